@@ -0,0 +1,199 @@
+package apidef
+
+// Version locations supported by VersionDefinition.Location.
+const (
+	HeaderLocation   = "header"
+	URLParamLocation = "url-param"
+)
+
+// Load balancing algorithms supported by ProxyConfig.LoadBalancing.
+const (
+	RoundRobin         = "round_robin"
+	WeightedRoundRobin = "weighted_round_robin"
+	LeastConnections   = "least_connections"
+	ConsistentHash     = "consistent_hash"
+)
+
+// Values of ProxyConfig.HashOn.
+const (
+	HashOnIP     = "ip"
+	HashOnHeader = "header"
+)
+
+// ProtocolGRPC is the APIDefinition.Protocol of APIs proxying gRPC.
+const ProtocolGRPC = "grpc"
+
+// RaspberryEvent is the name of an event the gateway can fire.
+type RaspberryEvent string
+
+// Handler names supported by EventHandlerTriggerConfig.Handler.
+const (
+	WebHookHandler = "eh_web_hook_handler"
+	LogHandler     = "eh_log_handler"
+)
+
+// AuthConfig describes where the API key is read from.
+type AuthConfig struct {
+	AuthHeaderName string `bson:"auth_header_name" json:"auth_header_name"`
+}
+
+// VersionDefinition describes how the requested version is read from a
+// request.
+type VersionDefinition struct {
+	Location string `bson:"location" json:"location"`
+	Key      string `bson:"key" json:"key"`
+}
+
+// VersionInfo describes a single version of an API.
+type VersionInfo struct {
+	Name           string `bson:"name" json:"name"`
+	Expires        string `bson:"expires" json:"expires"`
+	OverrideTarget string `bson:"override_target" json:"override_target"`
+}
+
+// VersionData holds the versions of an API.
+type VersionData struct {
+	NotVersioned   bool                   `bson:"not_versioned" json:"not_versioned"`
+	DefaultVersion string                 `bson:"default_version" json:"default_version"`
+	Versions       map[string]VersionInfo `bson:"versions" json:"versions"`
+}
+
+// UpstreamTarget is one of the upstreams an API balances requests across.
+// A target without a weight has a weight of 1, a weight of 0 drains it.
+type UpstreamTarget struct {
+	URL    string `bson:"url" json:"url"`
+	Weight *int   `bson:"weight" json:"weight"`
+}
+
+// UpstreamTLS configures the TLS connections to the https upstreams of an
+// API. CertFile and KeyFile are the client certificate presented to them
+// and CAFile the PEM bundle their certificates are verified against, the
+// system roots when empty. PinnedPublicKeys are base64 SHA-256 hashes of
+// certificate public keys (SPKI), one of which the upstream's certificate
+// chain must have. InsecureSkipVerify turns off the verification of the
+// upstream certificate, pins are still checked.
+type UpstreamTLS struct {
+	CertFile           string   `bson:"cert_file" json:"cert_file"`
+	KeyFile            string   `bson:"key_file" json:"key_file"`
+	CAFile             string   `bson:"ca_file" json:"ca_file"`
+	PinnedPublicKeys   []string `bson:"pinned_public_keys" json:"pinned_public_keys"`
+	InsecureSkipVerify bool     `bson:"ssl_insecure_skip_verify" json:"ssl_insecure_skip_verify"`
+}
+
+// ForwardedHeaders configures the headers telling the upstream where a
+// request came from. X-Forwarded-For always has the client appended to it.
+// Forwarded adds an RFC 7239 element for the hop to the gateway, XForwarded
+// sets X-Forwarded-Proto and X-Forwarded-Host when the client didn't, and
+// Via adds the gateway to the Via header. StripClientHeaders drops the ones
+// the client sent first, X-Forwarded-For then starts with the client IP
+// worked out from the trusted proxies.
+type ForwardedHeaders struct {
+	Forwarded          bool `bson:"forwarded" json:"forwarded"`
+	XForwarded         bool `bson:"x_forwarded" json:"x_forwarded"`
+	Via                bool `bson:"via" json:"via"`
+	StripClientHeaders bool `bson:"strip_client_headers" json:"strip_client_headers"`
+}
+
+// ProxyConfig describes where an API listens and what it proxies to. When
+// Targets is set, requests are balanced across them and TargetURL is
+// ignored. With EnableHTTP2 requests are sent to the upstream over HTTP/2,
+// negotiated over TLS for https targets and as h2c for http ones.
+type ProxyConfig struct {
+	ListenPath      string           `bson:"listen_path" json:"listen_path"`
+	TargetURL       string           `bson:"target_url" json:"target_url"`
+	StripListenPath bool             `bson:"strip_listen_path" json:"strip_listen_path"`
+	Targets         []UpstreamTarget `bson:"targets" json:"targets"`
+	LoadBalancing   string           `bson:"load_balancing" json:"load_balancing"`
+	HashOn          string           `bson:"hash_on" json:"hash_on"`
+	HashHeader      string           `bson:"hash_header" json:"hash_header"`
+	EnableHTTP2     bool             `bson:"enable_http2" json:"enable_http2"`
+	UpstreamTLS     UpstreamTLS      `bson:"upstream_tls" json:"upstream_tls"`
+
+	ForwardedHeaders ForwardedHeaders `bson:"forwarded_headers" json:"forwarded_headers"`
+}
+
+// UpstreamHealthCheck configures the health checks of an API's targets.
+// Targets are probed actively when Path is set, and marked down passively
+// after PassiveFailures consecutive 5xx responses or errors when that is
+// set.
+type UpstreamHealthCheck struct {
+	Path               string `bson:"path" json:"path"`
+	Interval           int    `bson:"interval" json:"interval"`
+	Timeout            int    `bson:"timeout" json:"timeout"`
+	ExpectedStatus     int    `bson:"expected_status" json:"expected_status"`
+	ExpectedBody       string `bson:"expected_body" json:"expected_body"`
+	HealthyThreshold   int    `bson:"healthy_threshold" json:"healthy_threshold"`
+	UnhealthyThreshold int    `bson:"unhealthy_threshold" json:"unhealthy_threshold"`
+	PassiveFailures    int    `bson:"passive_failures" json:"passive_failures"`
+}
+
+// CircuitBreakerMeta configures a circuit breaker for the requests of an API
+// whose path, relative to the listen path, matches the Path regular
+// expression and whose method is Method (any method when empty). The
+// breaker trips once ThresholdPercent (0 to 1) of the last Samples requests
+// failed, and lets a single request through again after
+// ReturnToServiceAfter seconds.
+type CircuitBreakerMeta struct {
+	Path                 string  `bson:"path" json:"path"`
+	Method               string  `bson:"method" json:"method"`
+	ThresholdPercent     float64 `bson:"threshold_percent" json:"threshold_percent"`
+	Samples              int     `bson:"samples" json:"samples"`
+	ReturnToServiceAfter int     `bson:"return_to_service_after" json:"return_to_service_after"`
+}
+
+// EventHandlerTriggerConfig is a handler to run when an event fires, the
+// content of HandlerMeta depends on the handler.
+type EventHandlerTriggerConfig struct {
+	Handler     string                 `bson:"handler_name" json:"handler_name"`
+	HandlerMeta map[string]interface{} `bson:"handler_meta" json:"handler_meta"`
+}
+
+// EventHandlerMetaConfig lists the handlers of each event.
+type EventHandlerMetaConfig struct {
+	Events map[RaspberryEvent][]EventHandlerTriggerConfig `bson:"events" json:"events"`
+}
+
+// GRPCMethod configures the calls to a gRPC method, given as
+// /package.Service/Method, or to every method of a service with
+// /package.Service/*. TargetURL routes the calls to a different upstream,
+// UseKeylessAccess lets them through without a key and Rate and Per limit
+// the calls each key may make to the method.
+type GRPCMethod struct {
+	Method           string  `bson:"method" json:"method"`
+	TargetURL        string  `bson:"target_url" json:"target_url"`
+	UseKeylessAccess bool    `bson:"use_keyless" json:"use_keyless"`
+	Rate             float64 `bson:"rate" json:"rate"`
+	Per              float64 `bson:"per" json:"per"`
+}
+
+// APIDefinition represents the configuration for a single proxied API and it's versions.
+// Domain limits the API to requests for that host name. With
+// UseMutualTLSAuth clients must present a certificate issued by a CA in
+// ClientCAFile, or one whose SHA-256 fingerprint is in ClientCertificates.
+type APIDefinition struct {
+	APIID              string                 `bson:"api_id" json:"api_id"`
+	OrgID              string                 `bson:"org_id" json:"org_id"`
+	Name               string                 `bson:"name" json:"name"`
+	Slug               string                 `bson:"slug" json:"slug"`
+	Active             bool                   `bson:"active" json:"active"`
+	UseKeylessAccess   bool                   `bson:"use_keyless" json:"use_keyless"`
+	Auth               AuthConfig             `bson:"auth" json:"auth"`
+	VersionDefinition  VersionDefinition      `bson:"definition" json:"definition"`
+	VersionData        VersionData            `bson:"version_data" json:"version_data"`
+	Proxy              ProxyConfig            `bson:"proxy" json:"proxy"`
+	HealthCheck        UpstreamHealthCheck    `bson:"health_check" json:"health_check"`
+	CircuitBreakers    []CircuitBreakerMeta   `bson:"circuit_breakers" json:"circuit_breakers"`
+	EventHandlers      EventHandlerMetaConfig `bson:"event_handlers" json:"event_handlers"`
+	Protocol           string                 `bson:"protocol" json:"protocol"`
+	GRPCMethods        []GRPCMethod           `bson:"grpc_methods" json:"grpc_methods"`
+	Domain             string                 `bson:"domain" json:"domain"`
+	UseMutualTLSAuth   bool                   `bson:"use_mutual_tls_auth" json:"use_mutual_tls_auth"`
+	ClientCAFile       string                 `bson:"client_ca_file" json:"client_ca_file"`
+	ClientCertificates []string               `bson:"client_certificates" json:"client_certificates"`
+
+	// AllowedIPs and DeniedIPs are the IPs and CIDRs the API may be called
+	// from, and may not be. DeniedIPs take precedence, an empty AllowedIPs
+	// allows every address.
+	AllowedIPs []string `bson:"allowed_ips" json:"allowed_ips"`
+	DeniedIPs  []string `bson:"denied_ips" json:"denied_ips"`
+}
@@ -2,10 +2,10 @@ package cli
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
-	"tyk/cli/linter"
 
+	"github.com/raspberry-gateway/raspberry/cli/linter"
+	"github.com/raspberry-gateway/raspberry/cli/reencrypt"
 	logger "github.com/raspberry-gateway/raspberry/log"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
@@ -62,7 +62,7 @@ func Init(version string, confPaths []string) {
 	LogInstrumentation = startCmd.Flag("log-instrumentation", "output instrumentation output to stdout").Bool()
 
 	startCmd.Action(func(ctx *kingpin.ParseContext) error {
-		DefalutMode = true
+		DefaultMode = true
 		return nil
 	})
 	startCmd.Default()
@@ -70,11 +70,7 @@ func Init(version string, confPaths []string) {
 	// Linter
 	lintCmd := app.Command("lint", "Runs a linter on Raspberry configuration file")
 	lintCmd.Action(func(c *kingpin.ParseContext) error {
-		confSchema, err := ioutil.ReadFile("cli/linter/schema.json")
-		if err != nil {
-			return err
-		}
-		path, lines, err := linter.Run(string(confSchema), confPaths)
+		path, lines, err := linter.Run(confPaths)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
@@ -91,4 +87,33 @@ func Init(version string, confPaths []string) {
 		return nil
 	})
 
+	// Session re-encryption
+	reencryptCmd := app.Command("reencrypt", "Encrypts the stored sessions again with the current session encryption key")
+	reencryptConf := reencryptCmd.Flag("conf", "load a named configuration file").PlaceHolder("FILE").String()
+	reencryptCmd.Action(func(c *kingpin.ParseContext) error {
+		paths := confPaths
+		if *reencryptConf != "" {
+			paths = []string{*reencryptConf}
+		}
+		n, lines, err := reencrypt.Run(paths)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("encrypted %d sessions again\n", n)
+		if len(lines) == 0 {
+			os.Exit(0)
+		}
+		fmt.Println("sessions left as they were:")
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		os.Exit(1)
+		return nil
+	})
+}
+
+// Parse parses the command-line arguments.
+func Parse() {
+	kingpin.MustParse(app.Parse(os.Args[1:]))
 }
@@ -0,0 +1,33 @@
+package linter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/raspberry-gateway/raspberry/config"
+)
+
+// Run will lint the configuration file. It will return the path to the
+// config file that was checked, a list of human readable issues and an
+// error if the file could not be read at all.
+func Run(paths []string) (string, []string, error) {
+	var conf config.Config
+	if err := config.Load(paths, &conf); err != nil {
+		return "", nil, err
+	}
+
+	fileBytes, err := ioutil.ReadFile(conf.OriginalPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var lines []string
+	dec := json.NewDecoder(bytes.NewReader(fileBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config.Config{}); err != nil {
+		lines = append(lines, fmt.Sprintf("%s: %v", conf.OriginalPath, err))
+	}
+	return conf.OriginalPath, lines, nil
+}
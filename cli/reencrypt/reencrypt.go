@@ -0,0 +1,61 @@
+package reencrypt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/storage"
+)
+
+// Run encrypts the sessions in the storage of the configuration file at
+// paths again with the current key of its keyring. It returns how many
+// sessions were encrypted again, a human readable line for each one that
+// couldn't be, and an error if the storage couldn't be used at all.
+// Sessions written by gateways while it runs are encrypted with the
+// current key already.
+func Run(paths []string) (int, []string, error) {
+	var conf config.Config
+	if err := config.Load(paths, &conf); err != nil {
+		return 0, nil, err
+	}
+	if !conf.SessionEncryption.Enabled {
+		return 0, nil, errors.New("session_encryption is not enabled in " + conf.OriginalPath)
+	}
+	if conf.Storage.Type == "" || conf.Storage.Type == "memory" {
+		// each process has its own, there is nothing stored to encrypt
+		return 0, nil, errors.New("storage type memory isn't persistent, reencrypt needs redis or file storage")
+	}
+	keys, err := storage.LoadKeyring(conf.SessionEncryption, conf.Secret)
+	if err != nil {
+		return 0, nil, fmt.Errorf("session_encryption: %v", err)
+	}
+	store, err := storage.Connect(conf.Storage, storage.SessionKeyPrefix)
+	if err != nil {
+		return 0, nil, fmt.Errorf("storage: %v", err)
+	}
+
+	sessions := storage.NewEncryptedHandler(store, keys)
+	done := 0
+	var lines []string
+	for _, keyName := range store.GetKeys("") {
+		changed, err := sessions.Reencrypt(keyName)
+		switch {
+		case err == storage.ErrKeyNotFound:
+			// expired or deleted since it was listed
+		case err != nil:
+			lines = append(lines, fmt.Sprintf("%s: %v", mask(keyName), err))
+		case changed:
+			done++
+		}
+	}
+	return done, lines, nil
+}
+
+// mask hides most of keyName, which may be an API key.
+func mask(keyName string) string {
+	if len(keyName) <= 4 {
+		return "****"
+	}
+	return keyName[:4] + "****"
+}
@@ -28,6 +28,12 @@ var (
 		ListenPort:   8080,
 		Secret:       "352d20ee67be67f6340b4c0605b044b7",
 		TemplatePath: "templates",
+		AppPath:      "apps/",
+		DnsCache: DnsCacheConfig{
+			TTL:                       dnsCacheDefaultTtl,
+			CheckInterval:             dnsCacheDefaultCheckInterval,
+			MultipleIPsHandleStrategy: NoCacheStrategy,
+		},
 	}
 )
 
@@ -76,6 +82,8 @@ type StorageOptionsConf struct {
 	EnableCluster         bool              `json:"enable_cluster"`
 	UseSSL                bool              `json:"use_ssl"`
 	SSLInsecureSkipVerify bool              `json:"ssl_insecure_skip_verify"`
+	Path                  string            `json:"path"`
+	SweepInterval         int               `json:"sweep_interval"`
 }
 
 type NormalisedURLConfig struct {
@@ -104,6 +112,25 @@ type AnalyticsConfigConfig struct {
 	ignoredIPsCompiled      map[string]bool
 }
 
+// loadIgnoredIPs compiles IgnoredIPs for StoreAnalytics.
+func (a *AnalyticsConfigConfig) loadIgnoredIPs() {
+	a.ignoredIPsCompiled = make(map[string]bool, len(a.IgnoredIPs))
+	for _, ip := range a.IgnoredIPs {
+		a.ignoredIPsCompiled[ip] = true
+	}
+}
+
+// StoreAnalytics reports whether requests from ip should be recorded.
+func (a *AnalyticsConfigConfig) StoreAnalytics(ip string) bool {
+	if len(a.ignoredIPsCompiled) == 0 {
+		return true
+	}
+	return !a.ignoredIPsCompiled[ip]
+}
+
+// HealthCheckConfig turns upstream health checking on. HealthCheckValueTimeout
+// is how many seconds a target marked down by passive checks stays out of
+// rotation when its API has no active checks to bring it back.
 type HealthCheckConfig struct {
 	EnableHealthChecks      bool  `json:"enable_health_checks"`
 	HealthCheckValueTimeout int64 `json:"health_check_value_timeouts"`
@@ -113,12 +140,37 @@ type LivenessCheckConfig struct {
 	CheckDuration time.Duration `json:"check_duration"`
 }
 
+// DnsCacheConfig configures the cache of upstream host name lookups. TTL is
+// how many seconds a lookup is cached for, MultipleIPsHandleStrategy how a
+// host resolving to several addresses is handled.
 type DnsCacheConfig struct {
-	Enbaled bool  `json:"enabled"`
+	Enabled bool  `json:"enabled"`
 	TTL     int64 `json:"ttl"`
 	// CheckInterval controls cache cleanup interval. By convention shouldn't be exposed to config or env_variable_setup
-	CheckInterval            int64             `json:"check_interval"`
-	MultipleIPsHandleStategy IPsHandleStrategy `json:"multiple_ips_handle_stategy"`
+	CheckInterval             int64             `json:"check_interval"`
+	MultipleIPsHandleStrategy IPsHandleStrategy `json:"multiple_ips_handle_strategy"`
+}
+
+// UnmarshalJSON also accepts multiple_ips_handle_stategy, the key's former
+// misspelling, when multiple_ips_handle_strategy isn't set.
+func (c *DnsCacheConfig) UnmarshalJSON(data []byte) error {
+	type plain DnsCacheConfig
+	aux := struct {
+		*plain
+		Strategy   *IPsHandleStrategy `json:"multiple_ips_handle_strategy"`
+		Deprecated *IPsHandleStrategy `json:"multiple_ips_handle_stategy"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	switch {
+	case aux.Strategy != nil:
+		c.MultipleIPsHandleStrategy = *aux.Strategy
+	case aux.Deprecated != nil:
+		log.Warning("dns_cache.multiple_ips_handle_stategy is deprecated, use multiple_ips_handle_strategy")
+		c.MultipleIPsHandleStrategy = *aux.Deprecated
+	}
+	return nil
 }
 
 type MonitorConfig struct {
@@ -132,7 +184,7 @@ type MonitorConfig struct {
 type WebHookHandlerConf struct {
 	Method       string            `bson:"method" json:"method"`
 	TargetPath   string            `bson:"target_path" json:"target_path"`
-	TemplatePath string            `bson:"template_path" josn:"template_path"`
+	TemplatePath string            `bson:"template_path" json:"template_path"`
 	HeaderList   map[string]string `bson:"header_map" json:"header_map"`
 	EventTimeout int64             `bson:"event_timeout" json:"event_timeout"`
 }
@@ -163,10 +215,10 @@ type HttpServerOptionsConfig struct {
 	OverrideDefaults       bool       `json:"override_defaults"`
 	ReadTimeout            int        `json:"read_timeout"`
 	WriteTimeout           int        `json:"write_timeout"`
-	UseSSL                 bool       `json:'use_ssl'`
+	UseSSL                 bool       `json:"use_ssl"`
 	UseLe_SSL              bool       `json:"use_ssl_le"`
 	EnableHttp2            bool       `json:"enable_http2"`
-	SSLInsecureSkipVerify  bool       `json:"ssl_insecure_skip_verify"`
+	EnableH2c              bool       `json:"enable_h2c"`
 	EnableWebSockets       bool       `json:"enable_web_sockets"`
 	Certificates           []CertData `json:"certificates"`
 	SSLCertificates        []string   `json:"ssl_certificates"`
@@ -175,7 +227,44 @@ type HttpServerOptionsConfig struct {
 	FlushIntercal          int        `json:"flush_interval"`
 	SkipURLCleaning        bool       `json:"skip_url_cleaning"`
 	SkipTargetPathEscaping bool       `json:"skip_target_path_escaping"`
-	Ciphers                []string   `json:"cliphers"`
+	Ciphers                []string   `json:"ciphers"`
+
+	// WebSocketIdleTimeout is how many seconds a WebSocket connection may
+	// go without traffic in either direction before it is closed.
+	WebSocketIdleTimeout int `json:"websocket_idle_timeout"`
+
+	// ACME configures how certificates are requested with use_ssl_le.
+	ACME ACMEConfig `json:"acme"`
+
+	// ProxyProtocol configures PROXY protocol headers on the listener.
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol"`
+
+	// Deprecated: ignored, upstream certificate verification is turned off
+	// per API with proxy.upstream_tls.ssl_insecure_skip_verify.
+	SSLInsecureSkipVerify bool `json:"ssl_insecure_skip_verify"`
+}
+
+// ACMEConfig configures the ACME server certificates are issued by for
+// the domains of APIs. DirectoryURL defaults to Let's Encrypt, CAFile is
+// a PEM bundle trusted for talking to the server, for test servers such as
+// Pebble. HTTPPort is the plain HTTP port HTTP-01 challenges are answered
+// on, other requests to it are redirected to HTTPS. Without it only
+// TLS-ALPN-01 challenges are answered, on the main listener.
+type ACMEConfig struct {
+	DirectoryURL string `json:"directory_url"`
+	Email        string `json:"email"`
+	CAFile       string `json:"ca_file"`
+	HTTPPort     int    `json:"http_port"`
+}
+
+// ProxyProtocolConfig configures the PROXY protocol (v1 and v2) headers
+// load balancers send ahead of the connections they pass on. Headers are
+// only read from peers in TrustedCIDRs, which may also connect without
+// one. HeaderTimeout is how many seconds they have to send it.
+type ProxyProtocolConfig struct {
+	Enabled       bool     `json:"enabled"`
+	TrustedCIDRs  []string `json:"trusted_cidrs"`
+	HeaderTimeout int      `json:"header_timeout"`
 }
 
 type AuthOverrideConf struct {
@@ -186,7 +275,15 @@ type AuthOverrideConf struct {
 type CertData struct {
 	Name     string `json:"name"`
 	CertFile string `json:"cert_file"`
-	KeyFile  string `key_file`
+	KeyFile  string `json:"key_file"`
+}
+
+// SessionEncryptionConfig sets up the encryption of sessions at rest. The
+// keys are derived from the secrets in KeyFile, one per line with the one
+// encrypting first, or from Secret without a key file.
+type SessionEncryptionConfig struct {
+	Enabled bool   `json:"enabled"`
+	KeyFile string `json:"key_file"`
 }
 
 // Config is the configuration object used by raspberry to set up various parameters.
@@ -207,14 +304,73 @@ type Config struct {
 	AllowInsecureConfigs bool   `json:"allow_insecure_configs"`
 	PublicKeyPath        string `json:"public_key_path"`
 	AllowRemoteConfig    bool   `json:"allow_remote_config"`
+	TemplatePath         string `json:"template_path"`
+
+	// AppPath is the directory API definitions are loaded from. If empty,
+	// ListenPath and TargetURL define a single keyless API.
+	AppPath string `json:"app_path"`
+
+	// GracefulShutdownTimeoutDuration is how many seconds in-flight requests
+	// are given to complete on SIGTERM/SIGINT before connections are closed.
+	GracefulShutdownTimeoutDuration int `json:"graceful_shutdown_timeout_duration"`
+
+	// ListenPath is the path requests are intercepted on, TargetURL is the
+	// upstream they are proxied to.
+	ListenPath      string `json:"listen_path"`
+	TargetURL       string `json:"target_url"`
+	StripListenPath bool   `json:"strip_listen_path"`
+
+	// TrustedProxies are the CIDRs or IP addresses of the proxies whose
+	// ClientIPHeaders are believed when working out the client IP, in order
+	// of precedence. Without trusted proxies the peer address is used.
+	TrustedProxies  []string `json:"trusted_proxies"`
+	ClientIPHeaders []string `json:"client_ip_headers"`
+
+	// DeniedIPs are the IPs and CIDRs no API may be called from.
+	DeniedIPs []string `json:"denied_ips"`
+
+	HttpServerOptions HttpServerOptionsConfig `json:"http_server_options"`
+	HealthCheck       HealthCheckConfig       `json:"health_check"`
+	DnsCache          DnsCacheConfig          `json:"dns_cache"`
+	Storage           StorageOptionsConf      `json:"storage"`
+
+	// SessionEncryption encrypts the sessions kept in the storage.
+	SessionEncryption SessionEncryptionConfig `json:"session_encryption"`
+
+	// HashKeys stores sessions under a hash of their key made with
+	// HashKeyFunction, "murmur64" (the default), "murmur128" or "sha256".
+	// Sessions stored under a hash made with one of HashKeyFunctionFallback
+	// are still found, and moved to the current hash if keys are hashed.
+	HashKeys                bool     `json:"hash_keys"`
+	HashKeyFunction         string   `json:"hash_key_function"`
+	HashKeyFunctionFallback []string `json:"hash_key_function_fallback"`
+
+	EnableAnalytics bool                  `json:"enable_analytics"`
+	AnalyticsConfig AnalyticsConfigConfig `json:"analytics_config"`
+}
+
+// Global returns the current global configuration.
+func Global() Config {
+	return global.Load().(Config)
+}
+
+// SetGlobal replaces the global configuration.
+func SetGlobal(conf Config) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	global.Store(conf)
+}
+
+func init() {
+	SetGlobal(Config{})
 }
 
 // WriteDefault will set conf to the default config and write it to disk
 // in path, if the path is non-empty.
 func WriteDefault(path string, conf *Config) error {
-	_, b, _ := runtime.Caller(0)
+	_, b, _, _ := runtime.Caller(0)
 	configPath := filepath.Dir(b)
-	rootPath := filepath.Dir(cinfigPath)
+	rootPath := filepath.Dir(configPath)
 	Default.TemplatePath = filepath.Join(rootPath, "templates")
 
 	*conf = Default
@@ -270,4 +426,9 @@ func Load(paths []string, conf *Config) error {
 	if err := json.NewDecoder(r).Decode(&conf); err != nil {
 		return fmt.Errorf("couldn't unmarshal config: %v", err)
 	}
+	if err := envconfig.Process(envPrefix, conf); err != nil {
+		return fmt.Errorf("failed to process config env vars: %v", err)
+	}
+	conf.AnalyticsConfig.loadIgnoredIPs()
+	return nil
 }
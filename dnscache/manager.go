@@ -0,0 +1,147 @@
+// Package dnscache caches the host name lookups of upstream connections.
+package dnscache
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	logger "github.com/raspberry-gateway/raspberry/log"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logger.Get().WithField("prefix", "dnscache")
+
+// DialContextFunc dials a network address, as in net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Stats are the counters of a DnsCacheManager.
+type Stats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+// DnsCacheManager wraps dialers so host names are resolved through a
+// DnsCacheStorage, picking an address with the configured strategy.
+type DnsCacheManager struct {
+	strategy config.IPsHandleStrategy
+	storage  *DnsCacheStorage
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// NewDnsCacheManager returns a manager using strategy for hosts that
+// resolve to several addresses. Caching is off until InitDNSCaching.
+func NewDnsCacheManager(strategy config.IPsHandleStrategy) *DnsCacheManager {
+	return &DnsCacheManager{
+		strategy: strategy,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// InitDNSCaching starts caching lookups for ttl, removing expired entries
+// every checkInterval.
+func (m *DnsCacheManager) InitDNSCaching(ttl, checkInterval time.Duration) {
+	if m.storage != nil {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"ttl":      ttl,
+		"strategy": m.strategy,
+	}).Info("Initialising DNS cache")
+	m.storage = NewDnsCacheStorage(ttl, checkInterval)
+}
+
+// IsCacheEnabled reports whether lookups are cached.
+func (m *DnsCacheManager) IsCacheEnabled() bool {
+	return m != nil && m.storage != nil
+}
+
+// CacheStorage returns the cache, nil if caching is off.
+func (m *DnsCacheManager) CacheStorage() *DnsCacheStorage {
+	return m.storage
+}
+
+// Stats returns the hit and miss counters of the cache.
+func (m *DnsCacheManager) Stats() Stats {
+	if !m.IsCacheEnabled() {
+		return Stats{}
+	}
+	return Stats{
+		Hits:    m.storage.Hits(),
+		Misses:  m.storage.Misses(),
+		Entries: m.storage.Len(),
+	}
+}
+
+// DisposeCache stops the cleanup of the cache and empties it, for when the
+// manager is being replaced. Dialers already wrapped keep working.
+func (m *DnsCacheManager) DisposeCache() {
+	if m.storage == nil {
+		return
+	}
+	m.storage.Stop()
+	m.storage.Clear()
+}
+
+// WrapDialer returns a dial function that resolves the host through the
+// cache before dialing with dialer. A cached address that can't be dialed
+// is evicted so the next connection looks the host up again.
+func (m *DnsCacheManager) WrapDialer(dialer *net.Dialer) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return m.doCachedDial(ctx, dialer, network, address)
+	}
+}
+
+func (m *DnsCacheManager) doCachedDial(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	storage := m.storage
+	if storage == nil {
+		return d.DialContext(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, address)
+	}
+
+	addrs, cached := storage.Get(host)
+	ips := addrs.Addrs
+	if !cached {
+		ips, err = storage.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if m.strategy == config.NoCacheStrategy && len(ips) > 1 {
+			// leave hosts with several addresses to the dialer, which
+			// falls back between them
+			return d.DialContext(ctx, network, address)
+		}
+		storage.Set(host, ips)
+	}
+
+	ip := m.pickIP(ips)
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"host": host,
+			"ip":   ip,
+		}).Debug("Dial to cached address failed, evicting: ", err)
+		storage.Delete(host)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (m *DnsCacheManager) pickIP(ips []string) string {
+	if m.strategy != config.RandomStrategy || len(ips) == 1 {
+		return ips[0]
+	}
+	m.randMu.Lock()
+	defer m.randMu.Unlock()
+	return ips[m.rand.Intn(len(ips))]
+}
@@ -0,0 +1,147 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+)
+
+// testManager returns a manager whose lookups of "upstream.local" return
+// addrs, counting the lookups in *lookups.
+func testManager(strategy config.IPsHandleStrategy, ttl time.Duration, lookups *int, addrs ...string) *DnsCacheManager {
+	m := NewDnsCacheManager(strategy)
+	m.InitDNSCaching(ttl, 0)
+	m.storage.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		*lookups++
+		if host != "upstream.local" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+	return m
+}
+
+func dial(m *DnsCacheManager, address string) error {
+	conn, err := m.WrapDialer(&net.Dialer{Timeout: time.Second})(context.Background(), "tcp", address)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestCachedDial(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var lookups int
+	m := testManager(config.PickFirstStrategy, time.Minute, &lookups, "127.0.0.1", "127.0.0.2")
+	for i := 0; i < 3; i++ {
+		if err := dial(m, net.JoinHostPort("upstream.local", port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("want 1 lookup, got %d", lookups)
+	}
+	if stats := m.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// addresses are dialed directly
+	if err := dial(m, srv.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 1 {
+		t.Errorf("IP addresses shouldn't be looked up, got %d lookups", lookups)
+	}
+}
+
+func TestCachedDialExpiry(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var lookups int
+	m := testManager(config.PickFirstStrategy, 10*time.Millisecond, &lookups, "127.0.0.1")
+	dial(m, net.JoinHostPort("upstream.local", port))
+	time.Sleep(20 * time.Millisecond)
+	dial(m, net.JoinHostPort("upstream.local", port))
+	if lookups != 2 {
+		t.Errorf("want a new lookup after the TTL, got %d lookups", lookups)
+	}
+}
+
+func TestCachedDialFailureEvicts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	var lookups int
+	m := testManager(config.PickFirstStrategy, time.Minute, &lookups, "127.0.0.1")
+	if err := dial(m, net.JoinHostPort("upstream.local", port)); err == nil {
+		t.Fatal("expected dial to a closed port to fail")
+	}
+	if m.Stats().Entries != 0 {
+		t.Error("failed address should be evicted")
+	}
+}
+
+func TestNoCacheStrategy(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var lookups int
+	m := testManager(config.NoCacheStrategy, time.Minute, &lookups, "127.0.0.1", "127.0.0.2")
+	// a host with several addresses is left to the dialer to resolve
+	dial(m, "upstream.local:80")
+	if m.Stats().Entries != 0 {
+		t.Error("hosts with several addresses shouldn't be cached")
+	}
+
+	m = testManager(config.NoCacheStrategy, time.Minute, &lookups, "127.0.0.1")
+	if err := dial(m, net.JoinHostPort("upstream.local", port)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Stats().Entries != 1 {
+		t.Error("hosts with a single address should be cached")
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+	m := NewDnsCacheManager(config.RandomStrategy)
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[m.pickIP(ips)] = true
+	}
+	if len(seen) != len(ips) {
+		t.Errorf("want every address picked, got %v", seen)
+	}
+	if ip := NewDnsCacheManager(config.PickFirstStrategy).pickIP(ips); ip != ips[0] {
+		t.Errorf("pick_first should pick %s, got %s", ips[0], ip)
+	}
+}
+
+func TestStorageCleanup(t *testing.T) {
+	s := NewDnsCacheStorage(10*time.Millisecond, 10*time.Millisecond)
+	defer s.Stop()
+	s.Set("upstream.local", []string{"127.0.0.1"})
+
+	deadline := time.Now().Add(time.Second)
+	for s.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired entry wasn't removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
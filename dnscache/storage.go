@@ -0,0 +1,141 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DnsCacheItem is the cached result of a host name lookup.
+type DnsCacheItem struct {
+	Addrs      []string
+	expiration time.Time
+}
+
+// DnsCacheStorage caches host name lookups for a fixed time, expired
+// entries are removed every check interval.
+type DnsCacheStorage struct {
+	// accessed atomically, first for 64-bit alignment on 32-bit platforms
+	hits   uint64
+	misses uint64
+
+	expiration time.Duration
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.RWMutex
+	items map[string]DnsCacheItem
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewDnsCacheStorage returns a storage keeping lookups for expiration and
+// sweeping expired ones every checkInterval.
+func NewDnsCacheStorage(expiration, checkInterval time.Duration) *DnsCacheStorage {
+	s := &DnsCacheStorage{
+		expiration: expiration,
+		lookupHost: net.DefaultResolver.LookupHost,
+		items:      make(map[string]DnsCacheItem),
+		stop:       make(chan struct{}),
+	}
+	if checkInterval > 0 {
+		go s.cleanup(checkInterval)
+	}
+	return s
+}
+
+func (s *DnsCacheStorage) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for host, item := range s.items {
+				if now.After(item.expiration) {
+					delete(s.items, host)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Get returns the cached addresses of hostName, counting a hit or a miss.
+func (s *DnsCacheStorage) Get(hostName string) (DnsCacheItem, bool) {
+	s.mu.RLock()
+	item, ok := s.items[hostName]
+	s.mu.RUnlock()
+
+	if !ok || time.Now().After(item.expiration) {
+		atomic.AddUint64(&s.misses, 1)
+		return DnsCacheItem{}, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+	return item, true
+}
+
+// Set caches addrs as the addresses of hostName.
+func (s *DnsCacheStorage) Set(hostName string, addrs []string) {
+	s.mu.Lock()
+	s.items[hostName] = DnsCacheItem{Addrs: addrs, expiration: time.Now().Add(s.expiration)}
+	s.mu.Unlock()
+}
+
+// Delete removes hostName from the cache.
+func (s *DnsCacheStorage) Delete(hostName string) {
+	s.mu.Lock()
+	delete(s.items, hostName)
+	s.mu.Unlock()
+}
+
+// FetchItem returns the addresses of hostName from the cache, looking them
+// up and caching them on a miss.
+func (s *DnsCacheStorage) FetchItem(ctx context.Context, hostName string) ([]string, error) {
+	if item, ok := s.Get(hostName); ok {
+		return item.Addrs, nil
+	}
+	addrs, err := s.resolve(ctx, hostName)
+	if err != nil {
+		return nil, err
+	}
+	s.Set(hostName, addrs)
+	return addrs, nil
+}
+
+func (s *DnsCacheStorage) resolve(ctx context.Context, hostName string) ([]string, error) {
+	return s.lookupHost(ctx, hostName)
+}
+
+// Len returns the number of cached hosts.
+func (s *DnsCacheStorage) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.items)
+}
+
+// Hits returns how many lookups were answered from the cache.
+func (s *DnsCacheStorage) Hits() uint64 {
+	return atomic.LoadUint64(&s.hits)
+}
+
+// Misses returns how many lookups weren't in the cache.
+func (s *DnsCacheStorage) Misses() uint64 {
+	return atomic.LoadUint64(&s.misses)
+}
+
+// Clear removes every cached host.
+func (s *DnsCacheStorage) Clear() {
+	s.mu.Lock()
+	s.items = make(map[string]DnsCacheItem)
+	s.mu.Unlock()
+}
+
+// Stop stops the cleanup of expired entries.
+func (s *DnsCacheStorage) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/storage"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeCerts issues certificates for the domains of APIs when use_ssl_le is
+// set.
+var acmeCerts = &acmeManager{}
+
+// acmeStorage holds the certificates and account key of acmeCerts.
+var acmeStorage storage.Handler
+
+// acmeManager requests certificates from an ACME server for the domains of
+// the loaded APIs, and renews them before they expire.
+type acmeManager struct {
+	mu      sync.RWMutex
+	hosts   map[string]bool
+	manager *autocert.Manager
+}
+
+// configure starts issuing certificates from the server in conf, keeping
+// them in store.
+func (m *acmeManager) configure(conf config.ACMEConfig, store storage.Handler) error {
+	client := &acme.Client{DirectoryURL: conf.DirectoryURL}
+	if conf.CAFile != "" {
+		certs, err := loadCertificates(conf.CAFile)
+		if err != nil {
+			return fmt.Errorf("acme CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		for _, cert := range certs {
+			roots.AddCert(cert)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.manager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      storageCache{store},
+		HostPolicy: m.hostPolicy,
+		Client:     client,
+		Email:      conf.Email,
+	}
+	return nil
+}
+
+// updateHosts requests certificates for the domains of specs. Wildcards
+// and IP addresses can't be validated through HTTP-01 or TLS-ALPN-01, so
+// they are left out.
+func (m *acmeManager) updateHosts(specs []*APISpec) {
+	hosts := make(map[string]bool)
+	for _, spec := range specs {
+		domain := strings.ToLower(spec.Domain)
+		if domain == "" || strings.Contains(domain, "*") || net.ParseIP(domain) != nil {
+			continue
+		}
+		hosts[domain] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts = hosts
+}
+
+func (m *acmeManager) hostPolicy(_ context.Context, host string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.hosts[strings.ToLower(host)] {
+		return fmt.Errorf("acme: %s is not the domain of an API", host)
+	}
+	return nil
+}
+
+// handles reports whether the certificate for hello comes from the ACME
+// server, either for one of the domains or to answer a TLS-ALPN-01
+// challenge.
+func (m *acmeManager) handles(hello *tls.ClientHelloInfo) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.manager == nil {
+		return false
+	}
+	return isACMEChallenge(hello) || m.hosts[strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")]
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	manager := m.manager
+	m.mu.RUnlock()
+	return manager.GetCertificate(hello)
+}
+
+// httpHandler answers HTTP-01 challenges and redirects other requests to
+// HTTPS.
+func (m *acmeManager) httpHandler() http.Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.manager.HTTPHandler(nil)
+}
+
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// listenACMEChallenges serves HTTP-01 challenges on the acme http_port in
+// the background.
+func listenACMEChallenges(conf config.Config) error {
+	address := net.JoinHostPort(conf.ListenAddress, strconv.Itoa(conf.HttpServerOptions.ACME.HTTPPort))
+	ln, err := listenTCP(address)
+	if err != nil {
+		return err
+	}
+	mainLog.Infof("--> Answering ACME challenges on address: %s", ln.Addr())
+
+	srv := newServer(acmeCerts.httpHandler())
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			mainLog.Fatalf("ACME challenge server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// storageCache keeps ACME certificates and account keys in a
+// storage.Handler, so that every node shares them.
+type storageCache struct {
+	store storage.Handler
+}
+
+// Get implements autocert.Cache.
+func (c storageCache) Get(_ context.Context, key string) ([]byte, error) {
+	data, err := c.store.GetKey(key)
+	if err == storage.ErrKeyNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+// Put implements autocert.Cache.
+func (c storageCache) Put(_ context.Context, key string, data []byte) error {
+	return c.store.SetKey(key, string(data), 0)
+}
+
+// Delete implements autocert.Cache.
+func (c storageCache) Delete(_ context.Context, key string) error {
+	c.store.DeleteKey(key)
+	return nil
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/storage"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// unreachableACME is a directory that can't be reached, so tests fail
+// rather than request real certificates.
+const unreachableACME = "http://127.0.0.1:1/directory"
+
+// useACME sets up acmeCerts for the domains, returning a func restoring it.
+func useACME(t *testing.T, store storage.Handler, domains ...string) func() {
+	old := acmeCerts
+	acmeCerts = &acmeManager{}
+	if err := acmeCerts.configure(config.ACMEConfig{DirectoryURL: unreachableACME}, store); err != nil {
+		t.Fatal(err)
+	}
+	var specs []*APISpec
+	for _, domain := range domains {
+		specs = append(specs, buildSpec(t, "http://example.com", func(def *apidef.APIDefinition) {
+			def.Domain = domain
+		}))
+	}
+	acmeCerts.updateHosts(specs)
+	return func() { acmeCerts = old }
+}
+
+// dialedFor returns the common name of the certificate addr serves for
+// serverName.
+func dialedFor(t *testing.T, addr, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestStorageCache(t *testing.T) {
+	ctx := context.Background()
+	cache := storageCache{storage.NewMemoryStorageManager("acme-")}
+
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("want %v, got %v", autocert.ErrCacheMiss, err)
+	}
+	if err := cache.Put(ctx, "example.com", []byte("pem")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get(ctx, "example.com"); err != nil || string(data) != "pem" {
+		t.Fatalf("want pem, got %q %v", data, err)
+	}
+	if err := cache.Delete(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("want %v after delete, got %v", autocert.ErrCacheMiss, err)
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	defer useACME(t, storage.NewMemoryStorageManager(""), "API.example.com", "*.example.com", "127.0.0.1", "")()
+
+	ctx := context.Background()
+	if err := acmeCerts.hostPolicy(ctx, "api.example.com"); err != nil {
+		t.Errorf("want the domain of an API allowed, got %v", err)
+	}
+	for _, host := range []string{"other.example.com", "*.example.com", "127.0.0.1", ""} {
+		if err := acmeCerts.hostPolicy(ctx, host); err == nil {
+			t.Errorf("want %q refused", host)
+		}
+	}
+}
+
+func TestACMECertificates(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// a certificate another node already obtained
+	store := storage.NewMemoryStorageManager("acme-")
+	certFile, keyFile := writeTestCert(t, dir, "api.example.com")
+	certPEM, _ := ioutil.ReadFile(certFile)
+	keyPEM, _ := ioutil.ReadFile(keyFile)
+	store.SetKey("api.example.com", string(keyPEM)+string(certPEM), 0)
+	defer useACME(t, store, "api.example.com")()
+
+	staticCert, staticKey := writeTestCert(t, dir, "static.example.com")
+	defer setServerOptions(config.HttpServerOptionsConfig{
+		UseLe_SSL:    true,
+		Certificates: []config.CertData{{Name: "static", CertFile: staticCert, KeyFile: staticKey}},
+		ACME:         config.ACMEConfig{DirectoryURL: unreachableACME},
+	})()
+	defer func(old storage.Handler) { acmeStorage = old }(acmeStorage)
+	acmeStorage = store
+	addr, stop := serveProtocols(t)
+	defer stop()
+
+	for _, test := range []struct{ serverName, want string }{
+		{"api.example.com", "api.example.com"},
+		{"static.example.com", "static.example.com"},
+		{"other.example.com", "static.example.com"},
+	} {
+		if got := dialedFor(t, addr, test.serverName); got != test.want {
+			t.Errorf("%s: want the certificate for %s, got %s", test.serverName, test.want, got)
+		}
+	}
+
+	// clients that don't speak TLS-ALPN-01 still agree on a protocol
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "api.example.com"},
+	}}
+	if proto := getProto(t, client, "https://"+addr); proto != "HTTP/1.1" {
+		t.Errorf("want HTTP/1.1, got %s", proto)
+	}
+}
+
+func TestACMEWithoutCertificates(t *testing.T) {
+	defer useACME(t, storage.NewMemoryStorageManager(""), "api.example.com")()
+	defer setServerOptions(config.HttpServerOptionsConfig{UseLe_SSL: true})()
+	addr, stop := serveProtocols(t)
+	defer stop()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.com"})
+	if err == nil {
+		conn.Close()
+		t.Error("want the handshake to fail for a name without a certificate")
+	}
+}
+
+func TestACMEHTTPHandler(t *testing.T) {
+	defer useACME(t, storage.NewMemoryStorageManager(""), "api.example.com")()
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/widgets?page=2", nil)
+	rec := httptest.NewRecorder()
+	acmeCerts.httpHandler().ServeHTTP(rec, req)
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || loc != "https://api.example.com/widgets?page=2" {
+		t.Errorf("want a redirect to HTTPS, got %d %s", rec.Code, loc)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://api.example.com/.well-known/acme-challenge/unknown", nil)
+	rec = httptest.NewRecorder()
+	acmeCerts.httpHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("want %d for an unknown challenge, got %d", http.StatusNotFound, rec.Code)
+	}
+}
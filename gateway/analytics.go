@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/request"
+	"github.com/raspberry-gateway/raspberry/storage"
+)
+
+// analyticsKeyName is the list analytics records are appended to, for a
+// purger to collect.
+const analyticsKeyName = "raspberry-system-analytics"
+
+const (
+	defaultRecordsBufferSize = 1000
+	// recordsBufferFlushInterval is how often a worker writes the records
+	// it has buffered.
+	recordsBufferFlushInterval = 200 * time.Millisecond
+)
+
+// AnalyticsRecord describes a request handled by the gateway.
+type AnalyticsRecord struct {
+	Method        string     `json:"method"`
+	Host          string     `json:"host"`
+	Path          string     `json:"path"`
+	RawPath       string     `json:"raw_path"`
+	ContentLength int64      `json:"content_length"`
+	UserAgent     string     `json:"user_agent"`
+	Day           int        `json:"day"`
+	Month         time.Month `json:"month"`
+	Year          int        `json:"year"`
+	Hour          int        `json:"hour"`
+	ResponseCode  int        `json:"response_code"`
+	APIKey        string     `json:"api_key"`
+	TimeStamp     time.Time  `json:"timestamp"`
+	APIVersion    string     `json:"api_version"`
+	APIName       string     `json:"api_name"`
+	APIID         string     `json:"api_id"`
+	OrgID         string     `json:"org_id"`
+	RequestTime   int64      `json:"request_time"`
+	IPAddress     string     `json:"ip_address"`
+	Tags          []string   `json:"tags"`
+	ExpireAt      time.Time  `json:"expireAt"`
+
+	// Protocol is set for requests that weren't plain HTTP, such as
+	// "websocket".
+	Protocol string `json:"protocol,omitempty"`
+	// BytesIn and BytesOut count the bytes received from the client and
+	// sent back to it.
+	BytesIn  int64 `json:"bytes_in,omitempty"`
+	BytesOut int64 `json:"bytes_out,omitempty"`
+	// FramesIn and FramesOut count the WebSocket frames in each direction.
+	FramesIn  int64 `json:"frames_in,omitempty"`
+	FramesOut int64 `json:"frames_out,omitempty"`
+	// GRPCStatus is the name of the status a gRPC call ended with, such as
+	// "UNAVAILABLE". ResponseCode then holds the closest HTTP status.
+	GRPCStatus string `json:"grpc_status,omitempty"`
+	// ClientCertSubject and ClientCertFingerprint identify the certificate
+	// a client authenticated with over mutual TLS.
+	ClientCertSubject     string `json:"client_cert_subject,omitempty"`
+	ClientCertFingerprint string `json:"client_cert_fingerprint,omitempty"`
+}
+
+// SetExpiry sets when the record should be removed from the analytics
+// store, a non-positive expiry keeps it for 100 years.
+func (a *AnalyticsRecord) SetExpiry(expiresInSeconds int64) {
+	expiry := time.Duration(expiresInSeconds) * time.Second
+	if expiresInSeconds <= 0 {
+		expiry = 24 * 365 * 100 * time.Hour
+	}
+	a.ExpireAt = time.Now().Add(expiry)
+}
+
+// newAnalyticsRecord fills in the parts of a record that come from the
+// request, its spec and session.
+func newAnalyticsRecord(spec *APISpec, r *http.Request, code int, start time.Time) *AnalyticsRecord {
+	now := time.Now()
+	record := &AnalyticsRecord{
+		Method:        r.Method,
+		Host:          r.Host,
+		Path:          r.URL.Path,
+		RawPath:       r.URL.EscapedPath(),
+		ContentLength: r.ContentLength,
+		UserAgent:     r.UserAgent(),
+		Day:           start.Day(),
+		Month:         start.Month(),
+		Year:          start.Year(),
+		Hour:          start.Hour(),
+		ResponseCode:  code,
+		APIKey:        obfuscateKey(ctxGetAuthToken(r)),
+		TimeStamp:     start,
+		APIVersion:    ctxGetVersionName(r),
+		APIName:       spec.Name,
+		APIID:         spec.APIID,
+		OrgID:         spec.OrgID,
+		RequestTime:   int64(now.Sub(start) / time.Millisecond),
+		IPAddress:     request.RealIP(r),
+	}
+	if session := ctxGetSession(r); session != nil {
+		record.Tags = session.Tags
+	}
+	if cert := ctxGetClientCert(r); cert != nil {
+		record.ClientCertSubject = cert.Subject
+		record.ClientCertFingerprint = cert.Fingerprint
+	}
+	record.SetExpiry(int64(config.Global().AnalyticsConfig.StorageExpirationTime))
+	return record
+}
+
+// AnalyticsHandler buffers analytics records and writes them to the
+// analytics store from a pool of workers.
+type AnalyticsHandler struct {
+	Store storage.Handler
+
+	mu      sync.RWMutex // guards stopped and sending to records
+	stopped bool
+	records chan *AnalyticsRecord
+	wg      sync.WaitGroup
+}
+
+// NewAnalyticsHandler returns a handler writing to store.
+func NewAnalyticsHandler(store storage.Handler) *AnalyticsHandler {
+	return &AnalyticsHandler{Store: store}
+}
+
+// Init starts the workers, sized from the analytics_config.
+func (a *AnalyticsHandler) Init() {
+	conf := config.Global().AnalyticsConfig
+	workers := conf.PoolSize
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	bufferSize := conf.RecordsBufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultRecordsBufferSize
+	}
+
+	a.records = make(chan *AnalyticsRecord, bufferSize)
+	for i := 0; i < workers; i++ {
+		a.wg.Add(1)
+		go a.recordWorker()
+	}
+}
+
+// RecordHit queues record to be written. Records are dropped when the
+// buffer is full rather than holding up the request.
+func (a *AnalyticsHandler) RecordHit(record *AnalyticsRecord) {
+	conf := config.Global().AnalyticsConfig
+	if !conf.StoreAnalytics(record.IPAddress) {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.stopped {
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		log.WithField("prefix", "analytics").Warning("Analytics buffer full, dropping record")
+	}
+}
+
+// Stop writes the queued records and stops the workers.
+func (a *AnalyticsHandler) Stop() {
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		return
+	}
+	a.stopped = true
+	close(a.records)
+	a.mu.Unlock()
+	a.wg.Wait()
+}
+
+func (a *AnalyticsHandler) recordWorker() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(recordsBufferFlushInterval)
+	defer ticker.Stop()
+
+	var batch []string
+	flush := func() {
+		for _, data := range batch {
+			a.Store.AppendToSet(analyticsKeyName, data)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case record, ok := <-a.records:
+			if !ok {
+				flush()
+				return
+			}
+			data, err := json.Marshal(record)
+			if err != nil {
+				log.WithField("prefix", "analytics").Error("Couldn't encode analytics record: ", err)
+				continue
+			}
+			batch = append(batch, string(data))
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// recordAnalytics queues record if analytics are enabled.
+func recordAnalytics(record *AnalyticsRecord) {
+	if !config.Global().EnableAnalytics || analytics == nil {
+		return
+	}
+	analytics.RecordHit(record)
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/user"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// controlAPIPath is the path the control API is served under. Listen paths
+// of APIs may not use it.
+const controlAPIPath = "/raspberry"
+
+type apiStatusMessage struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiModifyKeySuccess struct {
+	Key     string `json:"key"`
+	KeyHash string `json:"key_hash,omitempty"`
+	Status  string `json:"status"`
+	Action  string `json:"action"`
+}
+
+type apiAllKeys struct {
+	APIKeys []string `json:"keys"`
+}
+
+func apiOk(msg string) apiStatusMessage {
+	return apiStatusMessage{"ok", msg}
+}
+
+func apiError(msg string) apiStatusMessage {
+	return apiStatusMessage{"error", msg}
+}
+
+func doJSONWrite(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set(headers.ContentType, headers.ApplicationJSON)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func controlAPILog(r *http.Request) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"prefix": "api",
+		"path":   r.URL.Path,
+		"method": r.Method,
+	})
+}
+
+// controlAPI returns the handler serving the control API.
+func controlAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(controlAPIPath+"/reload", reloadHandler)
+	mux.HandleFunc(controlAPIPath+"/health", healthHandler)
+	mux.HandleFunc(controlAPIPath+"/keys/create", createKeyHandler)
+	mux.HandleFunc(controlAPIPath+"/keys", keyHandler)
+	mux.HandleFunc(controlAPIPath+"/keys/", keyHandler)
+	return checkIsAPIOwner(mux)
+}
+
+// checkIsAPIOwner will ensure that the accessor of the control API has the
+// correct secret set in the X-Raspberry-Authorization header.
+func checkIsAPIOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := config.Global().Secret
+		given := r.Header.Get(headers.XRaspberryAuthorization)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+			controlAPILog(r).Warning("Attempted administrative access with invalid or missing key!")
+			doJSONWrite(w, http.StatusForbidden, apiError("Attempted administrative access with invalid or missing key!"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyHandler serves the sessions of keys. With ?hashed=true the path holds
+// the hash of a key, as listed, instead of the key.
+func keyHandler(w http.ResponseWriter, r *http.Request) {
+	keyName := strings.Trim(strings.TrimPrefix(r.URL.Path, controlAPIPath+"/keys"), "/")
+	hashed := r.URL.Query().Get("hashed") == "true"
+	if hashed && keyName != "" && !isKeyHash(keyName) {
+		doJSONWrite(w, http.StatusBadRequest, apiError("Key hash is malformed"))
+		return
+	}
+	if !hashed && isKeyHash(keyName) {
+		doJSONWrite(w, http.StatusBadRequest, apiError("Key names can't look like a key hash, add ?hashed=true to use a hash"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if keyName == "" {
+			doJSONWrite(w, http.StatusOK, apiAllKeys{GlobalSessionManager.Sessions("")})
+			return
+		}
+		handleGetKey(w, r, keyName, hashed)
+	case http.MethodPost, http.MethodPut:
+		if keyName == "" {
+			doJSONWrite(w, http.StatusBadRequest, apiError("Key name is required"))
+			return
+		}
+		handleAddOrUpdateKey(w, r, keyName, hashed)
+	case http.MethodDelete:
+		if keyName == "" {
+			doJSONWrite(w, http.StatusBadRequest, apiError("Key name is required"))
+			return
+		}
+		handleDeleteKey(w, r, keyName, hashed)
+	default:
+		doJSONWrite(w, http.StatusMethodNotAllowed, apiError("Method not supported"))
+	}
+}
+
+// keyHash returns the hash of keyName to report, if keys are hashed.
+func keyHash(keyName string, hashed bool) string {
+	if hashed {
+		return keyName
+	}
+	if !config.Global().HashKeys {
+		return ""
+	}
+	return GlobalSessionManager.KeyHash(keyName)
+}
+
+func handleGetKey(w http.ResponseWriter, r *http.Request, keyName string, hashed bool) {
+	session, ok := GlobalSessionManager.SessionDetail(keyName, hashed)
+	if !ok {
+		doJSONWrite(w, http.StatusNotFound, apiError("Key not found"))
+		return
+	}
+	controlAPILog(r).WithField("key", obfuscateKey(keyName)).Info("Retrieved key detail.")
+	doJSONWrite(w, http.StatusOK, session)
+}
+
+func handleAddOrUpdateKey(w http.ResponseWriter, r *http.Request, keyName string, hashed bool) {
+	var session user.SessionState
+	if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+		controlAPILog(r).Error("Couldn't decode new session object: ", err)
+		doJSONWrite(w, http.StatusBadRequest, apiError("Request malformed"))
+		return
+	}
+
+	action := "modified"
+	if _, exists := GlobalSessionManager.SessionDetail(keyName, hashed); !exists {
+		if hashed {
+			// a key can't be added without knowing it
+			doJSONWrite(w, http.StatusNotFound, apiError("Key not found"))
+			return
+		}
+		action = "added"
+	}
+	if err := GlobalSessionManager.UpdateSession(keyName, &session, session.Lifetime(), hashed); err != nil {
+		controlAPILog(r).Error("Couldn't store session: ", err)
+		doJSONWrite(w, http.StatusInternalServerError, apiError("Failed to store key"))
+		return
+	}
+
+	controlAPILog(r).WithField("key", obfuscateKey(keyName)).Info("Key ", action, ".")
+	doJSONWrite(w, http.StatusOK, apiModifyKeySuccess{Key: keyName, KeyHash: keyHash(keyName, hashed), Status: "ok", Action: action})
+}
+
+func handleDeleteKey(w http.ResponseWriter, r *http.Request, keyName string, hashed bool) {
+	if !GlobalSessionManager.RemoveSession(keyName, hashed) {
+		doJSONWrite(w, http.StatusNotFound, apiError("Key not found"))
+		return
+	}
+	controlAPILog(r).WithField("key", obfuscateKey(keyName)).Info("Deleted key.")
+	doJSONWrite(w, http.StatusOK, apiModifyKeySuccess{Key: keyName, KeyHash: keyHash(keyName, hashed), Status: "ok", Action: "deleted"})
+}
+
+func createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		doJSONWrite(w, http.StatusMethodNotAllowed, apiError("Method not supported"))
+		return
+	}
+
+	var session user.SessionState
+	if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+		controlAPILog(r).Error("Couldn't decode new session object: ", err)
+		doJSONWrite(w, http.StatusBadRequest, apiError("Request malformed"))
+		return
+	}
+
+	newKey := generateToken(session.OrgID)
+	if err := GlobalSessionManager.UpdateSession(newKey, &session, session.Lifetime(), false); err != nil {
+		controlAPILog(r).Error("Couldn't store session: ", err)
+		doJSONWrite(w, http.StatusInternalServerError, apiError("Failed to create key"))
+		return
+	}
+
+	controlAPILog(r).WithField("key", obfuscateKey(newKey)).Info("Generated new key.")
+	doJSONWrite(w, http.StatusOK, apiModifyKeySuccess{Key: newKey, KeyHash: keyHash(newKey, false), Status: "ok", Action: "added"})
+}
+
+// generateToken returns a new random key prefixed with the org ID.
+func generateToken(orgID string) string {
+	return orgID + strings.Replace(uuid.NewV4().String(), "-", "", -1)
+}
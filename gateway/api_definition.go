@@ -0,0 +1,281 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+)
+
+// RequestStatus is a custom type to avoid collisions
+type RequestStatus string
+
+// Statuses of the request, all are false-y except StatusOk
+const (
+	VersionNotFound     RequestStatus = "Version information not found"
+	VersionDoesNotExist RequestStatus = "This API version does not seem to exist"
+	VersionExpired      RequestStatus = "Api Version has expired, please check documentation or contact administrator"
+	StatusOk            RequestStatus = "Ok"
+)
+
+const expiryTimeFormat = "2006-01-02 15:04"
+
+var errEmptyTarget = errors.New("target_url is empty")
+
+// APISpec represents an APIDefinition that has been validated and had its
+// derived values, such as the parsed target, computed.
+type APISpec struct {
+	*apidef.APIDefinition
+
+	loadBalancer    *LoadBalancer
+	versionExpiry   map[string]time.Time
+	versionTargets  map[string]*url.URL
+	authHeaderName  string
+	versionLocation string
+	versionKey      string
+	circuitBreakers []*circuitBreaker
+	eventHandlers   map[apidef.RaspberryEvent][]RaspberryEventHandler
+	grpcMethods     map[string]*grpcMethod
+	upstreamTLS     *tls.Config
+	proxy           *ReverseProxy
+
+	// clientCAs and clientFingerprints authorise client certificates for
+	// APIs using mutual TLS.
+	clientCAs          *x509.CertPool
+	clientCACerts      []*x509.Certificate
+	clientFingerprints map[string]bool
+
+	// allowedIPs and deniedIPs are nil when the lists are empty.
+	allowedIPs *ipTrie
+	deniedIPs  *ipTrie
+}
+
+// APIDefinitionLoader will load an Api definition from a storage system.
+type APIDefinitionLoader struct{}
+
+// MakeSpec validates def and returns the APISpec built from it.
+func (a APIDefinitionLoader) MakeSpec(def *apidef.APIDefinition) (*APISpec, error) {
+	if def.APIID == "" {
+		return nil, errors.New("api_id is required")
+	}
+	spec := &APISpec{
+		APIDefinition:  def,
+		versionExpiry:  make(map[string]time.Time),
+		versionTargets: make(map[string]*url.URL),
+	}
+
+	spec.Proxy.ListenPath = cleanListenPath(def.Proxy.ListenPath)
+	lb, err := NewLoadBalancer(def.APIID, def.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	spec.loadBalancer = lb
+
+	spec.authHeaderName = def.Auth.AuthHeaderName
+	if spec.authHeaderName == "" {
+		spec.authHeaderName = headers.Authorization
+	}
+
+	spec.versionLocation = def.VersionDefinition.Location
+	if spec.versionLocation == "" {
+		spec.versionLocation = apidef.HeaderLocation
+	}
+	spec.versionKey = def.VersionDefinition.Key
+	if spec.versionKey == "" {
+		spec.versionKey = "x-api-version"
+	}
+
+	for name, v := range def.VersionData.Versions {
+		if v.Expires != "" {
+			t, err := time.Parse(expiryTimeFormat, v.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("version %q: invalid expiry date: %v", name, err)
+			}
+			spec.versionExpiry[name] = t
+		}
+		if v.OverrideTarget != "" {
+			t, err := parseTarget(v.OverrideTarget)
+			if err != nil {
+				return nil, fmt.Errorf("version %q: %v", name, err)
+			}
+			spec.versionTargets[name] = t
+		}
+	}
+	if def.VersionData.NotVersioned && len(def.VersionData.Versions) > 1 {
+		return nil, errors.New("not_versioned APIs can define a single version")
+	}
+	if !def.VersionData.NotVersioned && def.VersionData.DefaultVersion != "" {
+		if _, ok := def.VersionData.Versions[def.VersionData.DefaultVersion]; !ok {
+			return nil, fmt.Errorf("default version %q is not defined", def.VersionData.DefaultVersion)
+		}
+	}
+
+	switch def.Protocol {
+	case "":
+	case apidef.ProtocolGRPC:
+		if spec.grpcMethods, err = newGRPCMethods(def.GRPCMethods); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", def.Protocol)
+	}
+
+	if spec.upstreamTLS, err = newUpstreamTLSConfig(def.Proxy.UpstreamTLS); err != nil {
+		return nil, fmt.Errorf("upstream_tls: %v", err)
+	}
+
+	if spec.allowedIPs, err = newIPTrie(def.AllowedIPs); err != nil {
+		return nil, fmt.Errorf("allowed_ips: %v", err)
+	}
+	if spec.deniedIPs, err = newIPTrie(def.DeniedIPs); err != nil {
+		return nil, fmt.Errorf("denied_ips: %v", err)
+	}
+
+	if def.UseMutualTLSAuth {
+		if err := spec.initClientCertificates(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, meta := range def.CircuitBreakers {
+		cb, err := newCircuitBreaker(spec, meta)
+		if err != nil {
+			return nil, fmt.Errorf("circuit breaker %d: %v", i, err)
+		}
+		spec.circuitBreakers = append(spec.circuitBreakers, cb)
+	}
+	if err := spec.initEventHandlers(); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// isGRPC reports whether the API proxies gRPC.
+func (a *APISpec) isGRPC() bool {
+	return a.Protocol == apidef.ProtocolGRPC
+}
+
+// FromDir will load APIDefinitions from a directory on the filesystem. Definitions need
+// to be the JSON representation of APIDefinition object. Files that fail to
+// load are skipped and reported in the returned error.
+func (a APIDefinitionLoader) FromDir(dir string) ([]*APISpec, error) {
+	var specs []*APISpec
+	var failed []string
+	// Grab json files from directory
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range paths {
+		log.Info("Loading API Specification from ", path)
+		spec, err := a.loadDefFromFilePath(path)
+		if err != nil {
+			log.Errorf("Couldn't load API definition file %s: %v", path, err)
+			failed = append(failed, filepath.Base(path))
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	if len(failed) > 0 {
+		return specs, errors.New("couldn't load API definitions: " + strings.Join(failed, ", "))
+	}
+	return specs, nil
+}
+
+func (a APIDefinitionLoader) loadDefFromFilePath(path string) (*APISpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	def := &apidef.APIDefinition{}
+	if err := json.NewDecoder(f).Decode(def); err != nil {
+		return nil, err
+	}
+	return a.MakeSpec(def)
+}
+
+// legacyAPIDefinition returns a keyless, unversioned definition made from
+// the listen_path and target_url set in the gateway configuration.
+func legacyAPIDefinition(conf config.Config) *apidef.APIDefinition {
+	return &apidef.APIDefinition{
+		APIID:            "default",
+		Name:             "Default",
+		Active:           true,
+		UseKeylessAccess: true,
+		VersionData:      apidef.VersionData{NotVersioned: true},
+		Proxy: apidef.ProxyConfig{
+			ListenPath:      conf.ListenPath,
+			TargetURL:       conf.TargetURL,
+			StripListenPath: conf.StripListenPath,
+		},
+	}
+}
+
+func parseTarget(target string) (*url.URL, error) {
+	if target == "" {
+		return nil, errEmptyTarget
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("target_url must be an absolute URL: " + target)
+	}
+	return u, nil
+}
+
+func (a *APISpec) getVersionFromRequest(r *http.Request) string {
+	switch a.versionLocation {
+	case apidef.HeaderLocation:
+		return r.Header.Get(a.versionKey)
+	case apidef.URLParamLocation:
+		return r.URL.Query().Get(a.versionKey)
+	}
+	return ""
+}
+
+// Version returns the version the request is made against and whether
+// that version can be used.
+func (a *APISpec) Version(r *http.Request) (*apidef.VersionInfo, RequestStatus) {
+	if a.VersionData.NotVersioned {
+		for name, v := range a.VersionData.Versions {
+			if v.Name == "" {
+				v.Name = name
+			}
+			return &v, StatusOk
+		}
+		return &apidef.VersionInfo{}, StatusOk
+	}
+
+	name := a.getVersionFromRequest(r)
+	if name == "" {
+		name = a.VersionData.DefaultVersion
+	}
+	if name == "" {
+		return nil, VersionNotFound
+	}
+
+	v, ok := a.VersionData.Versions[name]
+	if !ok {
+		return nil, VersionDoesNotExist
+	}
+	if v.Name == "" {
+		v.Name = name
+	}
+	if expiry, ok := a.versionExpiry[name]; ok && time.Now().After(expiry) {
+		return &v, VersionExpired
+	}
+	return &v, StatusOk
+}
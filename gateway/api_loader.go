@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/sirupsen/logrus"
+)
+
+// loadAPISpecs returns the API definitions found in app_path. When no
+// app_path is configured the listen_path and target_url of the gateway
+// configuration are used as a single keyless API. Definitions that loaded
+// are returned alongside any error.
+func loadAPISpecs(conf config.Config) ([]*APISpec, error) {
+	loader := APIDefinitionLoader{}
+	if conf.AppPath == "" {
+		spec, err := loader.MakeSpec(legacyAPIDefinition(conf))
+		if err != nil {
+			return nil, err
+		}
+		return []*APISpec{spec}, nil
+	}
+
+	mainLog.Info("Loading API configurations from ", conf.AppPath)
+	specs, err := loader.FromDir(conf.AppPath)
+	if err == nil && len(specs) == 0 {
+		err = errors.New("no API definitions found in " + conf.AppPath)
+	}
+	return specs, err
+}
+
+// loadApps builds the router serving specs and the control API.
+func loadApps(specs []*APISpec) *router {
+	rt := &router{}
+	rt.handle(controlAPIPath, controlAPI())
+
+	listenPaths := map[string]string{controlAPIPath: "control API"}
+	var loaded []*APISpec
+	for _, spec := range specs {
+		logger := mainLog.WithFields(logrus.Fields{
+			"api_id":   spec.APIID,
+			"api_name": spec.Name,
+		})
+		if !spec.Active {
+			logger.Info("Skipping inactive API")
+			continue
+		}
+		route := spec.Domain + spec.Proxy.ListenPath
+		other, ok := listenPaths[route]
+		if !ok && spec.Proxy.ListenPath == controlAPIPath {
+			other, ok = listenPaths[controlAPIPath]
+		}
+		if ok {
+			logger.Errorf("Listen path %s is already used by %s, skipping", route, other)
+			continue
+		}
+		listenPaths[route] = spec.APIID
+
+		rt.handleDomain(spec.Domain, spec.Proxy.ListenPath, processSpec(spec))
+		loaded = append(loaded, spec)
+		logger.Infof("Loaded: %s -> %s", spec.Proxy.ListenPath, spec.loadBalancer)
+	}
+	rt.specs = loaded
+	GlobalHostChecker.Update(loaded)
+	serverCerts.updateClientAuth(loaded)
+	acmeCerts.updateHosts(loaded)
+	return rt
+}
+
+// processSpec builds the middleware chain for spec, ending in the proxy.
+func processSpec(spec *APISpec) http.Handler {
+	base := BaseMiddleware{Spec: spec}
+
+	var chain []RaspberryMiddleware
+	mwAppendEnabled(&chain, &IPAccessCheck{BaseMiddleware: base})
+	mwAppendEnabled(&chain, &ClientCertificateCheck{BaseMiddleware: base})
+	mwAppendEnabled(&chain, &VersionCheck{BaseMiddleware: base})
+	mwAppendEnabled(&chain, &GRPCMethodCheck{BaseMiddleware: base})
+	mwAppendEnabled(&chain, &AuthKey{BaseMiddleware: base})
+	mwAppendEnabled(&chain, &RateLimitAndQuotaCheck{BaseMiddleware: base})
+	mwAppendEnabled(&chain, &CircuitBreaker{BaseMiddleware: base})
+
+	spec.proxy = NewReverseProxy(spec)
+	return buildChain(chain, spec.proxy)
+}
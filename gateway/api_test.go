@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/storage"
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+func doRequest(h http.Handler, method, path string, hdrs map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range hdrs {
+		r.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestControlAPIKeys(t *testing.T) {
+	rt := loadApps(nil)
+	admin := map[string]string{headers.XRaspberryAuthorization: testSecret}
+
+	if rec := doRequest(rt, http.MethodGet, "/raspberry/keys", nil, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected %d without secret, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec := doRequest(rt, http.MethodPost, "/raspberry/keys/create", admin, `{"rate": 10, "per": 1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create: expected %d got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	var created apiModifyKeySuccess
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.Key == "" || created.Action != "added" {
+		t.Fatalf("unexpected create response %+v", created)
+	}
+
+	rec = doRequest(rt, http.MethodGet, "/raspberry/keys/"+created.Key, admin, "")
+	var session user.SessionState
+	json.NewDecoder(rec.Body).Decode(&session)
+	if rec.Code != http.StatusOK || session.Rate != 10 {
+		t.Fatalf("get: unexpected response %d %+v", rec.Code, session)
+	}
+
+	if rec := doRequest(rt, http.MethodDelete, "/raspberry/keys/"+created.Key, admin, ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete: expected %d got %d", http.StatusOK, rec.Code)
+	}
+	if rec := doRequest(rt, http.MethodGet, "/raspberry/keys/"+created.Key, admin, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get deleted: expected %d got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestKeyAuthAndRateLimit(t *testing.T) {
+	upstream := testUpstream()
+	defer upstream.Close()
+
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseKeylessAccess = false
+		def.Auth.AuthHeaderName = "x-api-key"
+	})
+	rt := loadApps([]*APISpec{spec})
+
+	if rec := doRequest(rt, http.MethodGet, "/", nil, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no key: expected %d got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": "nope"}, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("unknown key: expected %d got %d", http.StatusForbidden, rec.Code)
+	}
+
+	other := createSession(t, &user.SessionState{
+		AccessRights: map[string]user.AccessDefinition{"other": {APIID: "other"}},
+	})
+	if rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": other}, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("no access rights: expected %d got %d", http.StatusForbidden, rec.Code)
+	}
+
+	key := createSession(t, &user.SessionState{Rate: 2, Per: 60})
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": key}, ""); rec.Code != expected {
+			t.Errorf("request %d: expected %d got %d", i, expected, rec.Code)
+		}
+	}
+
+	quotaKey := createSession(t, &user.SessionState{QuotaMax: 1, QuotaRenewalRate: 60})
+	rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": quotaKey}, "")
+	if rec.Code != http.StatusOK || rec.Header().Get(headers.XRateLimitRemaining) != "0" {
+		t.Errorf("quota: expected %d with 0 remaining, got %d %q", http.StatusOK, rec.Code, rec.Header().Get(headers.XRateLimitRemaining))
+	}
+	if rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": quotaKey}, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("quota exceeded: expected %d got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	upstream := testUpstream()
+	defer upstream.Close()
+	override := testUpstream()
+	defer override.Close()
+
+	spec := buildSpec(t, upstream.URL+"/v1", func(def *apidef.APIDefinition) {
+		def.VersionData = apidef.VersionData{
+			DefaultVersion: "v1",
+			Versions: map[string]apidef.VersionInfo{
+				"v1":  {Name: "v1"},
+				"v2":  {Name: "v2", OverrideTarget: override.URL + "/v2"},
+				"old": {Name: "old", Expires: "2000-01-01 00:00"},
+			},
+		}
+	})
+	rt := loadApps([]*APISpec{spec})
+
+	tests := []struct {
+		version string
+		code    int
+		body    string
+	}{
+		{"", http.StatusOK, "/v1/"},
+		{"v2", http.StatusOK, "/v2/"},
+		{"old", http.StatusForbidden, ""},
+		{"v3", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-version": test.version}, "")
+		if rec.Code != test.code {
+			t.Errorf("version %q: expected %d got %d", test.version, test.code, rec.Code)
+		}
+		if test.body != "" && rec.Body.String() != test.body {
+			t.Errorf("version %q: expected body %q got %q", test.version, test.body, rec.Body.String())
+		}
+	}
+}
+
+func TestNotVersionedSingleVersion(t *testing.T) {
+	def := &apidef.APIDefinition{
+		APIID: "test",
+		Proxy: apidef.ProxyConfig{TargetURL: "http://example.com"},
+		VersionData: apidef.VersionData{
+			NotVersioned: true,
+			Versions: map[string]apidef.VersionInfo{
+				"Default": {Name: "Default"},
+				"v2":      {Name: "v2"},
+			},
+		},
+	}
+	if _, err := (APIDefinitionLoader{}).MakeSpec(def); err == nil {
+		t.Error("expected an error for a not_versioned API with two versions")
+	}
+
+	delete(def.VersionData.Versions, "v2")
+	spec, err := APIDefinitionLoader{}.MakeSpec(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, status := spec.Version(httptest.NewRequest(http.MethodGet, "/", nil)); status != StatusOk || v.Name != "Default" {
+		t.Errorf("expected the single version, got %v %v", v, status)
+	}
+}
+
+func TestAPIDefinitionLoaderFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raspberry-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"one.json":    `{"api_id": "1", "active": true, "proxy": {"listen_path": "/one/", "target_url": "http://one.local"}}`,
+		"two.json":    `{"api_id": "2", "active": true, "proxy": {"listen_path": "/two", "target_url": "http://two.local"}}`,
+		"broken.json": `{"api_id": `,
+		"notes.txt":   `not a definition`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	specs, err := APIDefinitionLoader{}.FromDir(dir)
+	if err == nil {
+		t.Error("expected error for broken.json")
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 specs, got %d", len(specs))
+	}
+	for _, spec := range specs {
+		if spec.Proxy.ListenPath != "/one" && spec.Proxy.ListenPath != "/two" {
+			t.Errorf("unexpected listen path %q", spec.Proxy.ListenPath)
+		}
+	}
+}
+
+func TestSessionEncryption(t *testing.T) {
+	old := config.Global()
+	conf := old
+	conf.SessionEncryption.Enabled = true
+	config.SetGlobal(conf)
+	if err := setupGlobals(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		config.SetGlobal(old)
+		if err := setupGlobals(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	key := createSession(t, &user.SessionState{Rate: 10, Per: 1})
+	store := GlobalSessionManager.(*DefaultSessionManager).store.(*storage.EncryptedHandler)
+	if raw, err := store.Handler.GetKey(key); err != nil || strings.Contains(raw, "rate") {
+		t.Errorf("want the session stored encrypted, got %q %v", raw, err)
+	}
+	if session, ok := GlobalSessionManager.SessionDetail(key, false); !ok || session.Rate != 10 {
+		t.Errorf("want the session decrypted, got %+v %v", session, ok)
+	}
+
+	conf.SessionEncryption.KeyFile = filepath.Join(os.TempDir(), "missing.keys")
+	config.SetGlobal(conf)
+	if err := setupGlobals(); err == nil {
+		t.Error("want a missing key file refused")
+	}
+}
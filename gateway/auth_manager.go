@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/storage"
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+// SessionHandler handles all update/create/access session functions and deals exclusively with
+// user.SessionState objects, not identity. Keys are hashes of the key when
+// hashed is set, see KeyHash.
+type SessionHandler interface {
+	UpdateSession(keyName string, session *user.SessionState, resetTTLTo int64, hashed bool) error
+	RemoveSession(keyName string, hashed bool) bool
+	SessionDetail(keyName string, hashed bool) (user.SessionState, bool)
+	Sessions(filter string) []string
+	KeyHash(keyName string) string
+}
+
+// DefaultSessionManager implements SessionHandler, storing sessions as
+// JSON in a storage.Handler. With hash_keys set sessions are stored under
+// the hash of their key, those found under their key or its hash made with
+// a fallback function are moved there when first used.
+type DefaultSessionManager struct {
+	store storage.Handler
+}
+
+// NewSessionManager returns a DefaultSessionManager using store.
+func NewSessionManager(store storage.Handler) *DefaultSessionManager {
+	return &DefaultSessionManager{store: store}
+}
+
+// KeyHash returns the name the session of keyName is stored under: the
+// hash of keyName if keys are hashed, keyName itself otherwise.
+func (b *DefaultSessionManager) KeyHash(keyName string) string {
+	conf := config.Global()
+	if !conf.HashKeys {
+		return keyName
+	}
+	return hashKey(keyName, hashKeyFunction(conf))
+}
+
+// storedNames returns the names the session of keyName may be stored
+// under, the current one first. That is the plain key when keys are
+// hashed, and its hashes made with the fallback functions. A key that looks
+// like a hash has none, so that a listed hash can't be used as the key.
+func (b *DefaultSessionManager) storedNames(keyName string) []string {
+	if isKeyHash(keyName) {
+		return nil
+	}
+	conf := config.Global()
+	current := b.KeyHash(keyName)
+	names := []string{current}
+	if current != keyName {
+		names = append(names, keyName)
+	}
+	for _, fn := range conf.HashKeyFunctionFallback {
+		if hashed := hashKey(keyName, fn); hashed != current {
+			names = append(names, hashed)
+		}
+	}
+	return names
+}
+
+// UpdateSession updates the session state in the storage engine
+func (b *DefaultSessionManager) UpdateSession(keyName string, session *user.SessionState, resetTTLTo int64, hashed bool) error {
+	if !hashed {
+		keyName = b.KeyHash(keyName)
+	}
+	session.LastUpdated = time.Now().Format(time.RFC3339)
+	v, err := json.Marshal(session)
+	if err != nil {
+		log.Error("Error marshalling session for sync update")
+		return err
+	}
+	return b.store.SetKey(keyName, string(v), resetTTLTo)
+}
+
+// RemoveSession removes session from storage, wherever it is stored
+func (b *DefaultSessionManager) RemoveSession(keyName string, hashed bool) bool {
+	if hashed {
+		return b.store.DeleteKey(keyName)
+	}
+	return b.store.DeleteKeys(b.storedNames(keyName)) > 0
+}
+
+// SessionDetail returns the session detail using the storage engine (either in memory or Redis)
+func (b *DefaultSessionManager) SessionDetail(keyName string, hashed bool) (user.SessionState, bool) {
+	var session user.SessionState
+	var names, values []string
+	var err error
+	if hashed {
+		names = []string{keyName}
+		var value string
+		value, err = b.store.GetKey(keyName)
+		values = []string{value}
+	} else {
+		// every name at once, so unknown keys cost a single round trip
+		names = b.storedNames(keyName)
+		if len(names) == 0 {
+			return session, false
+		}
+		values, err = b.store.GetMultiKey(names)
+	}
+	if err != nil {
+		log.WithField("prefix", "auth-mgr").Debug("Querying keystore: ", err)
+		return session, false
+	}
+
+	for i, jsonKeyVal := range values {
+		if jsonKeyVal == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(jsonKeyVal), &session); err != nil {
+			log.WithField("prefix", "auth-mgr").Error("Couldn't unmarshal session object: ", err)
+			return session, false
+		}
+		if i > 0 && config.Global().HashKeys {
+			b.migrate(names[i], names[0], jsonKeyVal)
+		}
+		return session, true
+	}
+	log.WithField("prefix", "auth-mgr").Debug("Querying keystore: ", storage.ErrKeyNotFound)
+	return session, false
+}
+
+// migrate moves the session stored under from to to, keeping its expiry,
+// along with its quota. The session is still served if it fails.
+func (b *DefaultSessionManager) migrate(from, to, value string) {
+	logger := log.WithField("prefix", "auth-mgr").WithField("key", obfuscateKey(to))
+	ttl, err := b.store.GetExp(from)
+	if err != nil {
+		logger.Error("Couldn't migrate key: ", err)
+		return
+	}
+	if ttl == 0 {
+		// less than a second to go, zero would keep it forever
+		ttl = 1
+	}
+	if err := b.store.SetKey(to, value, ttl); err != nil {
+		logger.Error("Couldn't migrate key: ", err)
+		return
+	}
+	b.store.DeleteKey(from)
+	if sessionLimiter != nil {
+		sessionLimiter.moveQuota(from, to)
+	}
+	logger.Info("Migrated key to its hash.")
+}
+
+// Sessions returns all sessions in the key store that match a filter key
+// (a prefix), by the name they are stored under
+func (b *DefaultSessionManager) Sessions(filter string) []string {
+	return b.store.GetKeys(filter)
+}
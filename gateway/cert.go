@@ -0,0 +1,415 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+var errNoCertificates = errors.New("use_ssl is set but no certificates are configured")
+
+// cipherSuites maps the names accepted in the ciphers option to their
+// values. TLS 1.3 suites can't be configured and are always enabled.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// tlsVersions are the values accepted as min_version.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// parseCiphers returns the cipher suites named in names.
+func parseCiphers(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		id, ok := cipherSuites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// servesTLS reports whether the listener is wrapped in TLS, which
+// use_ssl_le implies.
+func servesTLS(opts config.HttpServerOptionsConfig) bool {
+	return opts.UseSSL || opts.UseLe_SSL
+}
+
+// getTLSConfig returns the TLS configuration of the listener. Certificates
+// are served from serverCerts, which is loaded with those set in opts, and
+// from acmeCerts with use_ssl_le.
+func getTLSConfig(opts config.HttpServerOptionsConfig) (*tls.Config, error) {
+	if opts.MinVersion != 0 {
+		if _, ok := tlsVersions[opts.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown min_version %#x", opts.MinVersion)
+		}
+	}
+	ciphers, err := parseCiphers(opts.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+	if err := serverCerts.load(opts); err != nil {
+		return nil, err
+	}
+	serverCerts.watch(certCheckInterval)
+	if opts.UseLe_SSL {
+		if err := acmeCerts.configure(opts.ACME, acmeStorage); err != nil {
+			return nil, err
+		}
+	}
+
+	conf := &tls.Config{
+		MinVersion:     opts.MinVersion,
+		CipherSuites:   ciphers,
+		GetCertificate: serverCerts.getCertificate,
+	}
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return serverCerts.configForClient(conf, hello), nil
+	}
+	return conf, nil
+}
+
+// serverCerts holds the certificates of the TLS listener.
+var serverCerts = &certificateStore{}
+
+// certificateStore picks the certificate for a handshake by SNI and
+// reloads certificates whose files change on disk.
+type certificateStore struct {
+	mu         sync.RWMutex
+	files      []*certFile
+	serverName string
+	byName     map[string]*tls.Certificate
+	fallback   *tls.Certificate
+
+	// clientAuth is how client certificates are asked for on each domain
+	// of APIs using mutual TLS, anyDomainAuth on every other one.
+	clientAuth    map[string]*clientAuthPolicy
+	anyDomainAuth *clientAuthPolicy
+
+	watchOnce sync.Once
+}
+
+// clientAuthPolicy is how client certificates are asked for during the
+// handshake.
+type clientAuthPolicy struct {
+	auth tls.ClientAuthType
+	cas  *x509.CertPool
+}
+
+// certFile is a certificate loaded from disk. PEM bundles holding both
+// the certificate and its key have the same certPath and keyPath.
+type certFile struct {
+	name     string
+	certPath string
+	keyPath  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// load replaces the certificates with those set in opts. Nothing is
+// replaced if any of them fails to load.
+func (s *certificateStore) load(opts config.HttpServerOptionsConfig) error {
+	files, err := loadCertFiles(opts)
+	if err != nil {
+		return err
+	}
+	s.set(opts, files)
+	return nil
+}
+
+// loadCertFiles loads the certificates set in opts from disk.
+func loadCertFiles(opts config.HttpServerOptionsConfig) ([]*certFile, error) {
+	var files []*certFile
+	for _, c := range opts.Certificates {
+		files = append(files, &certFile{name: c.Name, certPath: c.CertFile, keyPath: c.KeyFile})
+	}
+	for _, path := range opts.SSLCertificates {
+		files = append(files, &certFile{certPath: path, keyPath: path})
+	}
+	if len(files) == 0 && !opts.UseLe_SSL {
+		return nil, errNoCertificates
+	}
+	for _, f := range files {
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// set replaces the certificates with files, loaded from opts.
+func (s *certificateStore) set(opts config.HttpServerOptionsConfig, files []*certFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = files
+	s.serverName = strings.ToLower(opts.ServerName)
+	s.index()
+}
+
+// index maps the names of the certificates to them. Clients without SNI,
+// or asking for a name no certificate has, get the certificate for
+// server_name, or the first one.
+func (s *certificateStore) index() {
+	s.byName = make(map[string]*tls.Certificate)
+	for _, f := range s.files {
+		for _, name := range f.names() {
+			if _, ok := s.byName[name]; !ok {
+				s.byName[name] = f.cert
+			}
+		}
+	}
+	s.fallback = nil
+	if len(s.files) > 0 {
+		s.fallback = s.files[0].cert
+	}
+	if cert, ok := s.byName[s.serverName]; ok {
+		s.fallback = cert
+	}
+}
+
+// getCertificate returns the configured certificate for the name the
+// client asked for, then the one issued through ACME, then the fallback.
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isACMEChallenge(hello) && acmeCerts.handles(hello) {
+		return acmeCerts.getCertificate(hello)
+	}
+
+	s.mu.RLock()
+	cert, fallback := s.lookup(hello.ServerName), s.fallback
+	s.mu.RUnlock()
+	if cert != nil {
+		return cert, nil
+	}
+	if acmeCerts.handles(hello) {
+		return acmeCerts.getCertificate(hello)
+	}
+	if fallback == nil {
+		return nil, errNoCertificates
+	}
+	return fallback, nil
+}
+
+// lookup returns the certificate for serverName, trying a wildcard
+// certificate for its parent domain if there is none for the exact name.
+func (s *certificateStore) lookup(serverName string) *tls.Certificate {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return nil
+	}
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return s.byName["*"+name[i:]]
+	}
+	return nil
+}
+
+// updateClientAuth asks for client certificates on the domains of the APIs
+// in specs that use mutual TLS. APIs without a domain can be reached on
+// any name, so they apply everywhere.
+func (s *certificateStore) updateClientAuth(specs []*APISpec) {
+	byDomain := make(map[string][]*APISpec)
+	var anyDomain []*APISpec
+	for _, spec := range specs {
+		if !spec.UseMutualTLSAuth {
+			continue
+		}
+		if spec.Domain == "" {
+			anyDomain = append(anyDomain, spec)
+			continue
+		}
+		domain := strings.ToLower(spec.Domain)
+		byDomain[domain] = append(byDomain[domain], spec)
+	}
+
+	clientAuth := make(map[string]*clientAuthPolicy, len(byDomain))
+	for domain, domainSpecs := range byDomain {
+		clientAuth[domain] = newClientAuthPolicy(append(domainSpecs, anyDomain...))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientAuth = clientAuth
+	s.anyDomainAuth = newClientAuthPolicy(anyDomain)
+}
+
+// newClientAuthPolicy returns how to ask for the certificates of specs.
+// When all of them only accept certificates from CAs, the handshake
+// verifies the certificate against those CAs. Otherwise it is only asked
+// for and checked by the ClientCertificateCheck middleware.
+func newClientAuthPolicy(specs []*APISpec) *clientAuthPolicy {
+	if len(specs) == 0 {
+		return nil
+	}
+	cas := x509.NewCertPool()
+	for _, spec := range specs {
+		if spec.clientCAs == nil || len(spec.clientFingerprints) > 0 {
+			return &clientAuthPolicy{auth: tls.RequestClientCert}
+		}
+		for _, cert := range spec.clientCACerts {
+			cas.AddCert(cert)
+		}
+	}
+	return &clientAuthPolicy{auth: tls.VerifyClientCertIfGiven, cas: cas}
+}
+
+// configForClient returns the configuration for a handshake, base with
+// the client certificate policy of the name the client asked for.
+func (s *certificateStore) configForClient(base *tls.Config, hello *tls.ClientHelloInfo) *tls.Config {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	s.mu.RLock()
+	policy, ok := s.clientAuth[name]
+	if !ok {
+		policy = s.anyDomainAuth
+	}
+	s.mu.RUnlock()
+
+	if policy == nil {
+		return nil
+	}
+	conf := base.Clone()
+	conf.GetConfigForClient = nil
+	conf.ClientAuth = policy.auth
+	conf.ClientCAs = policy.cas
+	return conf
+}
+
+// watch checks the certificate files for changes every interval.
+func (s *certificateStore) watch(interval time.Duration) {
+	s.watchOnce.Do(func() {
+		go func() {
+			for range time.Tick(interval) {
+				s.reloadChanged()
+			}
+		}()
+	})
+}
+
+// reloadChanged reloads the certificates whose files have been modified. A
+// certificate that fails to load keeps being served and is tried again on
+// the next check.
+func (s *certificateStore) reloadChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for _, f := range s.files {
+		modTime, err := f.latestModTime()
+		if err != nil || !modTime.After(f.modTime) {
+			continue
+		}
+		logger := mainLog.WithFields(logrus.Fields{
+			"prefix": "tls",
+			"cert":   f.certPath,
+		})
+		if err := f.load(); err != nil {
+			logger.Error("Couldn't reload changed certificate: ", err)
+			continue
+		}
+		logger.Info("Reloaded changed certificate")
+		changed = true
+	}
+	if changed {
+		s.index()
+	}
+}
+
+func (f *certFile) load() error {
+	modTime, err := f.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	var cert tls.Certificate
+	if f.certPath == f.keyPath {
+		var data []byte
+		if data, err = ioutil.ReadFile(f.certPath); err == nil {
+			cert, err = tls.X509KeyPair(data, data)
+		}
+	} else {
+		cert, err = tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't load certificate %s: %v", f.certPath, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("couldn't parse certificate %s: %v", f.certPath, err)
+	}
+
+	f.cert = &cert
+	f.modTime = modTime
+	return nil
+}
+
+func (f *certFile) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{f.certPath, f.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// names returns the host names the certificate is served for: its
+// configured name and the names in the certificate itself.
+func (f *certFile) names() []string {
+	var names []string
+	if f.name != "" {
+		names = append(names, strings.ToLower(f.name))
+	}
+	leaf := f.cert.Leaf
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if len(leaf.DNSNames) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names
+}
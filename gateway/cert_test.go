@@ -0,0 +1,312 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"golang.org/x/net/http2"
+)
+
+// writeTestCert writes a self-signed certificate for hosts and its key to
+// dir, returning their paths.
+func writeTestCert(t *testing.T, dir string, hosts ...string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := strings.Replace(hosts[0], "*", "_", -1)
+	certFile = filepath.Join(dir, base+".crt")
+	keyFile = filepath.Join(dir, base+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func setServerOptions(opts config.HttpServerOptionsConfig) func() {
+	old := config.Global()
+	conf := old
+	conf.HttpServerOptions = opts
+	config.SetGlobal(conf)
+	return func() { config.SetGlobal(old) }
+}
+
+// serveProtocols serves a handler replying with the request's protocol on
+// a listener configured by configureProtocols.
+func serveProtocols(t *testing.T) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	if ln, err = configureProtocols(srv, ln); err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() { srv.Close() }
+}
+
+func getProto(t *testing.T, client *http.Client, url string) string {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeTestCert(t, dir, "127.0.0.1")
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+
+	for _, test := range []struct {
+		http2 bool
+		want  string
+	}{
+		{false, "HTTP/1.1"},
+		{true, "HTTP/2.0"},
+	} {
+		restore := setServerOptions(config.HttpServerOptionsConfig{
+			UseSSL:       true,
+			EnableHttp2:  test.http2,
+			Certificates: []config.CertData{{Name: "local", CertFile: certFile, KeyFile: keyFile}},
+		})
+		addr, stop := serveProtocols(t)
+		if proto := getProto(t, client, "https://"+addr); proto != test.want {
+			t.Errorf("enable_http2=%v: want %s, got %s", test.http2, test.want, proto)
+		}
+		stop()
+		restore()
+	}
+}
+
+func TestTLSListenerWithoutCertificates(t *testing.T) {
+	defer setServerOptions(config.HttpServerOptionsConfig{UseSSL: true})()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := configureProtocols(newServer(http.NotFoundHandler()), ln); err != errNoCertificates {
+		t.Errorf("want %v, got %v", errNoCertificates, err)
+	}
+}
+
+func TestH2cListener(t *testing.T) {
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	defer setServerOptions(config.HttpServerOptionsConfig{EnableHttp2: true, EnableH2c: true})()
+	addr, stop := serveProtocols(t)
+	defer stop()
+	if proto := getProto(t, h2cClient, "http://"+addr); proto != "HTTP/2.0" {
+		t.Errorf("want h2c accepted, got %s", proto)
+	}
+	if proto := getProto(t, http.DefaultClient, "http://"+addr); proto != "HTTP/1.1" {
+		t.Errorf("want HTTP/1.1 still served, got %s", proto)
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "raspberry-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// servedFor returns the common name of the certificate served to clients
+// asking for serverName.
+func servedFor(t *testing.T, serverName string) string {
+	cert, err := serverCerts.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestSNICertificates(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	aCert, aKey := writeTestCert(t, dir, "a.example.com")
+	wildCert, wildKey := writeTestCert(t, dir, "*.wild.example.com")
+	// a bundle holding both the certificate and the key
+	bCert, bKey := writeTestCert(t, dir, "b.example.com", "alt.example.com")
+	certPEM, _ := ioutil.ReadFile(bCert)
+	keyPEM, _ := ioutil.ReadFile(bKey)
+	bundle := filepath.Join(dir, "b.pem")
+	ioutil.WriteFile(bundle, append(certPEM, keyPEM...), 0600)
+
+	_, err := getTLSConfig(config.HttpServerOptionsConfig{
+		Certificates: []config.CertData{
+			{Name: "a.example.com", CertFile: aCert, KeyFile: aKey},
+			{Name: "wild", CertFile: wildCert, KeyFile: wildKey},
+		},
+		SSLCertificates: []string{bundle},
+		ServerName:      "b.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, want := range map[string]string{
+		"a.example.com":        "a.example.com",
+		"A.Example.com.":       "a.example.com",
+		"api.wild.example.com": "*.wild.example.com",
+		"alt.example.com":      "b.example.com",
+		"unknown.example.com":  "b.example.com",
+		"":                     "b.example.com",
+	} {
+		if got := servedFor(t, serverName); got != want {
+			t.Errorf("%q: want the certificate for %s, got %s", serverName, want, got)
+		}
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeTestCert(t, dir, "localhost")
+	certs := []config.CertData{{CertFile: certFile, KeyFile: keyFile}}
+
+	conf, err := getTLSConfig(config.HttpServerOptionsConfig{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+		Ciphers:      []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_ecdsa_with_aes_256_gcm_sha384"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.MinVersion != tls.VersionTLS12 || len(conf.CipherSuites) != 2 || conf.CipherSuites[1] != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("unexpected config %+v", conf)
+	}
+
+	for _, opts := range []config.HttpServerOptionsConfig{
+		{Certificates: certs, Ciphers: []string{"TLS_NOT_A_CIPHER"}},
+		{Certificates: certs, MinVersion: 0x0200},
+		{Certificates: []config.CertData{{CertFile: certFile, KeyFile: certFile}}},
+		{SSLCertificates: []string{filepath.Join(dir, "missing.pem")}},
+	} {
+		if _, err := getTLSConfig(opts); err == nil {
+			t.Errorf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeTestCert(t, dir, "127.0.0.1")
+
+	defer setServerOptions(config.HttpServerOptionsConfig{
+		UseSSL:       true,
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []config.CertData{{CertFile: certFile, KeyFile: keyFile}},
+	})()
+	addr, stop := serveProtocols(t)
+	defer stop()
+
+	for version, ok := range map[uint16]bool{tls.VersionTLS11: false, tls.VersionTLS12: true} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != ok {
+			t.Errorf("%s: want handshake ok=%v, got %v", tlsVersions[version], ok, err)
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeTestCert(t, dir, "reload.example.com")
+	if _, err := getTLSConfig(config.HttpServerOptionsConfig{
+		Certificates: []config.CertData{{CertFile: certFile, KeyFile: keyFile}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := serverCerts.getCertificate(&tls.ClientHelloInfo{})
+
+	// replaced on disk with a newer certificate
+	writeTestCert(t, dir, "reload.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	serverCerts.reloadChanged()
+	after, _ := serverCerts.getCertificate(&tls.ClientHelloInfo{})
+	if after.Leaf.SerialNumber.Cmp(before.Leaf.SerialNumber) == 0 {
+		t.Fatal("want the changed certificate reloaded")
+	}
+
+	// a broken file keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	serverCerts.reloadChanged()
+	if current, _ := serverCerts.getCertificate(&tls.ClientHelloInfo{}); current != after {
+		t.Error("want the current certificate kept when the new one can't be loaded")
+	}
+}
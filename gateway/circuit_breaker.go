@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/sirupsen/logrus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker tracks the outcome of the last requests to a path of an
+// API. Once too many of them failed it opens and rejects requests until
+// return_to_service_after has passed, then lets a single request through:
+// if it succeeds the breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	spec   *APISpec
+	meta   apidef.CircuitBreakerMeta
+	path   *regexp.Regexp
+	expiry time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	samples  []bool // ring of the last outcomes, true for a failure
+	next     int
+	count    int
+	failures int
+	openedAt time.Time
+	probing  bool // a half-open request is in flight
+}
+
+func newCircuitBreaker(spec *APISpec, meta apidef.CircuitBreakerMeta) (*circuitBreaker, error) {
+	if meta.ThresholdPercent <= 0 || meta.ThresholdPercent > 1 {
+		return nil, errors.New("threshold_percent must be between 0 and 1")
+	}
+	if meta.Samples < 1 {
+		return nil, errors.New("samples must be at least 1")
+	}
+	if meta.ReturnToServiceAfter < 1 {
+		return nil, errors.New("return_to_service_after must be at least 1 second")
+	}
+	path, err := regexp.Compile("^" + meta.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %v", err)
+	}
+	return &circuitBreaker{
+		spec:    spec,
+		meta:    meta,
+		path:    path,
+		expiry:  time.Duration(meta.ReturnToServiceAfter) * time.Second,
+		samples: make([]bool, meta.Samples),
+	}, nil
+}
+
+// matches reports whether the breaker covers a request for path, relative
+// to the listen path, with method.
+func (cb *circuitBreaker) matches(method, path string) bool {
+	if cb.meta.Method != "" && cb.meta.Method != method {
+		return false
+	}
+	return cb.path.MatchString(path)
+}
+
+// allow reports whether a request may be proxied.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.expiry {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		return true
+	case breakerHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return true
+}
+
+// record adds the outcome of a proxied request.
+func (cb *circuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerHalfOpen:
+		cb.probing = false
+		if failed {
+			cb.trip("half-open request failed")
+		} else {
+			cb.reset()
+		}
+	case breakerClosed:
+		if cb.count == len(cb.samples) {
+			if cb.samples[cb.next] {
+				cb.failures--
+			}
+		} else {
+			cb.count++
+		}
+		cb.samples[cb.next] = failed
+		if failed {
+			cb.failures++
+		}
+		cb.next = (cb.next + 1) % len(cb.samples)
+
+		if cb.count == len(cb.samples) && float64(cb.failures)/float64(cb.count) >= cb.meta.ThresholdPercent {
+			cb.trip(fmt.Sprintf("%d of the last %d requests failed", cb.failures, cb.count))
+		}
+	}
+	// outcomes of requests let through before the breaker opened are
+	// ignored
+}
+
+// abandon drops a request let through that has no outcome, as its client
+// gave up on it, so that the next one can be let through half-open.
+func (cb *circuitBreaker) abandon() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// abandonBreaker abandons the request r let through the circuit breaker it
+// matched, if any, for requests that never reach the upstream.
+func abandonBreaker(r *http.Request) {
+	if cb := ctxGetCircuitBreaker(r); cb != nil {
+		cb.abandon()
+	}
+}
+
+// trip opens the breaker. cb.mu must be held.
+func (cb *circuitBreaker) trip(reason string) {
+	cb.state = breakerOpen
+	cb.openedAt = time.Now()
+	cb.logger().Warning("Circuit breaker tripped: ", reason)
+	cb.spec.FireEvent(EventBreakerTripped, cb.eventMeta("Circuit breaker tripped: "+reason))
+}
+
+// reset closes the breaker with an empty sample window. cb.mu must be held.
+func (cb *circuitBreaker) reset() {
+	cb.state = breakerClosed
+	cb.next, cb.count, cb.failures = 0, 0, 0
+	for i := range cb.samples {
+		cb.samples[i] = false
+	}
+	cb.logger().Info("Circuit breaker reset")
+	cb.spec.FireEvent(EventBreakerReset, cb.eventMeta("Circuit breaker reset"))
+}
+
+func (cb *circuitBreaker) eventMeta(msg string) EventCircuitBreakerMeta {
+	return EventCircuitBreakerMeta{
+		EventMetaDefault: EventMetaDefault{Message: msg, APIID: cb.spec.APIID},
+		Path:             cb.meta.Path,
+		Method:           cb.meta.Method,
+	}
+}
+
+func (cb *circuitBreaker) logger() *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"prefix": "circuit-breaker",
+		"api_id": cb.spec.APIID,
+		"path":   cb.meta.Path,
+		"method": cb.meta.Method,
+	})
+}
+
+// breakerFor returns the first circuit breaker of the spec covering r.
+func (s *APISpec) breakerFor(r *http.Request) *circuitBreaker {
+	if len(s.circuitBreakers) == 0 {
+		return nil
+	}
+	path := stripListenPath(s.Proxy.ListenPath, r.URL.Path)
+	for _, cb := range s.circuitBreakers {
+		if cb.matches(r.Method, path) {
+			return cb
+		}
+	}
+	return nil
+}
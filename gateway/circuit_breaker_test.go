@@ -0,0 +1,249 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+)
+
+// webhookReceiver returns a server that passes the events it receives to
+// the returned channel.
+func webhookReceiver(t *testing.T) (*httptest.Server, chan EventMessage) {
+	events := make(chan EventMessage, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var em EventMessage
+		if err := json.Unmarshal(body, &em); err != nil {
+			t.Errorf("webhook body isn't JSON: %v: %s", err, body)
+		}
+		events <- em
+	}))
+	return srv, events
+}
+
+func waitForEvent(t *testing.T, events chan EventMessage, want apidef.RaspberryEvent) EventMessage {
+	select {
+	case em := <-events:
+		if em.Type != want {
+			t.Fatalf("want event %s, got %s", want, em.Type)
+		}
+		return em
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event %s not delivered", want)
+	}
+	return EventMessage{}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	hooks, events := webhookReceiver(t)
+	defer hooks.Close()
+	handlers := []apidef.EventHandlerTriggerConfig{{
+		Handler:     apidef.WebHookHandler,
+		HandlerMeta: map[string]interface{}{"method": "POST", "target_path": hooks.URL},
+	}}
+
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.Proxy.ListenPath = "/api/"
+		def.CircuitBreakers = []apidef.CircuitBreakerMeta{{
+			Path:                 "/widgets",
+			Method:               http.MethodGet,
+			ThresholdPercent:     0.5,
+			Samples:              4,
+			ReturnToServiceAfter: 60,
+		}}
+		def.EventHandlers.Events = map[apidef.RaspberryEvent][]apidef.EventHandlerTriggerConfig{
+			EventBreakerTripped: handlers,
+			EventBreakerReset:   handlers,
+		}
+	})
+	handler := processSpec(spec)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	for i := 0; i < 4; i++ {
+		if rec := get("/api/widgets/1"); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("request %d: want upstream's 500, got %d", i, rec.Code)
+		}
+	}
+	em := waitForEvent(t, events, EventBreakerTripped)
+	meta := em.Meta.(map[string]interface{})
+	if meta["api_id"] != spec.APIID || meta["path"] != "/widgets" {
+		t.Errorf("unexpected event meta: %v", meta)
+	}
+
+	rec := get("/api/widgets/1")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "Service temporarily unavailable") {
+		t.Fatalf("want 503 while open, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get("/api/other"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("paths without a breaker should be proxied, got %d", rec.Code)
+	}
+
+	cb := spec.circuitBreakers[0]
+	expire := func() {
+		cb.mu.Lock()
+		cb.openedAt = time.Now().Add(-time.Hour)
+		cb.mu.Unlock()
+	}
+
+	// a failed half-open request opens the breaker again
+	expire()
+	if rec := get("/api/widgets/1"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("want half-open request to be proxied, got %d", rec.Code)
+	}
+	waitForEvent(t, events, EventBreakerTripped)
+	if rec := get("/api/widgets/1"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("want 503 after failed half-open request, got %d", rec.Code)
+	}
+
+	// a successful one closes it
+	atomic.StoreInt32(&failing, 0)
+	expire()
+	if rec := get("/api/widgets/1"); rec.Code != http.StatusOK {
+		t.Fatalf("want half-open request to be proxied, got %d", rec.Code)
+	}
+	waitForEvent(t, events, EventBreakerReset)
+	if rec := get("/api/widgets/1"); rec.Code != http.StatusOK {
+		t.Fatalf("want 200 once reset, got %d", rec.Code)
+	}
+}
+
+func TestCircuitBreakerHalfOpenSingleRequest(t *testing.T) {
+	spec := buildSpec(t, "http://127.0.0.1:1", func(def *apidef.APIDefinition) {
+		def.CircuitBreakers = []apidef.CircuitBreakerMeta{{
+			Path:                 "/",
+			ThresholdPercent:     1,
+			Samples:              1,
+			ReturnToServiceAfter: 60,
+		}}
+	})
+	cb := spec.circuitBreakers[0]
+	cb.record(true)
+	if cb.allow() {
+		t.Fatal("breaker should be open")
+	}
+	cb.openedAt = time.Now().Add(-time.Hour)
+	if !cb.allow() {
+		t.Fatal("first half-open request should be allowed")
+	}
+	if cb.allow() {
+		t.Fatal("only one half-open request should be allowed")
+	}
+}
+
+func TestCircuitBreakerClientCancel(t *testing.T) {
+	defer enableHealthChecks(0)()
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.CircuitBreakers = []apidef.CircuitBreakerMeta{{
+			Path:                 "/",
+			ThresholdPercent:     1,
+			Samples:              1,
+			ReturnToServiceAfter: 60,
+		}}
+		def.HealthCheck.PassiveFailures = 1
+	})
+	GlobalHostChecker.Update([]*APISpec{spec})
+	handler := processSpec(spec)
+	cb := spec.circuitBreakers[0]
+
+	cancelled := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if rec.Code != statusClientClosedRequest {
+			t.Errorf("want %d, got %d", statusClientClosedRequest, rec.Code)
+		}
+	}
+
+	cancelled()
+	if !cb.allow() {
+		t.Error("a client giving up shouldn't trip the breaker")
+	}
+	u, _ := url.Parse(upstream.URL)
+	if isHostDown(spec.APIID, u) {
+		t.Error("a client giving up shouldn't mark the target down")
+	}
+
+	// a half-open request the client gave up on lets the next one through
+	cb.record(true)
+	cb.openedAt = time.Now().Add(-time.Hour)
+	cancelled()
+	if !cb.allow() {
+		t.Error("want another half-open request let through")
+	}
+}
+
+func TestCircuitBreakerInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		meta apidef.CircuitBreakerMeta
+	}{
+		{"threshold", apidef.CircuitBreakerMeta{ThresholdPercent: 1.5, Samples: 1, ReturnToServiceAfter: 1}},
+		{"samples", apidef.CircuitBreakerMeta{ThresholdPercent: 0.5, ReturnToServiceAfter: 1}},
+		{"return to service", apidef.CircuitBreakerMeta{ThresholdPercent: 0.5, Samples: 1}},
+		{"path", apidef.CircuitBreakerMeta{Path: "(", ThresholdPercent: 0.5, Samples: 1, ReturnToServiceAfter: 1}},
+	}
+	for _, tc := range tests {
+		def := &apidef.APIDefinition{
+			APIID:           "test",
+			Proxy:           apidef.ProxyConfig{TargetURL: "http://example.com"},
+			CircuitBreakers: []apidef.CircuitBreakerMeta{tc.meta},
+		}
+		if _, err := (APIDefinitionLoader{}).MakeSpec(def); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestWebHookHandlerInit(t *testing.T) {
+	tests := []struct {
+		name string
+		meta map[string]interface{}
+		ok   bool
+	}{
+		{"defaults", map[string]interface{}{"target_path": "http://example.com/hook"}, true},
+		{"method", map[string]interface{}{"method": "TRACE", "target_path": "http://example.com/hook"}, false},
+		{"target", map[string]interface{}{"target_path": "/hook"}, false},
+		{"template", map[string]interface{}{"target_path": "http://example.com/hook", "template_path": "missing.json"}, false},
+	}
+	for _, tc := range tests {
+		_, err := EventHandlerByName(apidef.EventHandlerTriggerConfig{
+			Handler:     apidef.WebHookHandler,
+			HandlerMeta: tc.meta,
+		})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+// Keys of values stored in the request context by the middleware chain.
+type ctxKey uint
+
+const (
+	ctxSessionData ctxKey = iota
+	ctxAuthToken
+	ctxVersionName
+	ctxTargetOverride
+	ctxUpstreamTarget
+	ctxCircuitBreaker
+	// ctxConn is the connection a request was received on, set on the
+	// server's base context.
+	ctxConn
+	ctxClientCert
+)
+
+func setCtxValue(r *http.Request, key, val interface{}) {
+	*r = *r.WithContext(context.WithValue(r.Context(), key, val))
+}
+
+func ctxGetSession(r *http.Request) *user.SessionState {
+	if v := r.Context().Value(ctxSessionData); v != nil {
+		return v.(*user.SessionState)
+	}
+	return nil
+}
+
+func ctxSetSession(r *http.Request, s *user.SessionState, token string) {
+	setCtxValue(r, ctxSessionData, s)
+	setCtxValue(r, ctxAuthToken, token)
+}
+
+func ctxGetAuthToken(r *http.Request) string {
+	if v := r.Context().Value(ctxAuthToken); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func ctxGetVersionName(r *http.Request) string {
+	if v := r.Context().Value(ctxVersionName); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func ctxSetVersionName(r *http.Request, name string) {
+	setCtxValue(r, ctxVersionName, name)
+}
+
+// ctxGetTargetOverride returns the upstream that replaces the API target
+// for this request, if any.
+func ctxGetTargetOverride(r *http.Request) *url.URL {
+	if v := r.Context().Value(ctxTargetOverride); v != nil {
+		return v.(*url.URL)
+	}
+	return nil
+}
+
+func ctxSetTargetOverride(r *http.Request, target *url.URL) {
+	setCtxValue(r, ctxTargetOverride, target)
+}
+
+// ctxGetUpstreamTarget returns the upstream picked for this request.
+func ctxGetUpstreamTarget(r *http.Request) *url.URL {
+	if v := r.Context().Value(ctxUpstreamTarget); v != nil {
+		return v.(*url.URL)
+	}
+	return nil
+}
+
+func ctxSetUpstreamTarget(r *http.Request, target *url.URL) {
+	setCtxValue(r, ctxUpstreamTarget, target)
+}
+
+// ctxGetCircuitBreaker returns the circuit breaker that let this request
+// through, if any.
+func ctxGetCircuitBreaker(r *http.Request) *circuitBreaker {
+	if v := r.Context().Value(ctxCircuitBreaker); v != nil {
+		return v.(*circuitBreaker)
+	}
+	return nil
+}
+
+func ctxSetCircuitBreaker(r *http.Request, cb *circuitBreaker) {
+	setCtxValue(r, ctxCircuitBreaker, cb)
+}
+
+// ctxGetClientCert returns the client certificate that authorised this
+// request, if any.
+func ctxGetClientCert(r *http.Request) *clientCertInfo {
+	if v := r.Context().Value(ctxClientCert); v != nil {
+		return v.(*clientCertInfo)
+	}
+	return nil
+}
+
+func ctxSetClientCert(r *http.Request, cert *clientCertInfo) {
+	setCtxValue(r, ctxClientCert, cert)
+}
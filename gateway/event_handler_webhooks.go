@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookTemplateName = "default_webhook.json"
+	// defaultEventTimeout is how many seconds an identical webhook is not
+	// sent again for.
+	defaultEventTimeout   = 10
+	webhookRequestTimeout = 10 * time.Second
+	webhookUserAgent      = "Raspberry-Hookshot"
+)
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// defaultWebhookTemplate is used when neither the handler nor template_path
+// provide one.
+var defaultWebhookTemplate = template.Must(template.New(defaultWebhookTemplateName).Funcs(webhookFuncs).Parse(`{
+    "event": {{json .Type}},
+    "timestamp": {{json .TimeStamp}},
+    "meta": {{json .Meta}}
+}`))
+
+// webhookStorage remembers recently sent webhooks so identical ones aren't
+// sent twice within event_timeout.
+var webhookStorage storage.Handler = storage.NewMemoryStorageManager("webhook.cache.")
+
+var webhookLog = log.WithField("prefix", "webhooks")
+
+// WebHookHandler delivers events to a URL, the body is rendered from a
+// template with the EventMessage.
+type WebHookHandler struct {
+	conf     config.WebHookHandlerConf
+	template *template.Template
+	client   *http.Client
+}
+
+// Init validates the WebHookHandlerConf in the handler's meta data and
+// loads its template.
+func (w *WebHookHandler) Init(handlerConf interface{}) error {
+	if err := decodeHandlerConf(handlerConf, &w.conf); err != nil {
+		return err
+	}
+
+	w.conf.Method = strings.ToUpper(w.conf.Method)
+	switch w.conf.Method {
+	case "":
+		w.conf.Method = http.MethodPost
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("webhook: unsupported method %q", w.conf.Method)
+	}
+
+	u, err := url.Parse(w.conf.TargetPath)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("webhook: invalid target_path %q", w.conf.TargetPath)
+	}
+
+	if w.conf.EventTimeout == 0 {
+		w.conf.EventTimeout = defaultEventTimeout
+	}
+
+	w.template = currentTemplates().Lookup(defaultWebhookTemplateName)
+	if w.conf.TemplatePath != "" {
+		tmpl, err := template.New(filepath.Base(w.conf.TemplatePath)).Funcs(webhookFuncs).ParseFiles(w.conf.TemplatePath)
+		if err != nil {
+			return fmt.Errorf("webhook: couldn't load template: %v", err)
+		}
+		w.template = tmpl
+	}
+	if w.template == nil {
+		w.template = defaultWebhookTemplate
+	}
+
+	w.client = &http.Client{Transport: httpTransport(), Timeout: webhookRequestTimeout}
+	return nil
+}
+
+// HandleEvent renders em and sends it to the webhook target, unless the
+// same request was sent within event_timeout.
+func (w *WebHookHandler) HandleEvent(em EventMessage) {
+	logger := webhookLog.WithFields(logrus.Fields{
+		"event":  em.Type,
+		"target": w.conf.TargetPath,
+	})
+
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, em); err != nil {
+		logger.Error("Couldn't render webhook template: ", err)
+		return
+	}
+
+	if w.wasSent(body.Bytes()) {
+		logger.Debug("Identical webhook sent recently, skipping")
+		return
+	}
+
+	req, err := w.buildRequest(&body)
+	if err != nil {
+		logger.Error("Couldn't build webhook request: ", err)
+		return
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		logger.Error("Webhook request failed: ", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		logger.Errorf("Webhook target replied with %s", resp.Status)
+		return
+	}
+	logger.Debug("Webhook sent")
+}
+
+func (w *WebHookHandler) buildRequest(body *bytes.Buffer) (*http.Request, error) {
+	var req *http.Request
+	var err error
+	if w.conf.Method == http.MethodGet {
+		// GET can't carry a body, the event is sent as a query parameter
+		u, _ := url.Parse(w.conf.TargetPath)
+		q := u.Query()
+		q.Set("event", body.String())
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequest(w.conf.Method, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(w.conf.Method, w.conf.TargetPath, body)
+		if err == nil {
+			req.Header.Set(headers.ContentType, headers.ApplicationJSON)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headers.UserAgent, webhookUserAgent)
+	for k, v := range w.conf.HeaderList {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// wasSent reports whether body was sent to the target within the event
+// timeout, and records it as sent otherwise.
+func (w *WebHookHandler) wasSent(body []byte) bool {
+	sum := md5.Sum(append([]byte(w.conf.Method+w.conf.TargetPath), body...))
+	key := hex.EncodeToString(sum[:])
+	if _, err := webhookStorage.GetKey(key); err == nil {
+		return true
+	}
+	webhookStorage.SetKey(key, "1", w.conf.EventTimeout)
+	return false
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/sirupsen/logrus"
+)
+
+// The names of the events fired by the gateway.
+const (
+	EventBreakerTripped apidef.RaspberryEvent = "BreakerTripped"
+	EventBreakerReset   apidef.RaspberryEvent = "BreakerReset"
+	EventIPRejected     apidef.RaspberryEvent = "IPRejected"
+)
+
+// EventMessage is passed to the handlers of an event.
+type EventMessage struct {
+	Type      apidef.RaspberryEvent `json:"event"`
+	Meta      interface{}           `json:"meta"`
+	TimeStamp string                `json:"timestamp"`
+}
+
+// EventMetaDefault is the meta data every event carries.
+type EventMetaDefault struct {
+	Message string `json:"message"`
+	APIID   string `json:"api_id"`
+}
+
+// EventCircuitBreakerMeta is the meta data of BreakerTripped and
+// BreakerReset.
+type EventCircuitBreakerMeta struct {
+	EventMetaDefault
+	Path   string `json:"path"`
+	Method string `json:"method"`
+}
+
+// EventIPRejectedMeta is the meta data of IPRejected.
+type EventIPRejectedMeta struct {
+	EventMetaDefault
+	Origin string `json:"origin"`
+	Path   string `json:"path"`
+}
+
+// RaspberryEventHandler is implemented by the handlers events can be
+// delivered to.
+type RaspberryEventHandler interface {
+	Init(handlerConf interface{}) error
+	HandleEvent(em EventMessage)
+}
+
+// EventHandlerByName returns an initialised handler for conf.
+func EventHandlerByName(conf apidef.EventHandlerTriggerConfig) (RaspberryEventHandler, error) {
+	var handler RaspberryEventHandler
+	switch conf.Handler {
+	case apidef.WebHookHandler:
+		handler = &WebHookHandler{}
+	case apidef.LogHandler:
+		handler = &LogMessageEventHandler{}
+	default:
+		return nil, fmt.Errorf("unknown event handler %q", conf.Handler)
+	}
+	if err := handler.Init(conf.HandlerMeta); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// decodeHandlerConf decodes the handler_meta of a handler into dst.
+func decodeHandlerConf(handlerConf interface{}, dst interface{}) error {
+	data, err := json.Marshal(handlerConf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// initEventHandlers builds the handlers configured in the event_handlers of
+// spec's definition.
+func (s *APISpec) initEventHandlers() error {
+	s.eventHandlers = make(map[apidef.RaspberryEvent][]RaspberryEventHandler)
+	for event, confs := range s.EventHandlers.Events {
+		for _, conf := range confs {
+			handler, err := EventHandlerByName(conf)
+			if err != nil {
+				return fmt.Errorf("event %s: %v", event, err)
+			}
+			s.eventHandlers[event] = append(s.eventHandlers[event], handler)
+		}
+	}
+	return nil
+}
+
+// FireEvent hands the event to the handlers configured for it. Handlers run
+// in the background so they never hold up the request that fired it.
+func (s *APISpec) FireEvent(name apidef.RaspberryEvent, meta interface{}) {
+	handlers := s.eventHandlers[name]
+	if len(handlers) == 0 {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"prefix": "events",
+		"api_id": s.APIID,
+	}).Debug("Firing event: ", name)
+
+	em := EventMessage{
+		Type:      name,
+		Meta:      meta,
+		TimeStamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, handler := range handlers {
+		go handler.HandleEvent(em)
+	}
+}
+
+// LogMessageEventHandler writes events to the gateway log.
+type LogMessageEventHandler struct {
+	prefix string
+}
+
+// Init reads the optional log prefix from the handler's meta data.
+func (l *LogMessageEventHandler) Init(handlerConf interface{}) error {
+	conf := struct {
+		Prefix string `json:"prefix"`
+	}{}
+	if err := decodeHandlerConf(handlerConf, &conf); err != nil {
+		return err
+	}
+	l.prefix = conf.Prefix
+	if l.prefix == "" {
+		l.prefix = "events"
+	}
+	return nil
+}
+
+// HandleEvent logs em.
+func (l *LogMessageEventHandler) HandleEvent(em EventMessage) {
+	meta, _ := json.Marshal(em.Meta)
+	log.WithFields(logrus.Fields{
+		"prefix": l.prefix,
+		"type":   em.Type,
+	}).Warning("EVENT: ", string(meta))
+}
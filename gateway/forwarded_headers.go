@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// viaPseudonym names the gateway in Via headers.
+const viaPseudonym = "raspberry"
+
+// forwardedHeaders describe the way a request came to the gateway.
+var forwardedHeaders = []string{
+	headers.Forwarded,
+	headers.XForwardFor,
+	headers.XForwardProto,
+	headers.XForwardHost,
+	headers.Via,
+}
+
+// setForwardedHeaders tells the upstream where req came from as configured
+// in conf. It has to run before the Host of req is replaced with the
+// upstream's. X-Forwarded-For is left without the peer, which
+// httputil.ReverseProxy appends, as does appendForwardedFor.
+func setForwardedHeaders(req *http.Request, conf apidef.ForwardedHeaders) {
+	peer, _, _ := net.SplitHostPort(req.RemoteAddr)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if conf.StripClientHeaders {
+		// the client as far as the trusted proxies can tell
+		client := request.RealIP(req)
+		for _, name := range forwardedHeaders {
+			req.Header.Del(name)
+		}
+		if client != "" && client != peer {
+			req.Header.Set(headers.XForwardFor, client)
+			if conf.Forwarded {
+				req.Header.Set(headers.Forwarded, "for="+forwardedNode(client))
+			}
+		}
+	}
+
+	if conf.Forwarded {
+		appendHeader(req.Header, headers.Forwarded, fmt.Sprintf("for=%s;host=%s;proto=%s",
+			forwardedNode(peer), forwardedValue(req.Host), proto))
+	}
+	if conf.XForwarded {
+		if req.Header.Get(headers.XForwardProto) == "" {
+			req.Header.Set(headers.XForwardProto, proto)
+		}
+		if req.Header.Get(headers.XForwardHost) == "" {
+			req.Header.Set(headers.XForwardHost, req.Host)
+		}
+	}
+	if conf.Via {
+		appendHeader(req.Header, headers.Via, viaProtocol(req)+" "+viaPseudonym)
+	}
+}
+
+// appendForwardedFor adds the peer of req to X-Forwarded-For, as
+// httputil.ReverseProxy does for the requests it sends.
+func appendForwardedFor(req *http.Request) {
+	if peer, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		appendHeader(req.Header, headers.XForwardFor, peer)
+	}
+}
+
+// appendHeader adds value to the list in the header name, folding the
+// lines it had into one.
+func appendHeader(h http.Header, name, value string) {
+	if prior := h[name]; len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// forwardedNode formats ip as the node of a Forwarded element, IPv6
+// addresses are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes v unless it is a token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// viaProtocol is the protocol version req was received with, as written
+// in Via headers.
+func viaProtocol(req *http.Request) string {
+	switch {
+	case req.ProtoMajor >= 2:
+		return strconv.Itoa(req.ProtoMajor)
+	case req.ProtoMajor == 1:
+		return fmt.Sprintf("1.%d", req.ProtoMinor)
+	}
+	return "1.1"
+}
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values []string
+		for _, name := range forwardedHeaders {
+			values = append(values, strings.Join(r.Header[name], "; "))
+		}
+		w.Write([]byte(strings.Join(values, "|")))
+	}))
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		name    string
+		conf    apidef.ForwardedHeaders
+		trusted []string
+		want    []string // Forwarded, X-Forwarded-For, -Proto, -Host, Via
+	}{
+		{
+			name: "defaults",
+			want: []string{"for=6.6.6.6", "6.6.6.6, 203.0.113.9, 192.0.2.1", "https", "", "1.0 edge"},
+		},
+		{
+			name: "all",
+			conf: apidef.ForwardedHeaders{Forwarded: true, XForwarded: true, Via: true},
+			want: []string{
+				"for=6.6.6.6, for=192.0.2.1;host=example.com;proto=http",
+				"6.6.6.6, 203.0.113.9, 192.0.2.1",
+				"https",
+				"example.com",
+				"1.0 edge, 1.1 raspberry",
+			},
+		},
+		{
+			name: "strip",
+			conf: apidef.ForwardedHeaders{Forwarded: true, XForwarded: true, Via: true, StripClientHeaders: true},
+			want: []string{"for=192.0.2.1;host=example.com;proto=http", "192.0.2.1", "http", "example.com", "1.1 raspberry"},
+		},
+		{
+			name:    "strip behind trusted proxies",
+			conf:    apidef.ForwardedHeaders{Forwarded: true, StripClientHeaders: true},
+			trusted: []string{"192.0.2.0/24"},
+			want:    []string{"for=203.0.113.9, for=192.0.2.1;host=example.com;proto=http", "203.0.113.9, 192.0.2.1", "", "", ""},
+		},
+	} {
+		if err := request.SetTrustedProxies(test.trusted, nil); err != nil {
+			t.Fatal(err)
+		}
+		proxy := NewReverseProxy(buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+			def.Proxy.ForwardedHeaders = test.conf
+		}))
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(headers.Forwarded, "for=6.6.6.6")
+		req.Header.Set(headers.XForwardFor, "6.6.6.6, 203.0.113.9")
+		req.Header.Set(headers.XForwardProto, "https")
+		req.Header.Set(headers.Via, "1.0 edge")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+
+		if got := rec.Body.String(); got != strings.Join(test.want, "|") {
+			t.Errorf("%s: want %q, got %q", test.name, strings.Join(test.want, "|"), got)
+		}
+	}
+	request.SetTrustedProxies(nil, nil)
+}
+
+func TestForwardedElement(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com:8443/", nil)
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	setForwardedHeaders(req, apidef.ForwardedHeaders{Forwarded: true, Via: true})
+
+	if got, want := req.Header.Get(headers.Forwarded), `for="[2001:db8::1]";host="example.com:8443";proto=https`; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if got := req.Header.Get(headers.Via); got != "2 raspberry" {
+		t.Errorf("want 2 raspberry, got %s", got)
+	}
+}
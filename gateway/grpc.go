@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/headers"
+)
+
+// gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcOutOfRange         = 11
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcDataLoss           = 15
+	grpcUnauthenticated    = 16
+)
+
+var grpcCodeNames = [...]string{
+	grpcOK:                 "OK",
+	grpcCanceled:           "CANCELLED",
+	grpcUnknown:            "UNKNOWN",
+	grpcInvalidArgument:    "INVALID_ARGUMENT",
+	grpcDeadlineExceeded:   "DEADLINE_EXCEEDED",
+	grpcNotFound:           "NOT_FOUND",
+	grpcAlreadyExists:      "ALREADY_EXISTS",
+	grpcPermissionDenied:   "PERMISSION_DENIED",
+	grpcResourceExhausted:  "RESOURCE_EXHAUSTED",
+	grpcFailedPrecondition: "FAILED_PRECONDITION",
+	grpcAborted:            "ABORTED",
+	grpcOutOfRange:         "OUT_OF_RANGE",
+	grpcUnimplemented:      "UNIMPLEMENTED",
+	grpcInternal:           "INTERNAL",
+	grpcUnavailable:        "UNAVAILABLE",
+	grpcDataLoss:           "DATA_LOSS",
+	grpcUnauthenticated:    "UNAUTHENTICATED",
+}
+
+const (
+	grpcContentType = "application/grpc"
+	grpcStatus      = "Grpc-Status"
+	grpcMessage     = "Grpc-Message"
+	// grpcClientClosed is the status recorded for calls the client
+	// cancelled, as nginx does.
+	grpcClientClosed = 499
+)
+
+func grpcCodeName(code int) string {
+	if code >= 0 && code < len(grpcCodeNames) {
+		return grpcCodeNames[code]
+	}
+	return "CODE(" + strconv.Itoa(code) + ")"
+}
+
+// grpcToHTTPStatus returns the HTTP status closest to a gRPC status, so
+// failed calls can be told apart in analytics.
+func grpcToHTTPStatus(code int) int {
+	switch code {
+	case grpcOK:
+		return http.StatusOK
+	case grpcCanceled:
+		return grpcClientClosed
+	case grpcInvalidArgument, grpcFailedPrecondition, grpcOutOfRange:
+		return http.StatusBadRequest
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case grpcNotFound:
+		return http.StatusNotFound
+	case grpcAlreadyExists, grpcAborted:
+		return http.StatusConflict
+	case grpcPermissionDenied:
+		return http.StatusForbidden
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcUnimplemented:
+		return http.StatusNotImplemented
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// httpToGRPCStatus maps the status of an error raised by the gateway to the
+// gRPC status returned to the client. It follows the gRPC HTTP mapping,
+// except that rate limits are reported as RESOURCE_EXHAUSTED.
+func httpToGRPCStatus(code int) int {
+	switch code {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// isGRPCRequest reports whether r is a gRPC call.
+func isGRPCRequest(r *http.Request) bool {
+	ct := r.Header.Get(headers.ContentType)
+	return ct == grpcContentType || strings.HasPrefix(ct, grpcContentType+"+") || strings.HasPrefix(ct, grpcContentType+";")
+}
+
+// writeGRPCError ends a gRPC call with status code and msg, as a
+// Trailers-Only response.
+func writeGRPCError(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Set(headers.ContentType, grpcContentType)
+	h.Set(grpcStatus, strconv.Itoa(code))
+	h.Set(grpcMessage, encodeGRPCMessage(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes msg as required for grpc-message.
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+// grpcResponseStatus returns the gRPC status of a proxied response from its
+// trailers, or its headers for a Trailers-Only response.
+func grpcResponseStatus(h http.Header) (int, bool) {
+	v := h.Get(grpcStatus)
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + grpcStatus)
+	}
+	if v == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return grpcUnknown, true
+	}
+	return code, true
+}
+
+// grpcMethod is a GRPCMethod with its target parsed.
+type grpcMethod struct {
+	apidef.GRPCMethod
+	target *url.URL
+}
+
+// newGRPCMethods indexes the methods of a gRPC API by name.
+func newGRPCMethods(defs []apidef.GRPCMethod) (map[string]*grpcMethod, error) {
+	methods := make(map[string]*grpcMethod, len(defs))
+	for _, def := range defs {
+		if !validGRPCMethodName(def.Method) {
+			return nil, fmt.Errorf("invalid gRPC method %q, want /package.Service/Method", def.Method)
+		}
+		if _, ok := methods[def.Method]; ok {
+			return nil, fmt.Errorf("gRPC method %q is configured twice", def.Method)
+		}
+		m := &grpcMethod{GRPCMethod: def}
+		if def.TargetURL != "" {
+			t, err := parseTarget(def.TargetURL)
+			if err != nil {
+				return nil, fmt.Errorf("gRPC method %q: %v", def.Method, err)
+			}
+			m.target = t
+		}
+		methods[def.Method] = m
+	}
+	return methods, nil
+}
+
+func validGRPCMethodName(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts) == 3 && parts[0] == "" && parts[1] != "" && parts[2] != ""
+}
+
+// grpcServiceWildcard returns the /package.Service/* pattern matching the
+// method name.
+func grpcServiceWildcard(name string) string {
+	return name[:strings.LastIndexByte(name, '/')+1] + "*"
+}
+
+// grpcMethodName returns the gRPC method called by r, relative to the
+// listen path of the API.
+func (a *APISpec) grpcMethodName(r *http.Request) string {
+	return stripListenPath(a.Proxy.ListenPath, r.URL.Path)
+}
+
+// grpcMethodFor returns the configuration of the gRPC method name, if any.
+func (a *APISpec) grpcMethodFor(name string) *grpcMethod {
+	if m, ok := a.grpcMethods[name]; ok {
+		return m
+	}
+	if !validGRPCMethodName(name) {
+		return nil
+	}
+	return a.grpcMethods[grpcServiceWildcard(name)]
+}
+
+// grpcMethodAllowed reports whether name is one of the allowed methods,
+// which may include /package.Service/* wildcards.
+func grpcMethodAllowed(allowed []string, name string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	wildcard := ""
+	if validGRPCMethodName(name) {
+		wildcard = grpcServiceWildcard(name)
+	}
+	for _, m := range allowed {
+		if m == name || m == wildcard {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/user"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcMessageFrame returns payload as a length-prefixed gRPC message.
+func grpcMessageFrame(payload string) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// grpcUpstream is an h2c gRPC server replying to every call with a message
+// naming itself and the method, ending it with the status given in the
+// x-status request header.
+func grpcUpstream(name string) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", grpcContentType)
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(grpcMessageFrame(name + " " + r.URL.Path))
+
+		status := r.Header.Get("x-status")
+		if status == "" {
+			status = "0"
+		}
+		w.Header().Set(grpcStatus, status)
+		w.Header().Set(grpcMessage, "upstream status")
+	}), &http2.Server{}))
+}
+
+type grpcResult struct {
+	body    string
+	status  string
+	message string
+}
+
+// grpcCall makes a gRPC call over h2c to url.
+func grpcCall(t *testing.T, url string, hdrs map[string]string) grpcResult {
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(grpcMessageFrame("ping")))
+	req.Header.Set("Content-Type", grpcContentType+"+proto")
+	req.Header.Set("TE", "trailers")
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("want gRPC responses sent with 200, got %d", res.StatusCode)
+	}
+
+	result := grpcResult{status: res.Trailer.Get(grpcStatus), message: res.Trailer.Get(grpcMessage)}
+	if result.status == "" {
+		// Trailers-Only
+		result.status, result.message = res.Header.Get(grpcStatus), res.Header.Get(grpcMessage)
+	}
+	if len(body) > 5 {
+		result.body = string(body[5:])
+	}
+	return result
+}
+
+func grpcGateway(t *testing.T, fns ...func(*apidef.APIDefinition)) (*httptest.Server, func()) {
+	echo := grpcUpstream("echo")
+	other := grpcUpstream("other")
+	fns = append([]func(*apidef.APIDefinition){func(def *apidef.APIDefinition) {
+		def.Protocol = apidef.ProtocolGRPC
+		def.GRPCMethods = []apidef.GRPCMethod{
+			{Method: "/demo.Echo/Say"},
+			{Method: "/demo.Echo/Health", UseKeylessAccess: true},
+			{Method: "/demo.Echo/Limited", Rate: 1, Per: 60},
+			{Method: "/demo.Other/*", TargetURL: other.URL},
+		}
+	}}, fns...)
+	gw := httptest.NewServer(h2c.NewHandler(processSpec(buildSpec(t, echo.URL, fns...)), &http2.Server{}))
+	return gw, func() {
+		gw.Close()
+		echo.Close()
+		other.Close()
+	}
+}
+
+func TestGRPCRouting(t *testing.T) {
+	gw, stop := grpcGateway(t)
+	defer stop()
+
+	for _, test := range []struct {
+		method, body, status string
+	}{
+		{"/demo.Echo/Say", "echo /demo.Echo/Say", "0"},
+		{"/demo.Other/Anything", "other /demo.Other/Anything", "0"},
+		{"/demo.Echo/Unknown", "", "12"},
+	} {
+		res := grpcCall(t, gw.URL+test.method, nil)
+		if res.body != test.body || res.status != test.status {
+			t.Errorf("%s: want %q with status %s, got %+v", test.method, test.body, test.status, res)
+		}
+	}
+}
+
+func TestGRPCTrailersAndAnalytics(t *testing.T) {
+	defer enableAnalytics()()
+	gw, stop := grpcGateway(t)
+	defer stop()
+
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+	res := grpcCall(t, gw.URL+"/demo.Echo/Say", map[string]string{"x-status": "5"})
+	if res.status != "5" || res.message != "upstream status" {
+		t.Errorf("want the upstream's trailers passed on, got %+v", res)
+	}
+
+	record := waitForAnalyticsRecord(t)
+	if record.Protocol != "grpc" || record.GRPCStatus != "NOT_FOUND" || record.ResponseCode != http.StatusNotFound {
+		t.Errorf("want NOT_FOUND recorded as 404, got %+v", record)
+	}
+}
+
+func TestGRPCAuthAndRateLimit(t *testing.T) {
+	gw, stop := grpcGateway(t, func(def *apidef.APIDefinition) {
+		def.UseKeylessAccess = false
+		def.Auth.AuthHeaderName = "authorization"
+	})
+	defer stop()
+
+	if res := grpcCall(t, gw.URL+"/demo.Echo/Say", nil); res.status != "16" {
+		t.Errorf("want UNAUTHENTICATED without a key, got %+v", res)
+	}
+	if res := grpcCall(t, gw.URL+"/demo.Echo/Health", nil); res.status != "0" {
+		t.Errorf("want keyless method let through, got %+v", res)
+	}
+
+	key := createSession(t, &user.SessionState{})
+	auth := map[string]string{"authorization": key}
+	for i, want := range []string{"0", "8"} {
+		if res := grpcCall(t, gw.URL+"/demo.Echo/Limited", auth); res.status != want {
+			t.Errorf("call %d: want status %s, got %+v", i, want, res)
+		}
+	}
+	if res := grpcCall(t, gw.URL+"/demo.Echo/Say", auth); res.status != "0" {
+		t.Errorf("want other methods unaffected by the method's limit, got %+v", res)
+	}
+
+	restricted := createSession(t, &user.SessionState{
+		AccessRights: map[string]user.AccessDefinition{
+			"test": {APIID: "test", GRPCMethods: []string{"/demo.Other/*"}},
+		},
+	})
+	auth = map[string]string{"authorization": restricted}
+	if res := grpcCall(t, gw.URL+"/demo.Other/Call", auth); res.status != "0" {
+		t.Errorf("want allowed service let through, got %+v", res)
+	}
+	if res := grpcCall(t, gw.URL+"/demo.Echo/Say", auth); res.status != "7" {
+		t.Errorf("want PERMISSION_DENIED for other methods, got %+v", res)
+	}
+}
+
+func TestGRPCUpstreamDown(t *testing.T) {
+	gw := httptest.NewServer(h2c.NewHandler(processSpec(buildSpec(t, "http://127.0.0.1:1", func(def *apidef.APIDefinition) {
+		def.Protocol = apidef.ProtocolGRPC
+	})), &http2.Server{}))
+	defer gw.Close()
+
+	if res := grpcCall(t, gw.URL+"/demo.Echo/Say", nil); res.status != "14" {
+		t.Errorf("want UNAVAILABLE, got %+v", res)
+	}
+}
+
+func TestGRPCMethodValidation(t *testing.T) {
+	for _, method := range []string{"demo.Echo/Say", "/demo.Echo", "/demo.Echo/Say/x", "//Say"} {
+		def := &apidef.APIDefinition{
+			APIID:       "test",
+			Protocol:    apidef.ProtocolGRPC,
+			Proxy:       apidef.ProxyConfig{TargetURL: "http://localhost"},
+			GRPCMethods: []apidef.GRPCMethod{{Method: method}},
+		}
+		if _, err := (APIDefinitionLoader{}).MakeSpec(def); err == nil {
+			t.Errorf("expected error for method %q", method)
+		}
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	if got := encodeGRPCMessage("100% done\n"); got != "100%25 done%0A" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/raspberry-gateway/raspberry/headers"
+)
+
+const defaultTemplateName = "error.json"
+
+// defaultTemplate is used when no templates could be loaded from disk.
+var defaultTemplate = template.Must(template.New(defaultTemplateName).Funcs(webhookFuncs).Parse(`{
+    "error": {{json .Message}}
+}`))
+
+// templates holds the *template.Template loaded from template_path,
+// replaced as a whole on reload.
+var templates atomic.Value
+
+func init() {
+	templates.Store(defaultTemplate)
+}
+
+// currentTemplates returns the templates loaded from template_path.
+func currentTemplates() *template.Template {
+	return templates.Load().(*template.Template)
+}
+
+// APIError is the value passed to error templates.
+type APIError struct {
+	Message string
+}
+
+// loadTemplates parses every template in dir. Templates named
+// error_<code>.json take precedence over error.json for that status code.
+// An empty dir means the defaults, rather than the working directory.
+func loadTemplates(dir string) {
+	if dir == "" {
+		templates.Store(defaultTemplate)
+		return
+	}
+	tmpls, err := template.New("").Funcs(webhookFuncs).ParseGlob(filepath.Join(dir, "*"))
+	if err != nil {
+		mainLog.Warnf("Couldn't load templates from %q, using defaults: %v", dir, err)
+		templates.Store(defaultTemplate)
+		return
+	}
+	templates.Store(tmpls)
+}
+
+// handleError writes an error response using the templates loaded from
+// template_path. gRPC calls get the matching gRPC status instead.
+func handleError(w http.ResponseWriter, r *http.Request, errMsg string, errCode int) {
+	if isGRPCRequest(r) {
+		writeGRPCError(w, httpToGRPCStatus(errCode), errMsg)
+		return
+	}
+
+	tmpls := currentTemplates()
+	tmpl := tmpls.Lookup("error_" + strconv.Itoa(errCode) + ".json")
+	if tmpl == nil {
+		tmpl = tmpls.Lookup(defaultTemplateName)
+	}
+	if tmpl == nil {
+		tmpl = defaultTemplate
+	}
+
+	w.Header().Set(headers.ContentType, headers.ApplicationJSON)
+	w.WriteHeader(errCode)
+	if err := tmpl.Execute(w, &APIError{Message: errMsg}); err != nil {
+		log.WithField("prefix", "gateway").Error("Couldn't execute error template: ", err)
+	}
+}
@@ -0,0 +1,391 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/dnscache"
+	"github.com/raspberry-gateway/raspberry/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCheckInterval      = 10 * time.Second
+	defaultCheckTimeout       = 5 * time.Second
+	defaultHealthValueTimeout = 30 * time.Second
+
+	// maxCheckBody is how much of a probe response is read to match
+	// expected_body against.
+	maxCheckBody = 64 << 10
+)
+
+var hostCheckLog = log.WithField("prefix", "host-check")
+
+// HostStatus is the health of an upstream target as reported by the
+// control API.
+type HostStatus struct {
+	URL         string    `json:"url"`
+	APIID       string    `json:"api_id"`
+	Healthy     bool      `json:"healthy"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	DownSince   time.Time `json:"down_since,omitempty"`
+}
+
+type hostHealth struct {
+	url          *url.URL
+	apiID        string
+	conf         apidef.UpstreamHealthCheck
+	expectedBody *regexp.Regexp
+	client       *http.Client // probes the target, nil for passive checks
+
+	healthy         bool
+	failures        int // consecutive failed probes
+	successes       int // consecutive successful probes
+	passiveFailures int // consecutive failed proxied requests
+	lastChecked     time.Time
+	lastError       string
+	downSince       time.Time
+}
+
+func (h *hostHealth) active() bool {
+	return h.conf.Path != ""
+}
+
+func (h *hostHealth) key() string {
+	return hostKey(h.apiID, h.url)
+}
+
+// HostCheckManager runs the health checks of the upstream targets and
+// marks them up or down for the load balancers. Targets are checked per
+// API, by hostKey.
+type HostCheckManager struct {
+	mu     sync.Mutex
+	hosts  map[string]*hostHealth
+	stopCh chan struct{}
+}
+
+// GlobalHostChecker checks the targets of the loaded APIs.
+var GlobalHostChecker = &HostCheckManager{hosts: map[string]*hostHealth{}}
+
+// Update replaces the checked targets with those of specs. Targets that are
+// still in use keep their current state.
+func (m *HostCheckManager) Update(specs []*APISpec) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopCh != nil {
+		close(m.stopCh)
+		m.stopCh = nil
+	}
+
+	old := m.hosts
+	m.hosts = map[string]*hostHealth{}
+	if !config.Global().HealthCheck.EnableHealthChecks {
+		for key := range old {
+			hostsDown.Delete(key)
+		}
+		return
+	}
+
+	for _, spec := range specs {
+		conf := spec.HealthCheck
+		if conf.Path == "" && conf.PassiveFailures <= 0 {
+			continue
+		}
+		var expectedBody *regexp.Regexp
+		if conf.ExpectedBody != "" {
+			re, err := regexp.Compile(conf.ExpectedBody)
+			if err != nil {
+				hostCheckLog.WithField("api_id", spec.APIID).Error("Invalid expected_body, skipping health checks: ", err)
+				continue
+			}
+			expectedBody = re
+		}
+		for _, t := range spec.loadBalancer.targets {
+			h := &hostHealth{url: t.url, apiID: spec.APIID, conf: conf, expectedBody: expectedBody, healthy: true}
+			if h.active() {
+				h.client = probeClient(spec, conf)
+			}
+			key := h.key()
+			if prev, ok := old[key]; ok {
+				h.healthy, h.lastChecked, h.lastError, h.downSince = prev.healthy, prev.lastChecked, prev.lastError, prev.downSince
+				if !h.healthy && !h.active() {
+					// the pending revive was for the replaced entry
+					m.scheduleRevive(h)
+				}
+			}
+			m.hosts[key] = h
+		}
+	}
+
+	for key := range old {
+		if _, ok := m.hosts[key]; !ok {
+			hostsDown.Delete(key)
+		}
+	}
+
+	m.stopCh = make(chan struct{})
+	for _, h := range m.hosts {
+		if h.active() {
+			go m.checkLoop(h, m.stopCh)
+		}
+	}
+}
+
+// Stop stops all active checks.
+func (m *HostCheckManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopCh != nil {
+		close(m.stopCh)
+		m.stopCh = nil
+	}
+}
+
+// checkLoop probes h every interval until stop is closed. The connections
+// of its client are closed on the way out, as h isn't probed again.
+func (m *HostCheckManager) checkLoop(h *hostHealth, stop chan struct{}) {
+	defer h.client.CloseIdleConnections()
+
+	interval := defaultCheckInterval
+	if h.conf.Interval > 0 {
+		interval = time.Duration(h.conf.Interval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := m.probe(h)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		m.recordProbe(h, err)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeClient returns the client the targets of spec are probed with, its
+// connections are kept alive between probes.
+func probeClient(spec *APISpec, conf apidef.UpstreamHealthCheck) *http.Client {
+	timeout := defaultCheckTimeout
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	transport := httpTransport()
+	if spec.upstreamTLS != nil {
+		transport.TLSClientConfig = spec.upstreamTLS.Clone()
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// probe requests the health check path of the target and checks the
+// response against the expected status and body.
+func (m *HostCheckManager) probe(h *hostHealth) error {
+	checkURL := *h.url
+	checkURL.Path = singleJoiningSlash(h.url.Path, h.conf.Path)
+	resp, err := h.client.Get(checkURL.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if h.conf.ExpectedStatus > 0 {
+		if resp.StatusCode != h.conf.ExpectedStatus {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if h.expectedBody != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+		if err != nil {
+			return err
+		}
+		if !h.expectedBody.Match(body) {
+			return fmt.Errorf("body doesn't match %q", h.conf.ExpectedBody)
+		}
+	}
+	return nil
+}
+
+// recordProbe adds the outcome of a probe of h, unless an update replaced
+// h while it was probed.
+func (m *HostCheckManager) recordProbe(h *hostHealth, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hosts[h.key()] != h {
+		return
+	}
+
+	h.lastChecked = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		h.successes = 0
+		h.failures++
+		if h.healthy && h.failures >= threshold(h.conf.UnhealthyThreshold) {
+			m.setHealthy(h, false, "health check failed: "+err.Error())
+		}
+		return
+	}
+
+	h.lastError = ""
+	h.failures = 0
+	h.successes++
+	if !h.healthy && h.successes >= threshold(h.conf.HealthyThreshold) {
+		m.setHealthy(h, true, "health check passed")
+	}
+}
+
+// ReportResult records the outcome of a request of the API apiID proxied
+// to target, marking it down after passive_failures consecutive failures.
+func (m *HostCheckManager) ReportResult(apiID string, target *url.URL, failed bool, reason string) {
+	if target == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.hosts[hostKey(apiID, target)]
+	if !ok || h.conf.PassiveFailures <= 0 {
+		return
+	}
+	if !failed {
+		h.passiveFailures = 0
+		return
+	}
+	h.passiveFailures++
+	if h.healthy && h.passiveFailures >= h.conf.PassiveFailures {
+		m.setHealthy(h, false, fmt.Sprintf("%d consecutive failed requests, last: %s", h.passiveFailures, reason))
+		if !h.active() {
+			m.scheduleRevive(h)
+		}
+	}
+}
+
+// scheduleRevive puts a passively marked down target back into rotation
+// after health_check_value_timeouts, as there is no probe to do so.
+func (m *HostCheckManager) scheduleRevive(h *hostHealth) {
+	timeout := defaultHealthValueTimeout
+	if t := config.Global().HealthCheck.HealthCheckValueTimeout; t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+	time.AfterFunc(timeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if current, ok := m.hosts[h.key()]; ok && current == h && !h.healthy {
+			m.setHealthy(h, true, "retrying after passive failures")
+		}
+	})
+}
+
+// setHealthy marks h up or down. m.mu must be held.
+func (m *HostCheckManager) setHealthy(h *hostHealth, healthy bool, reason string) {
+	h.healthy = healthy
+	h.passiveFailures = 0
+	logger := hostCheckLog.WithFields(logrus.Fields{
+		"api_id": h.apiID,
+		"target": h.url.String(),
+	})
+	if healthy {
+		h.downSince = time.Time{}
+		hostsDown.Delete(h.key())
+		logger.Info("Target is up: ", reason)
+		return
+	}
+	h.downSince = time.Now()
+	hostsDown.Store(h.key(), true)
+	logger.Warning("Target is down: ", reason)
+}
+
+// Status returns the health of every checked target.
+func (m *HostCheckManager) Status() []HostStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]HostStatus, 0, len(m.hosts))
+	for _, h := range m.hosts {
+		statuses = append(statuses, HostStatus{
+			URL:         h.url.String(),
+			APIID:       h.apiID,
+			Healthy:     h.healthy,
+			LastChecked: h.lastChecked,
+			LastError:   h.lastError,
+			DownSince:   h.downSince,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].URL != statuses[j].URL {
+			return statuses[i].URL < statuses[j].URL
+		}
+		return statuses[i].APIID < statuses[j].APIID
+	})
+	return statuses
+}
+
+func threshold(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// storageStatus returns the state of the storage connections.
+var storageStatus = storage.Status
+
+type apiHealthStatus struct {
+	Status    string                     `json:"status"`
+	Upstreams []HostStatus               `json:"upstreams"`
+	Storage   []storage.ConnectionStatus `json:"storage,omitempty"`
+	DNSCache  *dnscache.Stats            `json:"dns_cache,omitempty"`
+}
+
+// healthHandler reports the health of the upstream targets and of the
+// storage connections on the control API. Without its storage the gateway
+// fails, and answers 503.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		doJSONWrite(w, http.StatusMethodNotAllowed, apiError("Method not supported"))
+		return
+	}
+	status := apiHealthStatus{Status: "pass", Upstreams: GlobalHostChecker.Status()}
+	for _, h := range status.Upstreams {
+		if !h.Healthy {
+			status.Status = "warn"
+			break
+		}
+	}
+	code := http.StatusOK
+	status.Storage = storageStatus()
+	for _, conn := range status.Storage {
+		switch {
+		case conn.State == storage.StateDisconnected:
+			status.Status = "fail"
+			code = http.StatusServiceUnavailable
+		case conn.State == storage.StateConnecting && status.Status == "pass":
+			status.Status = "warn"
+		}
+	}
+	if dnsCache := currentDNSCache(); dnsCache != nil {
+		stats := dnsCache.Stats()
+		status.DNSCache = &stats
+	}
+	doJSONWrite(w, code, status)
+}
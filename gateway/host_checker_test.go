@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/storage"
+)
+
+// enableHealthChecks turns health checks on, the returned func restores the
+// previous configuration and stops all checks.
+func enableHealthChecks(valueTimeout int64) func() {
+	old := config.Global()
+	conf := old
+	conf.HealthCheck = config.HealthCheckConfig{
+		EnableHealthChecks:      true,
+		HealthCheckValueTimeout: valueTimeout,
+	}
+	config.SetGlobal(conf)
+	return func() {
+		config.SetGlobal(old)
+		GlobalHostChecker.Update(nil)
+	}
+}
+
+func waitForHost(t *testing.T, apiID, target string, down bool) {
+	u, _ := url.Parse(target)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if isHostDown(apiID, u) == down {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: want down=%v", target, down)
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	defer enableHealthChecks(0)()
+
+	var healthy int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer upstream.Close()
+
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.HealthCheck = apidef.UpstreamHealthCheck{
+			Path:               "/health",
+			Interval:           1,
+			ExpectedBody:       `"ok"`,
+			UnhealthyThreshold: 1,
+		}
+	})
+	GlobalHostChecker.Update([]*APISpec{spec})
+	waitForHost(t, "test", upstream.URL, false)
+
+	atomic.StoreInt32(&healthy, 0)
+	waitForHost(t, "test", upstream.URL, true)
+
+	rec := httptest.NewRecorder()
+	processSpec(spec).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("want 503 while the only target is down, got %d", rec.Code)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitForHost(t, "test", upstream.URL, false)
+}
+
+func TestHealthCheckPerAPI(t *testing.T) {
+	defer enableHealthChecks(0)()
+
+	var conns int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/up" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	specs := make([]*APISpec, 2)
+	for i, path := range []string{"/up", "/down"} {
+		path := path
+		specs[i] = buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+			def.APIID = strings.TrimPrefix(path, "/")
+			def.HealthCheck = apidef.UpstreamHealthCheck{Path: path, Interval: 1, UnhealthyThreshold: 1}
+		})
+	}
+	GlobalHostChecker.Update(specs)
+
+	// the same target is down for one API only
+	waitForHost(t, "down", upstream.URL, true)
+	time.Sleep(1500 * time.Millisecond)
+	u, _ := url.Parse(upstream.URL)
+	if isHostDown("up", u) {
+		t.Error("want the target up for the API whose check passes")
+	}
+	if statuses := GlobalHostChecker.Status(); len(statuses) != 2 {
+		t.Errorf("want a status per API, got %+v", statuses)
+	}
+	// probes reuse their connection
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("want a connection per API, got %d", n)
+	}
+}
+
+func TestHealthCheckStaleProbe(t *testing.T) {
+	defer enableHealthChecks(0)()
+	upstream := testUpstream()
+	defer upstream.Close()
+
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.HealthCheck = apidef.UpstreamHealthCheck{Path: "/health", Interval: 60, UnhealthyThreshold: 1}
+	})
+	u, _ := url.Parse(upstream.URL)
+	GlobalHostChecker.Update([]*APISpec{spec})
+	GlobalHostChecker.mu.Lock()
+	replaced := GlobalHostChecker.hosts[hostKey(spec.APIID, u)]
+	GlobalHostChecker.mu.Unlock()
+
+	// a probe finishing after a reload replaced its entry
+	GlobalHostChecker.Update([]*APISpec{spec})
+	GlobalHostChecker.recordProbe(replaced, errors.New("connection refused"))
+	if isHostDown(spec.APIID, u) {
+		t.Error("want the outcome of a replaced entry's probe ignored")
+	}
+}
+
+func TestPassiveHealthCheck(t *testing.T) {
+	defer enableHealthChecks(1)()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.HealthCheck.PassiveFailures = 2
+	})
+	GlobalHostChecker.Update([]*APISpec{spec})
+	handler := processSpec(spec)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("want upstream's 500, got %d", rec.Code)
+		}
+	}
+	waitForHost(t, "test", upstream.URL, true)
+
+	// with no active check the target is retried after the value timeout
+	waitForHost(t, "test", upstream.URL, false)
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	defer enableHealthChecks(0)()
+
+	spec := buildSpec(t, "http://127.0.0.1:1", func(def *apidef.APIDefinition) {
+		def.HealthCheck.PassiveFailures = 1
+	})
+	GlobalHostChecker.Update([]*APISpec{spec})
+	GlobalHostChecker.ReportResult(spec.APIID, spec.loadBalancer.targets[0].url, true, "connection refused")
+
+	admin := map[string]string{headers.XRaspberryAuthorization: testSecret}
+	rec := doRequest(controlAPI(), http.MethodGet, "/raspberry/health", admin, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	var status apiHealthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "warn" || len(status.Upstreams) != 1 || status.Upstreams[0].Healthy {
+		t.Errorf("unexpected health status: %+v", status)
+	}
+}
+
+func TestHealthEndpointStorage(t *testing.T) {
+	defer func(old func() []storage.ConnectionStatus) { storageStatus = old }(storageStatus)
+	admin := map[string]string{headers.XRaspberryAuthorization: testSecret}
+
+	for _, test := range []struct {
+		state  string
+		code   int
+		status string
+	}{
+		{storage.StateConnected, http.StatusOK, "pass"},
+		{storage.StateConnecting, http.StatusOK, "warn"},
+		{storage.StateDisconnected, http.StatusServiceUnavailable, "fail"},
+	} {
+		storageStatus = func() []storage.ConnectionStatus {
+			return []storage.ConnectionStatus{{Type: "redis", Mode: "single", Addrs: []string{"127.0.0.1:6379"}, State: test.state}}
+		}
+		rec := doRequest(controlAPI(), http.MethodGet, "/raspberry/health", admin, "")
+		var status apiHealthStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != test.code || status.Status != test.status || len(status.Storage) != 1 || status.Storage[0].State != test.state {
+			t.Errorf("%s: want %d %s, got %d %+v", test.state, test.code, test.status, rec.Code, status)
+		}
+	}
+}
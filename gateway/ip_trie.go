@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"net"
+
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// ipTrie is a binary prefix trie of networks. IPv4 networks are kept as
+// IPv4-mapped IPv6 ones, so both families share it and a lookup takes at
+// most 128 steps however many networks it holds. A nil *ipTrie is empty.
+type ipTrie struct {
+	root ipTrieNode
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	// end is set where a network ends, covering everything below it.
+	end bool
+}
+
+// newIPTrie returns a trie of the IPs and CIDRs in list, or nil when it is
+// empty.
+func newIPTrie(list []string) (*ipTrie, error) {
+	nets, err := request.ParseCIDRs(list)
+	if err != nil || len(nets) == 0 {
+		return nil, err
+	}
+	t := &ipTrie{}
+	for _, n := range nets {
+		t.insert(n)
+	}
+	return t, nil
+}
+
+func (t *ipTrie) insert(n *net.IPNet) {
+	ip := n.IP.To16()
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+
+	node := &t.root
+	for i := 0; i < ones && !node.end; i++ {
+		b := ipBit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &ipTrieNode{}
+		}
+		node = node.children[b]
+	}
+	node.end = true
+	// the network covers any longer ones already in the trie
+	node.children = [2]*ipTrieNode{}
+}
+
+// contains reports whether ip is in one of the networks of t.
+func (t *ipTrie) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if t == nil || ip == nil {
+		return false
+	}
+	node := &t.root
+	for i := 0; !node.end; i++ {
+		if i == 8*net.IPv6len {
+			return false
+		}
+		if node = node.children[ipBit(ip, i)]; node == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ipBit returns bit i of ip, counting from the most significant.
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>uint(7-i%8)) & 1
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIPTrie(t *testing.T) {
+	trie, err := newIPTrie([]string{
+		"10.0.0.0/8",
+		"192.168.1.7",
+		"2001:db8::/32",
+		"2001:db8:1::/48", // covered by the /32
+		"::1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+		{"::2", false},
+		{"not-an-ip", false},
+	} {
+		if got := trie.contains(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s: want %v, got %v", test.ip, test.want, got)
+		}
+	}
+}
+
+func TestIPTrieEmpty(t *testing.T) {
+	trie, err := newIPTrie(nil)
+	if err != nil || trie != nil {
+		t.Fatalf("want a nil trie, got %v %v", trie, err)
+	}
+	if trie.contains(net.ParseIP("10.0.0.1")) {
+		t.Error("want nothing in an empty trie")
+	}
+	if _, err := newIPTrie([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("want an invalid CIDR refused")
+	}
+}
+
+func TestIPTrieAll(t *testing.T) {
+	v4, _ := newIPTrie([]string{"0.0.0.0/0"})
+	if !v4.contains(net.ParseIP("203.0.113.1")) || v4.contains(net.ParseIP("2001:db8::1")) {
+		t.Error("want 0.0.0.0/0 to hold every IPv4 address and no IPv6 one")
+	}
+	all, _ := newIPTrie([]string{"::/0"})
+	if !all.contains(net.ParseIP("2001:db8::1")) {
+		t.Error("want ::/0 to hold every IPv6 address")
+	}
+}
+
+func BenchmarkIPTrie(b *testing.B) {
+	var list []string
+	for i := 0; i < 10000; i++ {
+		list = append(list, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+	trie, err := newIPTrie(list)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ip := net.ParseIP("203.0.113.1")
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if trie.contains(ip) {
+			b.Fatal("want the IP outside the networks")
+		}
+	}
+}
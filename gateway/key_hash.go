@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/spaolacci/murmur3"
+)
+
+// The functions keys can be hashed with.
+const (
+	hashMurmur64  = "murmur64"
+	hashMurmur128 = "murmur128"
+	hashSHA256    = "sha256"
+
+	defaultHashKeyFunction = hashMurmur64
+)
+
+var keyHashFunctions = []string{hashMurmur64, hashMurmur128, hashSHA256}
+
+// checkHashKeyFunctions returns an error if the hash_key_function or
+// hash_key_function_fallback of conf isn't a function keys can be hashed
+// with.
+func checkHashKeyFunctions(conf config.Config) error {
+	if err := checkHashKeyFunction(conf.HashKeyFunction); err != nil {
+		return fmt.Errorf("hash_key_function: %v", err)
+	}
+	for _, fn := range conf.HashKeyFunctionFallback {
+		if err := checkHashKeyFunction(fn); err != nil {
+			return fmt.Errorf("hash_key_function_fallback: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkHashKeyFunction returns an error if fn isn't a function keys can be
+// hashed with, empty meaning the default.
+func checkHashKeyFunction(fn string) error {
+	if fn == "" {
+		return nil
+	}
+	for _, known := range keyHashFunctions {
+		if fn == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown function %q, use one of %s", fn, strings.Join(keyHashFunctions, ", "))
+}
+
+// hashKeyFunction returns the function keys are hashed with in conf.
+func hashKeyFunction(conf config.Config) string {
+	if conf.HashKeyFunction == "" {
+		return defaultHashKeyFunction
+	}
+	return conf.HashKeyFunction
+}
+
+// hashKey returns the hash of keyName made with fn, as the name of fn and
+// the hex of the hash so that hashes made with different functions don't
+// mix.
+func hashKey(keyName, fn string) string {
+	var sum []byte
+	switch fn {
+	case hashSHA256:
+		s := sha256.Sum256([]byte(keyName))
+		sum = s[:]
+	case hashMurmur128:
+		h1, h2 := murmur3.Sum128([]byte(keyName))
+		sum = make([]byte, 16)
+		binary.BigEndian.PutUint64(sum, h1)
+		binary.BigEndian.PutUint64(sum[8:], h2)
+	default:
+		sum = make([]byte, 8)
+		binary.BigEndian.PutUint64(sum, murmur3.Sum64([]byte(keyName)))
+	}
+	return fn + ":" + hex.EncodeToString(sum)
+}
+
+// isKeyHash reports whether name is a hash made by hashKey.
+func isKeyHash(name string) bool {
+	for _, fn := range keyHashFunctions {
+		if strings.HasPrefix(name, fn+":") && len(name) == len(hashKey("", fn)) {
+			_, err := hex.DecodeString(name[len(fn)+1:])
+			return err == nil
+		}
+	}
+	return false
+}
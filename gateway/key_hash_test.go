@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+// hashKeys turns key hashing on with fn, falling back to fallback, the
+// returned func restores the previous configuration.
+func hashKeys(fn string, fallback ...string) func() {
+	old := config.Global()
+	conf := old
+	conf.HashKeys = fn != ""
+	conf.HashKeyFunction = fn
+	conf.HashKeyFunctionFallback = fallback
+	config.SetGlobal(conf)
+	return func() { config.SetGlobal(old) }
+}
+
+// storedSessions returns the names sessions are stored under.
+func storedSessions() map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range GlobalSessionManager.Sessions("") {
+		names[name] = true
+	}
+	return names
+}
+
+func TestHashKey(t *testing.T) {
+	if got := hashKey("", hashSHA256); got != "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("unexpected SHA-256 hash %s", got)
+	}
+	for _, fn := range keyHashFunctions {
+		h := hashKey("key", fn)
+		if !strings.HasPrefix(h, fn+":") || h == hashKey("other", fn) || h != hashKey("key", fn) {
+			t.Errorf("%s: unexpected hash %s", fn, h)
+		}
+		if !isKeyHash(h) {
+			t.Errorf("want %s taken for a hash", h)
+		}
+	}
+	for _, name := range []string{"key", "sha256:", "murmur64:zz11223344556677", "murmur64:0011"} {
+		if isKeyHash(name) {
+			t.Errorf("want %s not taken for a hash", name)
+		}
+	}
+
+	if err := checkHashKeyFunctions(config.Config{HashKeyFunctionFallback: []string{hashSHA256}}); err != nil {
+		t.Error(err)
+	}
+	for _, conf := range []config.Config{{HashKeyFunction: "md5"}, {HashKeyFunctionFallback: []string{"md5"}}} {
+		if err := checkHashKeyFunctions(conf); err == nil {
+			t.Errorf("want an unknown function refused in %+v", conf)
+		}
+	}
+}
+
+func TestHashedKeysControlAPI(t *testing.T) {
+	defer hashKeys(hashSHA256)()
+	api := controlAPI()
+	admin := map[string]string{headers.XRaspberryAuthorization: testSecret}
+
+	rec := doRequest(api, http.MethodPost, "/raspberry/keys/create", admin, `{"rate": 10, "per": 1}`)
+	var created apiModifyKeySuccess
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.KeyHash != hashKey(created.Key, hashSHA256) {
+		t.Fatalf("want the hash of the key, got %+v", created)
+	}
+	if stored := storedSessions(); stored[created.Key] || !stored[created.KeyHash] {
+		t.Errorf("want only the hash stored, got %v", stored)
+	}
+
+	for _, path := range []string{"/raspberry/keys/" + created.Key, "/raspberry/keys/" + created.KeyHash + "?hashed=true"} {
+		if rec := doRequest(api, http.MethodGet, path, admin, ""); rec.Code != http.StatusOK {
+			t.Errorf("%s: want %d, got %d", path, http.StatusOK, rec.Code)
+		}
+	}
+	if rec := doRequest(api, http.MethodGet, "/raspberry/keys/"+created.Key+"?hashed=true", admin, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("want a key passed as a hash refused, got %d", rec.Code)
+	}
+	unknown := hashKey("unknown", hashSHA256)
+	if rec := doRequest(api, http.MethodPut, "/raspberry/keys/"+unknown+"?hashed=true", admin, `{}`); rec.Code != http.StatusNotFound {
+		t.Errorf("want no key added by its hash, got %d", rec.Code)
+	}
+	if rec := doRequest(api, http.MethodPut, "/raspberry/keys/"+created.KeyHash+"?hashed=true", admin, `{"rate": 20, "per": 1}`); rec.Code != http.StatusOK {
+		t.Errorf("want the key updated by its hash, got %d", rec.Code)
+	}
+	if session, _ := GlobalSessionManager.SessionDetail(created.Key, false); session.Rate != 20 {
+		t.Errorf("want the update stored, got %+v", session)
+	}
+
+	rec = doRequest(api, http.MethodDelete, "/raspberry/keys/"+created.KeyHash+"?hashed=true", admin, "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("want the key deleted by its hash, got %d", rec.Code)
+	}
+	if _, ok := GlobalSessionManager.SessionDetail(created.Key, false); ok {
+		t.Error("want the session gone")
+	}
+}
+
+func TestHashedKeysMigration(t *testing.T) {
+	upstream := testUpstream()
+	defer upstream.Close()
+	rt := loadApps([]*APISpec{buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseKeylessAccess = false
+		def.Auth.AuthHeaderName = "x-api-key"
+	})})
+
+	// stored before hashing was turned on, with some quota used
+	session := &user.SessionState{QuotaMax: 5, QuotaRenewalRate: 3600}
+	key := generateToken("")
+	if err := GlobalSessionManager.UpdateSession(key, session, 600, false); err != nil {
+		t.Fatal(err)
+	}
+	defer GlobalSessionManager.RemoveSession(key, false)
+	doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": key}, "")
+
+	for i, fn := range []string{hashMurmur64, hashSHA256} {
+		restore := hashKeys(fn, hashMurmur64)
+		rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": key}, "")
+		if rec.Code != http.StatusOK || rec.Header().Get(headers.XRateLimitRemaining) != strconv.Itoa(3-i) {
+			t.Errorf("%s: want the key served with its quota, got %d %q", fn, rec.Code, rec.Header().Get(headers.XRateLimitRemaining))
+		}
+		stored := storedSessions()
+		if stored[key] || !stored[hashKey(key, fn)] || stored[hashKey(key, hashMurmur64)] != (fn == hashMurmur64) {
+			t.Errorf("%s: want the session moved to its hash, got %v", fn, stored)
+		}
+		if exp, _ := GlobalSessionManager.(*DefaultSessionManager).store.GetExp(hashKey(key, fn)); exp < 590 || exp > 600 {
+			t.Errorf("%s: want the expiry kept, got %d", fn, exp)
+		}
+		restore()
+	}
+
+	// and found again without hashing, by the function that hashed it
+	if _, ok := GlobalSessionManager.SessionDetail(key, false); ok {
+		t.Error("want hashed sessions only found with their function as a fallback")
+	}
+	defer hashKeys("", hashSHA256)()
+	if _, ok := GlobalSessionManager.SessionDetail(key, false); !ok {
+		t.Error("want hashed sessions found with hashing off")
+	}
+}
+
+func TestHashedKeySentAsKey(t *testing.T) {
+	defer hashKeys(hashSHA256, hashMurmur64)()
+	upstream := testUpstream()
+	defer upstream.Close()
+	rt := loadApps([]*APISpec{buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseKeylessAccess = false
+		def.Auth.AuthHeaderName = "x-api-key"
+	})})
+
+	key := generateToken("")
+	if err := GlobalSessionManager.UpdateSession(key, &user.SessionState{}, 600, false); err != nil {
+		t.Fatal(err)
+	}
+	defer GlobalSessionManager.RemoveSession(key, false)
+
+	// the hash is listed, but isn't the key
+	hash := hashKey(key, hashSHA256)
+	if rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": hash}, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("want the stored hash refused as a key, got %d", rec.Code)
+	}
+	if stored := storedSessions(); !stored[hash] || stored[hashKey(hash, hashSHA256)] {
+		t.Errorf("want the session left under its hash, got %v", stored)
+	}
+	if rec := doRequest(rt, http.MethodGet, "/", map[string]string{"x-api-key": key}, ""); rec.Code != http.StatusOK {
+		t.Errorf("want the key still served, got %d", rec.Code)
+	}
+
+	admin := map[string]string{headers.XRaspberryAuthorization: testSecret}
+	if rec := doRequest(controlAPI(), http.MethodPost, "/raspberry/keys/"+hash, admin, `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("want a key name looking like a hash refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// hashReplicas is how many points each unit of weight gets on the
+// consistent hash ring.
+const hashReplicas = 100
+
+var errNoHealthyTargets = errors.New("no healthy upstream targets available")
+
+// upstreamTarget is a target of an API together with the number of
+// requests currently being proxied to it.
+type upstreamTarget struct {
+	url    *url.URL
+	weight int
+	active int64
+
+	currentWeight int // guarded by LoadBalancer.mu
+}
+
+func (t *upstreamTarget) acquire() {
+	atomic.AddInt64(&t.active, 1)
+}
+
+func (t *upstreamTarget) release() {
+	atomic.AddInt64(&t.active, -1)
+}
+
+func (t *upstreamTarget) activeConnections() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+type ringEntry struct {
+	hash   uint32
+	target *upstreamTarget
+}
+
+// LoadBalancer picks the upstream target for each request of an API,
+// skipping targets that are marked down.
+type LoadBalancer struct {
+	apiID      string
+	algorithm  string
+	hashOn     string
+	hashHeader string
+	targets    []*upstreamTarget
+
+	counter uint64
+
+	mu   sync.Mutex // guards currentWeight of the targets
+	ring []ringEntry
+}
+
+// NewLoadBalancer returns a LoadBalancer for the targets of proxy, of the
+// API apiID. A proxy without targets balances over its single target_url.
+func NewLoadBalancer(apiID string, proxy apidef.ProxyConfig) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		apiID:      apiID,
+		algorithm:  proxy.LoadBalancing,
+		hashOn:     proxy.HashOn,
+		hashHeader: proxy.HashHeader,
+	}
+	if lb.algorithm == "" {
+		lb.algorithm = apidef.RoundRobin
+	}
+
+	targets := proxy.Targets
+	if len(targets) == 0 {
+		targets = []apidef.UpstreamTarget{{URL: proxy.TargetURL}}
+	}
+	for _, t := range targets {
+		u, err := parseTarget(t.URL)
+		if err != nil {
+			return nil, err
+		}
+		weight := 1
+		if t.Weight != nil {
+			weight = *t.Weight
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("target %s: weight can't be negative", t.URL)
+		}
+		if weight == 0 {
+			// drained, it gets no requests
+			continue
+		}
+		lb.targets = append(lb.targets, &upstreamTarget{url: u, weight: weight})
+	}
+	if len(lb.targets) == 0 {
+		return nil, errors.New("every target has a weight of 0")
+	}
+
+	switch lb.algorithm {
+	case apidef.RoundRobin, apidef.WeightedRoundRobin, apidef.LeastConnections:
+	case apidef.ConsistentHash:
+		if lb.hashOn == apidef.HashOnHeader && lb.hashHeader == "" {
+			return nil, errors.New("hash_header is required when hashing on a header")
+		}
+		lb.buildRing()
+	default:
+		return nil, fmt.Errorf("unknown load balancing algorithm %q", lb.algorithm)
+	}
+	return lb, nil
+}
+
+// String lists the targets of the load balancer.
+func (lb *LoadBalancer) String() string {
+	urls := make([]string, len(lb.targets))
+	for i, t := range lb.targets {
+		urls[i] = t.url.String()
+	}
+	if len(urls) == 1 {
+		return urls[0]
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(urls, ", "), lb.algorithm)
+}
+
+func (lb *LoadBalancer) buildRing() {
+	for _, t := range lb.targets {
+		for i := 0; i < t.weight*hashReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + t.url.String()))
+			lb.ring = append(lb.ring, ringEntry{hash: h, target: t})
+		}
+	}
+	sort.Slice(lb.ring, func(i, j int) bool {
+		return lb.ring[i].hash < lb.ring[j].hash
+	})
+}
+
+// Next returns the target r should be proxied to.
+func (lb *LoadBalancer) Next(r *http.Request) (*upstreamTarget, error) {
+	var t *upstreamTarget
+	switch lb.algorithm {
+	case apidef.WeightedRoundRobin:
+		t = lb.nextWeighted()
+	case apidef.LeastConnections:
+		t = lb.nextLeastConnections()
+	case apidef.ConsistentHash:
+		t = lb.nextHashed(r)
+	default:
+		t = lb.nextRoundRobin()
+	}
+	if t == nil {
+		return nil, errNoHealthyTargets
+	}
+	return t, nil
+}
+
+func (lb *LoadBalancer) nextRoundRobin() *upstreamTarget {
+	n := uint64(len(lb.targets))
+	start := atomic.AddUint64(&lb.counter, 1) - 1
+	for i := uint64(0); i < n; i++ {
+		t := lb.targets[(start+i)%n]
+		if !isHostDown(lb.apiID, t.url) {
+			return t
+		}
+	}
+	return nil
+}
+
+// nextWeighted implements smooth weighted round robin: every pick adds each
+// target's weight to its current weight, the highest current weight wins
+// and is reduced by the total weight.
+func (lb *LoadBalancer) nextWeighted() *upstreamTarget {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	var best *upstreamTarget
+	total := 0
+	for _, t := range lb.targets {
+		if isHostDown(lb.apiID, t.url) {
+			continue
+		}
+		t.currentWeight += t.weight
+		total += t.weight
+		if best == nil || t.currentWeight > best.currentWeight {
+			best = t
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+// nextLeastConnections picks the target with the fewest active requests
+// relative to its weight, ties are broken round robin.
+func (lb *LoadBalancer) nextLeastConnections() *upstreamTarget {
+	n := uint64(len(lb.targets))
+	start := atomic.AddUint64(&lb.counter, 1) - 1
+
+	var best *upstreamTarget
+	for i := uint64(0); i < n; i++ {
+		t := lb.targets[(start+i)%n]
+		if isHostDown(lb.apiID, t.url) {
+			continue
+		}
+		// compare active/weight without dividing
+		if best == nil || t.activeConnections()*int64(best.weight) < best.activeConnections()*int64(t.weight) {
+			best = t
+		}
+	}
+	return best
+}
+
+func (lb *LoadBalancer) hashKey(r *http.Request) string {
+	if lb.hashOn == apidef.HashOnHeader {
+		if v := r.Header.Get(lb.hashHeader); v != "" {
+			return v
+		}
+	}
+	return request.RealIP(r)
+}
+
+// nextHashed walks the ring clockwise from the hash of the request key
+// until it finds a healthy target, so a key keeps its target for as long
+// as it is up.
+func (lb *LoadBalancer) nextHashed(r *http.Request) *upstreamTarget {
+	h := crc32.ChecksumIEEE([]byte(lb.hashKey(r)))
+	start := sort.Search(len(lb.ring), func(i int) bool {
+		return lb.ring[i].hash >= h
+	})
+
+	tried := make(map[*upstreamTarget]bool, len(lb.targets))
+	for i := 0; i < len(lb.ring) && len(tried) < len(lb.targets); i++ {
+		t := lb.ring[(start+i)%len(lb.ring)].target
+		if tried[t] {
+			continue
+		}
+		if !isHostDown(lb.apiID, t.url) {
+			return t
+		}
+		tried[t] = true
+	}
+	return nil
+}
+
+// hostsDown holds the targets currently marked unhealthy, keyed by
+// hostKey. APIs sharing a target can check it differently, so each has its
+// own view of it.
+var hostsDown sync.Map
+
+// hostKey returns the key of target of the API apiID.
+func hostKey(apiID string, target *url.URL) string {
+	return apiID + " " + target.String()
+}
+
+// isHostDown reports whether target of the API apiID has been marked
+// unhealthy.
+func isHostDown(apiID string, target *url.URL) bool {
+	_, down := hostsDown.Load(hostKey(apiID, target))
+	return down
+}
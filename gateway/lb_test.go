@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+)
+
+func testLoadBalancer(t *testing.T, algorithm string, targets ...apidef.UpstreamTarget) *LoadBalancer {
+	lb, err := NewLoadBalancer("test", apidef.ProxyConfig{
+		Targets:       targets,
+		LoadBalancing: algorithm,
+		HashOn:        apidef.HashOnHeader,
+		HashHeader:    "X-User",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func countPicks(t *testing.T, lb *LoadBalancer, n int, r *http.Request) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		target, err := lb.Next(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[target.url.Host]++
+	}
+	return counts
+}
+
+func targetWeight(w int) *int {
+	return &w
+}
+
+var lbTargets = []apidef.UpstreamTarget{
+	{URL: "http://a.local", Weight: targetWeight(3)},
+	{URL: "http://b.local", Weight: targetWeight(1)},
+}
+
+func TestLoadBalancerRoundRobin(t *testing.T) {
+	lb := testLoadBalancer(t, apidef.RoundRobin, lbTargets...)
+	counts := countPicks(t, lb, 10, httptest.NewRequest(http.MethodGet, "/", nil))
+	if counts["a.local"] != 5 || counts["b.local"] != 5 {
+		t.Errorf("expected an even split, got %v", counts)
+	}
+}
+
+func TestLoadBalancerWeightedRoundRobin(t *testing.T) {
+	lb := testLoadBalancer(t, apidef.WeightedRoundRobin, lbTargets...)
+	counts := countPicks(t, lb, 8, httptest.NewRequest(http.MethodGet, "/", nil))
+	if counts["a.local"] != 6 || counts["b.local"] != 2 {
+		t.Errorf("expected a 3:1 split, got %v", counts)
+	}
+}
+
+func TestLoadBalancerLeastConnections(t *testing.T) {
+	lb := testLoadBalancer(t, apidef.LeastConnections,
+		apidef.UpstreamTarget{URL: "http://a.local"},
+		apidef.UpstreamTarget{URL: "http://b.local"},
+	)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	busy, _ := lb.Next(r)
+	busy.acquire()
+	defer busy.release()
+	for i := 0; i < 4; i++ {
+		if next, _ := lb.Next(r); next == busy {
+			t.Fatalf("expected the idle target to be picked, got %s", next.url)
+		}
+	}
+}
+
+func TestLoadBalancerConsistentHash(t *testing.T) {
+	lb := testLoadBalancer(t, apidef.ConsistentHash, lbTargets...)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User", "alice")
+	counts := countPicks(t, lb, 10, r)
+	if len(counts) != 1 {
+		t.Fatalf("expected the same key to stick to one target, got %v", counts)
+	}
+
+	// Without the header the client IP is used.
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if counts := countPicks(t, lb, 10, r); len(counts) != 1 {
+		t.Fatalf("expected the same IP to stick to one target, got %v", counts)
+	}
+}
+
+func TestLoadBalancerDrainedTarget(t *testing.T) {
+	for _, algorithm := range []string{apidef.RoundRobin, apidef.WeightedRoundRobin, apidef.LeastConnections, apidef.ConsistentHash} {
+		lb := testLoadBalancer(t, algorithm,
+			apidef.UpstreamTarget{URL: "http://a.local", Weight: targetWeight(0)},
+			apidef.UpstreamTarget{URL: "http://b.local"},
+		)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", "carol")
+		if counts := countPicks(t, lb, 5, r); counts["b.local"] != 5 {
+			t.Errorf("%s: expected the drained target to get no requests, got %v", algorithm, counts)
+		}
+	}
+}
+
+func TestLoadBalancerSkipsDownHosts(t *testing.T) {
+	for _, algorithm := range []string{apidef.RoundRobin, apidef.WeightedRoundRobin, apidef.LeastConnections, apidef.ConsistentHash} {
+		lb := testLoadBalancer(t, algorithm, lbTargets...)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", "bob")
+
+		hostsDown.Store("test http://a.local", true)
+		counts := countPicks(t, lb, 5, r)
+		if counts["b.local"] != 5 {
+			t.Errorf("%s: expected only b.local to be picked, got %v", algorithm, counts)
+		}
+
+		hostsDown.Store("test http://b.local", true)
+		if _, err := lb.Next(r); err != errNoHealthyTargets {
+			t.Errorf("%s: expected %v, got %v", algorithm, errNoHealthyTargets, err)
+		}
+		hostsDown.Delete("test http://a.local")
+		hostsDown.Delete("test http://b.local")
+	}
+}
+
+func TestNewLoadBalancerInvalid(t *testing.T) {
+	configs := []apidef.ProxyConfig{
+		{TargetURL: "http://a.local", LoadBalancing: "random"},
+		{Targets: []apidef.UpstreamTarget{{URL: "http://a.local", Weight: targetWeight(-1)}}},
+		{Targets: []apidef.UpstreamTarget{{URL: "http://a.local", Weight: targetWeight(0)}}},
+		{Targets: []apidef.UpstreamTarget{{URL: "a.local"}}},
+		{TargetURL: "http://a.local", LoadBalancing: apidef.ConsistentHash, HashOn: apidef.HashOnHeader},
+	}
+	for _, conf := range configs {
+		if _, err := NewLoadBalancer("test", conf); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mwStatusRespond is returned by a middleware that has already written the
+// response, the chain is stopped without writing an error.
+const mwStatusRespond = 666
+
+// RaspberryMiddleware is implemented by every middleware in an API chain.
+type RaspberryMiddleware interface {
+	Name() string
+	EnabledForSpec() bool
+	ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) // Handles request
+}
+
+// BaseMiddleware wraps up the APISpec, it is embedded by all middleware.
+type BaseMiddleware struct {
+	Spec *APISpec
+}
+
+// Logger returns a logger with the middleware's API attached.
+func (m BaseMiddleware) Logger() *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"prefix":   "gateway",
+		"api_id":   m.Spec.APIID,
+		"api_name": m.Spec.Name,
+	})
+}
+
+// EnabledForSpec is the default for middleware that are always on.
+func (m BaseMiddleware) EnabledForSpec() bool {
+	return true
+}
+
+// createMiddleware wraps mw so it runs before next.
+func createMiddleware(mw RaspberryMiddleware) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err, errCode := mw.ProcessRequest(w, r)
+			if err != nil {
+				handleError(w, r, err.Error(), errCode)
+				return
+			}
+			if errCode == mwStatusRespond {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// mwAppendEnabled adds mw to chain if it is enabled for its API.
+func mwAppendEnabled(chain *[]RaspberryMiddleware, mw RaspberryMiddleware) {
+	if mw.EnabledForSpec() {
+		*chain = append(*chain, mw)
+	}
+}
+
+// buildChain returns a handler that runs chain in order before final.
+func buildChain(chain []RaspberryMiddleware, final http.Handler) http.Handler {
+	handler := final
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = createMiddleware(chain[i])(handler)
+	}
+	return handler
+}
@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+// AuthKey is an authentication middleware that checks the API key passed
+// in the header named by the API's auth_header_name.
+type AuthKey struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (k *AuthKey) Name() string {
+	return "AuthKey"
+}
+
+// EnabledForSpec is false for keyless APIs.
+func (k *AuthKey) EnabledForSpec() bool {
+	return !k.Spec.UseKeylessAccess
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *AuthKey) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	var grpcMethod string
+	if k.Spec.isGRPC() {
+		grpcMethod = k.Spec.grpcMethodName(r)
+		if m := k.Spec.grpcMethodFor(grpcMethod); m != nil && m.UseKeylessAccess {
+			return nil, http.StatusOK
+		}
+	}
+
+	key := r.Header.Get(k.Spec.authHeaderName)
+	if key == "" {
+		k.Logger().Info("Attempted access with malformed header, no auth header found.")
+		return errors.New("Authorization field missing"), http.StatusUnauthorized
+	}
+
+	session, keyExists := GlobalSessionManager.SessionDetail(key, false)
+	if !keyExists {
+		k.Logger().Info("Attempted access with non-existent key.")
+		return errors.New("Key not authorised"), http.StatusForbidden
+	}
+	if session.IsInactive {
+		k.Logger().Info("Attempted access from inactive key.")
+		return errors.New("Key is inactive, please renew"), http.StatusForbidden
+	}
+	if session.IsExpired() {
+		k.Logger().Info("Attempted access from expired key.")
+		return errors.New("Key has expired, please renew"), http.StatusUnauthorized
+	}
+	if !k.hasAccess(&session, ctxGetVersionName(r)) {
+		k.Logger().Info("Attempted access to unauthorised API / version.")
+		return errors.New("Access to this API has been disallowed"), http.StatusForbidden
+	}
+	if grpcMethod != "" && !grpcMethodAllowed(session.AccessRights[k.Spec.APIID].GRPCMethods, grpcMethod) {
+		k.Logger().WithField("method", grpcMethod).Info("Attempted call to unauthorised gRPC method.")
+		return errors.New("Access to this method has been disallowed"), http.StatusForbidden
+	}
+
+	// counters and analytics go by the hash, so the key isn't stored
+	ctxSetSession(r, &session, GlobalSessionManager.KeyHash(key))
+	return nil, http.StatusOK
+}
+
+// hasAccess checks the access rights of the session against the API and
+// version being requested. Sessions without access rights may access any
+// API.
+func (k *AuthKey) hasAccess(session *user.SessionState, version string) bool {
+	if len(session.AccessRights) == 0 {
+		return true
+	}
+	access, ok := session.AccessRights[k.Spec.APIID]
+	if !ok {
+		return false
+	}
+	if len(access.Versions) == 0 || k.Spec.VersionData.NotVersioned {
+		return true
+	}
+	for _, v := range access.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ClientCertificateCheck rejects requests to APIs using mutual TLS unless
+// the client presented an authorised certificate, which is then stored in
+// the request context.
+type ClientCertificateCheck struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (c *ClientCertificateCheck) Name() string {
+	return "ClientCertificateCheck"
+}
+
+// EnabledForSpec is true for APIs using mutual TLS.
+func (c *ClientCertificateCheck) EnabledForSpec() bool {
+	return c.Spec.UseMutualTLSAuth
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (c *ClientCertificateCheck) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		c.Logger().Info("Attempted access without a client certificate.")
+		return errors.New("Client TLS certificate is required"), http.StatusUnauthorized
+	}
+
+	cert := newClientCertInfo(r.TLS.PeerCertificates[0])
+	if !c.Spec.authoriseClientCertificate(r.TLS.PeerCertificates) {
+		c.Logger().WithField("fingerprint", cert.Fingerprint).Info("Attempted access with an unauthorised client certificate.")
+		return errors.New("Client TLS certificate is not allowed"), http.StatusForbidden
+	}
+
+	ctxSetClientCert(r, cert)
+	return nil, http.StatusOK
+}
+
+// clientCertInfo describes the certificate a client authenticated with.
+type clientCertInfo struct {
+	Subject     string
+	Fingerprint string
+}
+
+func newClientCertInfo(cert *x509.Certificate) *clientCertInfo {
+	return &clientCertInfo{
+		Subject:     cert.Subject.String(),
+		Fingerprint: certFingerprint(cert),
+	}
+}
+
+// certFingerprint returns the hex SHA-256 of the certificate.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normaliseFingerprint accepts fingerprints in upper or lower case, with
+// or without colons between the bytes.
+func normaliseFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+}
+
+// initClientCertificates loads the CA bundle and fingerprints that
+// authorise client certificates.
+func (a *APISpec) initClientCertificates() error {
+	if a.ClientCAFile == "" && len(a.ClientCertificates) == 0 {
+		return errors.New("use_mutual_tls_auth needs a client_ca_file or client_certificates")
+	}
+	if a.ClientCAFile != "" {
+		certs, err := loadCertificates(a.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("client CA file: %v", err)
+		}
+		a.clientCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			a.clientCAs.AddCert(cert)
+		}
+		a.clientCACerts = certs
+	}
+
+	a.clientFingerprints = make(map[string]bool, len(a.ClientCertificates))
+	for _, fp := range a.ClientCertificates {
+		fp = normaliseFingerprint(fp)
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid client certificate fingerprint %q, want a hex SHA-256", fp)
+		}
+		a.clientFingerprints[fp] = true
+	}
+	return nil
+}
+
+// authoriseClientCertificate reports whether the chain presented by a
+// client is allowed: its certificate has an allowed fingerprint, or it is
+// issued by one of the API's client CAs.
+func (a *APISpec) authoriseClientCertificate(chain []*x509.Certificate) bool {
+	leaf := chain[0]
+	if a.clientFingerprints[certFingerprint(leaf)] {
+		return true
+	}
+	if a.clientCAs == nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// loadCertificates reads the PEM encoded certificates in path.
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return certs, nil
+}
@@ -0,0 +1,236 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+)
+
+// testCertificate returns a client certificate for name, issued by parent
+// or self-signed when parent is nil.
+func testCertificate(t *testing.T, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	issuer, signer := tmpl, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeCAFile(t *testing.T, dir string, ca *tls.Certificate) string {
+	path := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveMutualTLS serves spec over TLS, asking for client certificates as
+// its configuration requires.
+func serveMutualTLS(t *testing.T, dir string, spec *APISpec) (addr string, stop func()) {
+	certFile, keyFile := writeTestCert(t, dir, "127.0.0.1")
+	restore := setServerOptions(config.HttpServerOptionsConfig{
+		UseSSL:       true,
+		Certificates: []config.CertData{{Name: "local", CertFile: certFile, KeyFile: keyFile}},
+	})
+	serverCerts.updateClientAuth([]*APISpec{spec})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(processSpec(spec))
+	srv.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	if ln, err = configureProtocols(srv, ln); err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() {
+		srv.Close()
+		serverCerts.updateClientAuth(nil)
+		restore()
+	}
+}
+
+// mutualTLSGet requests addr presenting cert, if any, with a forged client
+// subject header, returning the status and the body.
+func mutualTLSGet(addr string, cert *tls.Certificate) (int, string, error) {
+	conf := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		// sent even when the server asks for another CA
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	req, _ := http.NewRequest(http.MethodGet, "https://"+addr, nil)
+	req.Header.Set(headers.XSSLClientSubject, "CN=forged")
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body), nil
+}
+
+func clientCertUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(headers.XSSLClientSubject) + " " + r.Header.Get(headers.XSSLClientFingerprint)))
+	}))
+}
+
+func TestMutualTLSClientCA(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer enableAnalytics()()
+	upstream := clientCertUpstream()
+	defer upstream.Close()
+
+	ca := testCertificate(t, "Test CA", nil)
+	client := testCertificate(t, "client", ca)
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseMutualTLSAuth = true
+		def.ClientCAFile = writeCAFile(t, dir, ca)
+	})
+	addr, stop := serveMutualTLS(t, dir, spec)
+	defer stop()
+
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+	code, body, err := mutualTLSGet(addr, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CN=client " + certFingerprint(client.Leaf)
+	if code != http.StatusOK || body != want {
+		t.Errorf("want the client's certificate sent upstream as %q, got %d %q", want, code, body)
+	}
+	record := waitForAnalyticsRecord(t)
+	if record.ClientCertSubject != "CN=client" || record.ClientCertFingerprint != certFingerprint(client.Leaf) {
+		t.Errorf("want the client's certificate recorded, got %q %q", record.ClientCertSubject, record.ClientCertFingerprint)
+	}
+
+	if code, _, err := mutualTLSGet(addr, nil); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("want %d without a certificate, got %d %v", http.StatusUnauthorized, code, err)
+	}
+	// certificates from other CAs fail the handshake
+	other := testCertificate(t, "client", testCertificate(t, "Other CA", nil))
+	if _, _, err := mutualTLSGet(addr, other); err == nil {
+		t.Error("want an error for a certificate from another CA")
+	}
+}
+
+func TestMutualTLSFingerprints(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	upstream := clientCertUpstream()
+	defer upstream.Close()
+
+	allowed := testCertificate(t, "allowed", nil)
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseMutualTLSAuth = true
+		def.ClientCertificates = []string{certFingerprint(allowed.Leaf)}
+	})
+	addr, stop := serveMutualTLS(t, dir, spec)
+	defer stop()
+
+	if code, body, err := mutualTLSGet(addr, allowed); err != nil || code != http.StatusOK || body != "CN=allowed "+certFingerprint(allowed.Leaf) {
+		t.Errorf("want an allowed certificate let through, got %d %q %v", code, body, err)
+	}
+	if code, _, err := mutualTLSGet(addr, testCertificate(t, "other", nil)); err != nil || code != http.StatusForbidden {
+		t.Errorf("want %d for another certificate, got %d %v", http.StatusForbidden, code, err)
+	}
+	if code, _, err := mutualTLSGet(addr, nil); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("want %d without a certificate, got %d %v", http.StatusUnauthorized, code, err)
+	}
+}
+
+func TestMutualTLSValidation(t *testing.T) {
+	for _, fn := range []func(*apidef.APIDefinition){
+		func(def *apidef.APIDefinition) {},
+		func(def *apidef.APIDefinition) { def.ClientCAFile = "/missing/ca.pem" },
+		func(def *apidef.APIDefinition) { def.ClientCertificates = []string{"not-hex"} },
+		func(def *apidef.APIDefinition) { def.ClientCertificates = []string{"ab:cd"} },
+	} {
+		def := &apidef.APIDefinition{
+			APIID:            "test",
+			UseMutualTLSAuth: true,
+			Proxy:            apidef.ProxyConfig{ListenPath: "/", TargetURL: "http://example.com"},
+		}
+		fn(def)
+		if _, err := (APIDefinitionLoader{}).MakeSpec(def); err == nil {
+			t.Errorf("want an error for %+v", def)
+		}
+	}
+}
+
+func TestNormaliseFingerprint(t *testing.T) {
+	if got := normaliseFingerprint(" AB:cd:EF "); got != "abcdef" {
+		t.Errorf("want abcdef, got %s", got)
+	}
+}
+
+func TestRouterDomains(t *testing.T) {
+	reply := func(s string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(s)) })
+	}
+	rt := &router{}
+	rt.handle("/", reply("any"))
+	rt.handleDomain("api.example.com", "/", reply("api"))
+	rt.handle("/long", reply("long"))
+
+	for _, test := range []struct{ host, path, want string }{
+		{"api.example.com", "/", "api"},
+		{"API.example.com.:8080", "/", "api"},
+		{"other.example.com", "/", "any"},
+		{"api.example.com", "/long", "long"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+		if rec.Body.String() != test.want {
+			t.Errorf("%s%s: want %s, got %s", test.host, test.path, test.want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+)
+
+// CircuitBreaker rejects requests to paths whose circuit breaker is open.
+// The outcome of the requests it lets through is recorded by the proxy.
+type CircuitBreaker struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (m *CircuitBreaker) Name() string {
+	return "CircuitBreaker"
+}
+
+// EnabledForSpec is true when the API defines circuit breakers.
+func (m *CircuitBreaker) EnabledForSpec() bool {
+	return len(m.Spec.circuitBreakers) > 0
+}
+
+// ProcessRequest replies with 503 while the breaker covering the request is
+// open.
+func (m *CircuitBreaker) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	cb := m.Spec.breakerFor(r)
+	if cb == nil {
+		return nil, http.StatusOK
+	}
+	if !cb.allow() {
+		m.Logger().WithField("path", r.URL.Path).Debug("Circuit breaker open, rejecting request")
+		return errors.New("Service temporarily unavailable"), http.StatusServiceUnavailable
+	}
+	ctxSetCircuitBreaker(r, cb)
+	return nil, http.StatusOK
+}
@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+)
+
+// GRPCMethodCheck only lets gRPC calls to the configured methods of a gRPC
+// API through, routing them to the method's upstream if it has one.
+type GRPCMethodCheck struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (g *GRPCMethodCheck) Name() string {
+	return "GRPCMethodCheck"
+}
+
+// EnabledForSpec is true for gRPC APIs.
+func (g *GRPCMethodCheck) EnabledForSpec() bool {
+	return g.Spec.isGRPC()
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (g *GRPCMethodCheck) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	if r.ProtoMajor != 2 {
+		return errors.New("gRPC requires HTTP/2"), http.StatusHTTPVersionNotSupported
+	}
+	if r.Method != http.MethodPost || !isGRPCRequest(r) {
+		return errors.New("Not a gRPC request"), http.StatusUnsupportedMediaType
+	}
+	if len(g.Spec.grpcMethods) == 0 {
+		return nil, http.StatusOK
+	}
+
+	name := g.Spec.grpcMethodName(r)
+	method := g.Spec.grpcMethodFor(name)
+	if method == nil {
+		g.Logger().WithField("method", name).Info("Attempted call to unknown gRPC method.")
+		return errors.New("Unknown gRPC method " + name), http.StatusNotFound
+	}
+	if method.target != nil {
+		ctxSetTargetOverride(r, method.target)
+	}
+	return nil, http.StatusOK
+}
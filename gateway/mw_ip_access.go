@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// globalDeniedIPs holds the *ipTrie of the denied_ips in the gateway
+// configuration, which apply to every API.
+var globalDeniedIPs atomic.Value
+
+func getGlobalDeniedIPs() *ipTrie {
+	t, _ := globalDeniedIPs.Load().(*ipTrie)
+	return t
+}
+
+// IPAccessCheck rejects requests from the denied IPs of the gateway and the
+// API, and from IPs that aren't in the allowed ones of the API when it has
+// any. The client IP is the one request.RealIP works out.
+type IPAccessCheck struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (i *IPAccessCheck) Name() string {
+	return "IPAccessCheck"
+}
+
+// EnabledForSpec is true when the gateway or the API has IP lists.
+func (i *IPAccessCheck) EnabledForSpec() bool {
+	return i.Spec.allowedIPs != nil || i.Spec.deniedIPs != nil || getGlobalDeniedIPs() != nil
+}
+
+// ProcessRequest rejects requests from disallowed IPs with a 403, firing
+// IPRejected and recording them in analytics.
+func (i *IPAccessCheck) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	origin := request.RealIP(r)
+	ip := net.ParseIP(origin)
+
+	var reason string
+	switch {
+	case getGlobalDeniedIPs().contains(ip):
+		reason = "IP address is in the gateway's denied_ips"
+	case i.Spec.deniedIPs.contains(ip):
+		reason = "IP address is in the API's denied_ips"
+	case i.Spec.allowedIPs != nil && !i.Spec.allowedIPs.contains(ip):
+		reason = "IP address is not in the API's allowed_ips"
+	default:
+		return nil, http.StatusOK
+	}
+
+	i.Logger().WithField("origin", origin).Info("Request rejected: ", reason)
+	i.Spec.FireEvent(EventIPRejected, EventIPRejectedMeta{
+		EventMetaDefault: EventMetaDefault{Message: reason, APIID: i.Spec.APIID},
+		Origin:           origin,
+		Path:             r.URL.Path,
+	})
+	recordAnalytics(newAnalyticsRecord(i.Spec, r, http.StatusForbidden, time.Now()))
+	return errors.New("Access from this IP address has been disallowed"), http.StatusForbidden
+}
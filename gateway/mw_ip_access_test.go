@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// denyIPs sets the gateway's denied_ips, returning a func clearing them.
+func denyIPs(t *testing.T, list ...string) func() {
+	trie, err := newIPTrie(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalDeniedIPs.Store(trie)
+	return func() { globalDeniedIPs.Store((*ipTrie)(nil)) }
+}
+
+func TestIPAccessCheck(t *testing.T) {
+	upstream := testUpstream()
+	defer upstream.Close()
+
+	handler := processSpec(buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.AllowedIPs = []string{"192.0.2.0/24", "2001:db8::/32"}
+		def.DeniedIPs = []string{"192.0.2.66"}
+	}))
+	defer denyIPs(t, "192.0.2.99", "2001:db8:bad::/48")()
+
+	for _, test := range []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"203.0.113.1:1234", http.StatusForbidden}, // not allowed
+		{"192.0.2.66:1234", http.StatusForbidden},  // denied by the API
+		{"192.0.2.99:1234", http.StatusForbidden},  // denied by the gateway
+		{"[2001:db8:bad::1]:1234", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: want %d, got %d", test.remoteAddr, test.want, rec.Code)
+		}
+	}
+}
+
+func TestIPAccessCheckTrustedProxies(t *testing.T) {
+	if err := request.SetTrustedProxies([]string{"10.0.0.0/8"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer request.SetTrustedProxies(nil, nil)
+	defer denyIPs(t, "203.0.113.0/24")()
+
+	upstream := testUpstream()
+	defer upstream.Close()
+	handler := processSpec(buildSpec(t, upstream.URL))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("want the client behind the proxy denied, got %d", rec.Code)
+	}
+}
+
+func TestIPAccessCheckRejection(t *testing.T) {
+	defer enableAnalytics()()
+	hooks, events := webhookReceiver(t)
+	defer hooks.Close()
+
+	spec := buildSpec(t, "http://127.0.0.1:1", func(def *apidef.APIDefinition) {
+		def.DeniedIPs = []string{"192.0.2.1"}
+		def.EventHandlers.Events = map[apidef.RaspberryEvent][]apidef.EventHandlerTriggerConfig{
+			EventIPRejected: {{
+				Handler:     apidef.WebHookHandler,
+				HandlerMeta: map[string]interface{}{"method": "POST", "target_path": hooks.URL},
+			}},
+		}
+	})
+	req := httptest.NewRequest(http.MethodGet, "/widgets", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	processSpec(spec).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("want %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	meta := waitForEvent(t, events, EventIPRejected).Meta.(map[string]interface{})
+	if meta["api_id"] != spec.APIID || meta["origin"] != "192.0.2.1" || meta["path"] != "/widgets" {
+		t.Errorf("unexpected event meta: %v", meta)
+	}
+	record := waitForAnalyticsRecord(t)
+	if record.ResponseCode != http.StatusForbidden || record.IPAddress != "192.0.2.1" || record.APIID != spec.APIID {
+		t.Errorf("unexpected analytics record: %+v", record)
+	}
+}
+
+func TestMakeSpecInvalidIPs(t *testing.T) {
+	for _, fn := range []func(*apidef.APIDefinition){
+		func(def *apidef.APIDefinition) { def.AllowedIPs = []string{"bogus"} },
+		func(def *apidef.APIDefinition) { def.DeniedIPs = []string{"10.0.0.0/99"} },
+	} {
+		def := &apidef.APIDefinition{APIID: "test", Proxy: apidef.ProxyConfig{TargetURL: "http://example.com"}}
+		fn(def)
+		if _, err := (APIDefinitionLoader{}).MakeSpec(def); err == nil {
+			t.Errorf("want an error for %v %v", def.AllowedIPs, def.DeniedIPs)
+		}
+	}
+}
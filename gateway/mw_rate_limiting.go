@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimitAndQuotaCheck will check the incoming request and key whether it is within it's quota and
+// within it's rate limit, it makes use of the SessionLimiter object to do this
+type RateLimitAndQuotaCheck struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (k *RateLimitAndQuotaCheck) Name() string {
+	return "RateLimitAndQuotaCheck"
+}
+
+// EnabledForSpec is false for keyless APIs, as there is no session to
+// limit.
+func (k *RateLimitAndQuotaCheck) EnabledForSpec() bool {
+	return !k.Spec.UseKeylessAccess
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	session := ctxGetSession(r)
+	if session == nil {
+		// a keyless gRPC method
+		return nil, http.StatusOK
+	}
+	token := ctxGetAuthToken(r)
+
+	reason := sessionLimiter.ForwardMessage(session, token)
+
+	if session.QuotaMax > 0 {
+		w.Header().Set(headers.XRateLimitLimit, strconv.FormatInt(session.QuotaMax, 10))
+		w.Header().Set(headers.XRateLimitRemaining, strconv.FormatInt(sessionLimiter.QuotaRemaining(session, token), 10))
+	}
+
+	switch reason {
+	case sessionFailRateLimit:
+		k.Logger().WithField("key", obfuscateKey(token)).Info("Key rate limit exceeded.")
+		return errors.New("Rate limit exceeded"), http.StatusTooManyRequests
+	case sessionFailQuota:
+		k.Logger().WithField("key", obfuscateKey(token)).Info("Key quota limit exceeded.")
+		return errors.New("Quota exceeded"), http.StatusForbidden
+	}
+
+	if k.Spec.isGRPC() {
+		name := k.Spec.grpcMethodName(r)
+		if m := k.Spec.grpcMethodFor(name); m != nil && sessionLimiter.MethodRateExceeded(token, m.Method, m.Rate, m.Per) {
+			k.Logger().WithFields(logrus.Fields{
+				"key":    obfuscateKey(token),
+				"method": name,
+			}).Info("Key rate limit exceeded for gRPC method.")
+			return errors.New("Rate limit exceeded"), http.StatusTooManyRequests
+		}
+	}
+	return nil, http.StatusOK
+}
+
+// obfuscateKey hides most of an API key so it can be logged.
+func obfuscateKey(keyName string) string {
+	if len(keyName) > 4 {
+		return "****" + keyName[len(keyName)-4:]
+	}
+	return "--"
+}
@@ -0,0 +1,31 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+)
+
+// VersionCheck will check whether the version of the requested API the request is accessing has any restrictions on URL endpoints
+type VersionCheck struct {
+	BaseMiddleware
+}
+
+// Name returns the name of the middleware.
+func (v *VersionCheck) Name() string {
+	return "VersionCheck"
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (v *VersionCheck) ProcessRequest(w http.ResponseWriter, r *http.Request) (error, int) {
+	versionInfo, status := v.Spec.Version(r)
+	if status != StatusOk {
+		v.Logger().WithField("path", r.URL.Path).Info("Attempted access to unknown or expired version: ", status)
+		return errors.New(string(status)), http.StatusForbidden
+	}
+
+	ctxSetVersionName(r, versionInfo.Name)
+	if target, ok := v.Spec.versionTargets[versionInfo.Name]; ok {
+		ctxSetTargetOverride(r, target)
+	}
+	return nil, http.StatusOK
+}
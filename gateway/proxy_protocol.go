@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// defaultProxyHeaderTimeout is how long trusted peers have to send their
+// PROXY protocol header.
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the longest v1 header, CRLF included.
+const proxyV1MaxLength = 107
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyProtoListener accepts PROXY protocol v1 and v2 headers from trusted
+// peers, such as an L4 load balancer, and reports the client address they
+// carry as the connection's remote address. Connections from other peers
+// are left as they are, so a header they send fails the request.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// newProxyProtoListener wraps ln as configured in conf.
+func newProxyProtoListener(ln net.Listener, conf config.ProxyProtocolConfig) (net.Listener, error) {
+	trusted, err := request.ParseCIDRs(conf.TrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol trusted_cidrs: %v", err)
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("proxy_protocol needs trusted_cidrs")
+	}
+	timeout := defaultProxyHeaderTimeout
+	if conf.HeaderTimeout > 0 {
+		timeout = time.Duration(conf.HeaderTimeout) * time.Second
+	}
+	return &proxyProtoListener{Listener: ln, trusted: trusted, timeout: timeout}, nil
+}
+
+// Accept implements net.Listener. The header is only read once the
+// connection is used, so that slow peers don't hold up the others.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !request.ContainsIP(l.trusted, tcpAddr.IP) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// proxyConn is a connection from a trusted peer, which may start with a
+// PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once    sync.Once
+	err     error
+	proxied net.Addr
+}
+
+// init reads the header, if the peer sent one.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.proxied, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the peer's
+// when there was none.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.proxied != nil {
+		return c.proxied
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxiedClientAddr returns the client address r came from according to
+// a PROXY protocol header. TLS connections can only be unwrapped to find
+// the header from Go 1.18 on.
+func proxiedClientAddr(r *http.Request) (string, bool) {
+	conn, _ := r.Context().Value(ctxConn).(net.Conn)
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = nc.NetConn()
+	}
+	pc, ok := conn.(*proxyConn)
+	if !ok {
+		return "", false
+	}
+	pc.init()
+	if pc.proxied == nil {
+		return "", false
+	}
+	return pc.proxied.(*net.TCPAddr).IP.String(), true
+}
+
+// readProxyHeader reads a v1 or v2 header from br, returning the source
+// address it carries. It returns nil when there is no header, or when the
+// header is for a connection of the peer itself, such as a health check.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		// nothing was sent, let the server deal with it
+		return nil, nil
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if b, err := br.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(b, proxyV1Prefix) {
+			return readProxyV1(br)
+		}
+	case proxyV2Signature[0]:
+		if b, err := br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+			return readProxyV2(br)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header, skipping any TLVs it has.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// UNSPEC, UDP and unix sockets carry no TCP client address
+	return nil, nil
+}
@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+// proxyV2Header returns a v2 PROXY header from src to dst with the given
+// command and extra TLV bytes.
+func proxyV2Header(cmd byte, src, dst *net.TCPAddr, tlvs []byte) []byte {
+	family := byte(0x11)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family, srcIP, dstIP = 0x21, src.IP.To16(), dst.IP.To16()
+	}
+	body := append(append([]byte{}, srcIP...), dstIP...)
+	body = append(body, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(dst.Port))
+	body = append(body, tlvs...)
+
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 56324}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	for _, test := range []struct {
+		name   string
+		header string
+		want   string
+		err    bool
+	}{
+		{name: "no header", header: "GET / HTTP/1.1\r\n"},
+		{name: "POST", header: "POST / HTTP/1.1\r\n"},
+		{name: "v1 TCP4", header: "PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n", want: "203.0.113.7:56324"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n", want: "[2001:db8::7]:56324"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 family mismatch", header: "PROXY TCP4 2001:db8::7 2001:db8::1 56324 443\r\n", err: true},
+		{name: "v1 bad port", header: "PROXY TCP4 203.0.113.7 198.51.100.1 70000 443\r\n", err: true},
+		{name: "v1 no CRLF", header: "PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\n", err: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: true},
+		{name: "v2 TCP4", header: string(proxyV2Header(1, v4, dst4, nil)), want: "203.0.113.7:56324"},
+		{name: "v2 TCP6", header: string(proxyV2Header(1, v6, dst6, nil)), want: "[2001:db8::7]:56324"},
+		{name: "v2 TLVs", header: string(proxyV2Header(1, v4, dst4, []byte{0x04, 0, 1, 'x'})), want: "203.0.113.7:56324"},
+		{name: "v2 LOCAL", header: string(proxyV2Header(0, v4, dst4, nil))},
+		{name: "v2 bad command", header: string(proxyV2Header(2, v4, dst4, nil)), err: true},
+	} {
+		br := bufio.NewReader(strings.NewReader(test.header + "rest"))
+		addr, err := readProxyHeader(br)
+		if (err != nil) != test.err {
+			t.Errorf("%s: want error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: want %q, got %q", test.name, test.want, got)
+		}
+		rest, _ := ioutil.ReadAll(br)
+		if test.want != "" && string(rest) != "rest" {
+			t.Errorf("%s: want the header consumed, %q left", test.name, rest)
+		}
+	}
+}
+
+// serveProxyProtocol serves the main handler with PROXY protocol headers
+// accepted from trusted, replying with the client IP and RemoteAddr.
+func serveProxyProtocol(t *testing.T, trusted ...string) (addr string, stop func()) {
+	oldRouter := mainRouter()
+	rt := &router{}
+	rt.handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(request.RealIP(r) + " " + r.RemoteAddr))
+	}))
+	setMainRouter(rt)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pln, err := newProxyProtoListener(ln, config.ProxyProtocolConfig{Enabled: true, TrustedCIDRs: trusted})
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	srv := newServer(mainHandler{})
+	srv.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	go srv.Serve(pln)
+	return ln.Addr().String(), func() {
+		srv.Close()
+		setMainRouter(oldRouter)
+	}
+}
+
+// rawGet sends header followed by a GET request to addr.
+func rawGet(t *testing.T, addr, header string) (int, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(header + "GET / HTTP/1.1\r\nHost: example.com\r\nX-Real-IP: 198.51.100.99\r\nConnection: close\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	addr, stop := serveProxyProtocol(t, "127.0.0.0/8")
+	defer stop()
+
+	code, body := rawGet(t, addr, "PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n")
+	if code != http.StatusOK || body != "203.0.113.7 203.0.113.7:56324" {
+		t.Errorf("want the proxied client, got %d %q", code, body)
+	}
+	code, body = rawGet(t, addr, string(proxyV2Header(1, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, nil)))
+	if code != http.StatusOK || body != "2001:db8::7 [2001:db8::7]:1234" {
+		t.Errorf("want the proxied v2 client, got %d %q", code, body)
+	}
+	// trusted peers may connect directly
+	if code, body = rawGet(t, addr, ""); code != http.StatusOK || !strings.HasPrefix(body, "127.0.0.1 127.0.0.1:") {
+		t.Errorf("want the peer without a header, got %d %q", code, body)
+	}
+	if code, _ = rawGet(t, addr, "PROXY TCP4 bogus\r\n"); code != http.StatusBadRequest {
+		t.Errorf("want a broken header rejected, got %d", code)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	addr, stop := serveProxyProtocol(t, "10.0.0.0/8")
+	defer stop()
+
+	if code, _ := rawGet(t, addr, "PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n"); code != http.StatusBadRequest {
+		t.Errorf("want a header from an untrusted peer rejected, got %d", code)
+	}
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeTestCert(t, dir, "127.0.0.1")
+	defer setServerOptions(config.HttpServerOptionsConfig{
+		UseSSL:       true,
+		Certificates: []config.CertData{{Name: "local", CertFile: certFile, KeyFile: keyFile}},
+	})()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pln, err := newProxyProtoListener(ln, config.ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	srv.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	tlsLn, err := configureProtocols(srv, pln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(tlsLn)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n"))
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "203.0.113.7:56324" {
+		t.Errorf("want the proxied client behind TLS, got %q", body)
+	}
+}
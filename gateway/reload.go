@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+var (
+	// mainRouterValue holds the *router currently serving requests. It is
+	// replaced as a whole on reload so in-flight requests keep the router
+	// they started with.
+	mainRouterValue atomic.Value
+
+	reloadMu sync.Mutex // serialises reloads
+)
+
+// mainHandler serves requests with whatever router is current.
+type mainHandler struct{}
+
+func (mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if addr, ok := proxiedClientAddr(r); ok {
+		setCtxValue(r, headers.RemoteAddr, addr)
+	}
+	mainRouter().ServeHTTP(w, r)
+}
+
+func mainRouter() *router {
+	return mainRouterValue.Load().(*router)
+}
+
+func setMainRouter(rt *router) {
+	mainRouterValue.Store(rt)
+}
+
+// reload re-reads the configuration and the API definitions and swaps in
+// a router built from them. If anything fails the current configuration
+// and router are kept and the error is returned.
+func reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	mainLog.Info("Reloading configuration and API definitions")
+	oldConf := config.Global()
+
+	newConf, err := loadGlobalConfig()
+	if err != nil {
+		mainLog.Error("Reload failed, couldn't load configuration: ", err)
+		return err
+	}
+	specs, err := loadAPISpecs(newConf)
+	if err != nil {
+		mainLog.Error("Reload failed, couldn't load API definitions: ", err)
+		return err
+	}
+
+	if newConf.ListenAddress != oldConf.ListenAddress || newConf.ListenPort != oldConf.ListenPort {
+		mainLog.Warning("Listen address changes only take effect after a restart")
+	}
+	oldOpts, newOpts := oldConf.HttpServerOptions, newConf.HttpServerOptions
+	if newOpts.UseSSL != oldOpts.UseSSL || newOpts.UseLe_SSL != oldOpts.UseLe_SSL || newOpts.ACME != oldOpts.ACME ||
+		newOpts.MinVersion != oldOpts.MinVersion || !reflect.DeepEqual(newOpts.Ciphers, oldOpts.Ciphers) {
+		mainLog.Warning("use_ssl, use_ssl_le, acme, min_version and cipher changes only take effect after a restart")
+	}
+	if !reflect.DeepEqual(newOpts.ProxyProtocol, oldOpts.ProxyProtocol) {
+		mainLog.Warning("proxy_protocol changes only take effect after a restart")
+	}
+	if !reflect.DeepEqual(newConf.Storage, oldConf.Storage) || newConf.SessionEncryption != oldConf.SessionEncryption {
+		mainLog.Warning("storage and session_encryption changes only take effect after a restart")
+	}
+
+	// everything is checked before anything is applied
+	reloadCerts := servesTLS(oldOpts) && servesTLS(newOpts)
+	var certs []*certFile
+	if reloadCerts {
+		if certs, err = loadCertFiles(newOpts); err != nil {
+			mainLog.Error("Reload failed, couldn't load certificates: ", err)
+			return err
+		}
+	}
+	if err := checkHashKeyFunctions(newConf); err != nil {
+		mainLog.Error("Reload failed: ", err)
+		return err
+	}
+	deniedIPs, err := newIPTrie(newConf.DeniedIPs)
+	if err != nil {
+		mainLog.Error("Reload failed, invalid denied_ips: ", err)
+		return err
+	}
+	proxies, err := request.ParseTrustedProxies(newConf.TrustedProxies, newConf.ClientIPHeaders)
+	if err != nil {
+		mainLog.Error("Reload failed, invalid trusted_proxies: ", err)
+		return err
+	}
+
+	if reloadCerts {
+		serverCerts.set(newOpts, certs)
+	}
+	globalDeniedIPs.Store(deniedIPs)
+	request.ApplyTrustedProxies(proxies)
+
+	config.SetGlobal(newConf)
+	loadTemplates(newConf.TemplatePath)
+	initDNSCaching()
+	old := mainRouter()
+	setMainRouter(loadApps(specs))
+	old.closeIdleConnections()
+
+	mainLog.Infof("Reload complete, %d API definitions loaded", len(specs))
+	return nil
+}
+
+// handleReloadSignals reloads the gateway whenever SIGHUP is received.
+func handleReloadSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			mainLog.Info("SIGHUP received, reloading")
+			reload()
+		}
+	}()
+}
+
+// reloadHandler triggers a reload from the control API, replying once it
+// has completed.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		doJSONWrite(w, http.StatusMethodNotAllowed, apiError("Method not supported"))
+		return
+	}
+	if err := reload(); err != nil {
+		doJSONWrite(w, http.StatusInternalServerError, apiError("Reload failed: "+err.Error()))
+		return
+	}
+	doJSONWrite(w, http.StatusOK, apiOk(""))
+}
@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/raspberry-gateway/raspberry/request"
+)
+
+func TestReload(t *testing.T) {
+	upstream := testUpstream()
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "raspberry-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "apps")
+	os.Mkdir(appDir, 0755)
+	confPath := filepath.Join(dir, "raspberry.conf")
+	writeFile := func(path, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldConfPaths, oldConf := confPaths, config.Global()
+	confPaths = []string{confPath}
+	defer func() {
+		confPaths = oldConfPaths
+		config.SetGlobal(oldConf)
+	}()
+
+	writeFile(confPath, `{"secret": "`+testSecret+`", "app_path": "`+appDir+`"}`)
+	writeFile(filepath.Join(appDir, "one.json"), `{"api_id": "1", "active": true, "use_keyless": true, "version_data": {"not_versioned": true},
+		"proxy": {"listen_path": "/one", "target_url": "`+upstream.URL+`"}}`)
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(mainHandler{}, http.MethodGet, "/one", nil, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected /one to be served, got %d", rec.Code)
+	}
+
+	// Broken definitions must keep the current router.
+	writeFile(filepath.Join(appDir, "two.json"), `{"api_id": `)
+	admin := map[string]string{headers.XRaspberryAuthorization: testSecret}
+	if rec := doRequest(mainHandler{}, http.MethodPost, "/raspberry/reload", admin, ""); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected failed reload to return %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if rec := doRequest(mainHandler{}, http.MethodGet, "/one", nil, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected old router to be kept, got %d", rec.Code)
+	}
+
+	os.Remove(filepath.Join(appDir, "one.json"))
+	writeFile(filepath.Join(appDir, "two.json"), `{"api_id": "2", "active": true, "use_keyless": true, "version_data": {"not_versioned": true},
+		"proxy": {"listen_path": "/two", "target_url": "`+upstream.URL+`"}}`)
+	if rec := doRequest(mainHandler{}, http.MethodPost, "/raspberry/reload", admin, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected reload to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(mainHandler{}, http.MethodGet, "/one", nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected /one to be removed, got %d", rec.Code)
+	}
+	if rec := doRequest(mainHandler{}, http.MethodGet, "/two", nil, ""); rec.Code != http.StatusOK {
+		t.Errorf("expected /two to be served, got %d", rec.Code)
+	}
+}
+
+func TestReloadFailureKeepsState(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	oldCert, oldKey := writeTestCert(t, dir, "old.example.com")
+	newCert, newKey := writeTestCert(t, dir, "new.example.com")
+
+	oldOpts := config.HttpServerOptionsConfig{
+		UseSSL:       true,
+		Certificates: []config.CertData{{CertFile: oldCert, KeyFile: oldKey}},
+	}
+	if err := serverCerts.load(oldOpts); err != nil {
+		t.Fatal(err)
+	}
+	defer setServerOptions(oldOpts)()
+	if err := request.SetTrustedProxies([]string{"10.0.0.0/8"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer request.SetTrustedProxies(nil, nil)
+
+	confPath := filepath.Join(dir, "raspberry.conf")
+	oldConfPaths := confPaths
+	confPaths = []string{confPath}
+	defer func() { confPaths = oldConfPaths }()
+	conf := `{"secret": "` + testSecret + `", "app_path": "` + dir + `",
+		"http_server_options": {"use_ssl": true, "certificates": [{"cert_file": "` + newCert + `", "key_file": "` + newKey + `"}]},
+		"trusted_proxies": ["192.168.0.0/16"], "denied_ips": ["not-an-ip"]}`
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reload(); err == nil {
+		t.Fatal("want the reload to fail on denied_ips")
+	}
+	if cert, _ := serverCerts.getCertificate(&tls.ClientHelloInfo{}); cert.Leaf.Subject.CommonName != "old.example.com" {
+		t.Errorf("want the current certificate kept, got %s", cert.Leaf.Subject.CommonName)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set(headers.XRealIP, "203.0.113.1")
+	if ip := request.RealIP(r); ip != "203.0.113.1" {
+		t.Errorf("want the current trusted proxies kept, got client %s", ip)
+	}
+}
@@ -0,0 +1,153 @@
+//go:build !windows
+// +build !windows
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/raspberry-gateway/raspberry/storage"
+)
+
+const (
+	// envInheritListeners lists the addresses of the listeners passed to a
+	// child process, their file descriptors start at 3 in the same order.
+	envInheritListeners = "RASPBERRY_INHERIT_LISTENERS"
+	// envParentPID is the pid of the process to stop once the child is
+	// serving.
+	envParentPID = "RASPBERRY_PARENT_PID"
+)
+
+// restartSignal forks a new gateway process that takes over the listeners.
+var restartSignal os.Signal = syscall.SIGUSR2
+
+var (
+	listenersMu sync.Mutex
+	// listeners are the active listeners by the address they were opened
+	// on, these are the ones handed over on restart.
+	listeners = map[string]*net.TCPListener{}
+
+	inheritOnce sync.Once
+	inherited   map[string]*net.TCPListener
+)
+
+// loadInheritedListeners picks up the listeners passed by a parent process.
+func loadInheritedListeners() {
+	inherited = map[string]*net.TCPListener{}
+	addrs := os.Getenv(envInheritListeners)
+	if addrs == "" {
+		return
+	}
+	for i, addr := range strings.Split(addrs, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			mainLog.Errorf("Couldn't inherit listener for %s: %v", addr, err)
+			continue
+		}
+		if tcpLn, ok := ln.(*net.TCPListener); ok {
+			inherited[addr] = tcpLn
+		}
+	}
+	mainLog.Infof("Inherited %d listeners from parent process", len(inherited))
+}
+
+// listenTCP returns a listener on address, reusing the one inherited from
+// the parent process if there is one.
+func listenTCP(address string) (net.Listener, error) {
+	inheritOnce.Do(loadInheritedListeners)
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	ln, ok := inherited[address]
+	if ok {
+		delete(inherited, address)
+	} else {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		ln = l.(*net.TCPListener)
+	}
+	listeners[address] = ln
+	return ln, nil
+}
+
+// startChild starts a new gateway process from the binary on disk, handing
+// it the active listeners. The child stops this process once it is ready.
+// It is refused while a storage file is open, which the child couldn't open
+// until this process stops.
+func startChild() error {
+	if files := storage.OpenFiles(); len(files) > 0 {
+		return fmt.Errorf("storage file %s can only be opened by one process, stop and start the gateway instead", files[0])
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	listenersMu.Lock()
+	var addrs []string
+	var files []*os.File
+	for addr, ln := range listeners {
+		f, err := ln.File()
+		if err != nil {
+			listenersMu.Unlock()
+			return err
+		}
+		defer f.Close()
+		addrs = append(addrs, addr)
+		files = append(files, f)
+	}
+	listenersMu.Unlock()
+	if len(files) == 0 {
+		return errors.New("no listeners to hand over")
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envInheritListeners+"="+strings.Join(addrs, ","),
+		envParentPID+"="+strconv.Itoa(os.Getpid()),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	mainLog.Infof("Started new process %d from %s", cmd.Process.Pid, path)
+	return nil
+}
+
+// notifyParent tells the process that started this one that it can shut
+// down, and closes any inherited listeners that weren't reused.
+func notifyParent() {
+	inheritOnce.Do(loadInheritedListeners)
+
+	listenersMu.Lock()
+	for addr, ln := range inherited {
+		mainLog.Info("Closing unused inherited listener on ", addr)
+		ln.Close()
+		delete(inherited, addr)
+	}
+	listenersMu.Unlock()
+
+	ppid, err := strconv.Atoi(os.Getenv(envParentPID))
+	if err != nil || ppid != os.Getppid() {
+		return
+	}
+	mainLog.Info("Stopping parent process ", ppid)
+	if err := syscall.Kill(ppid, syscall.SIGTERM); err != nil {
+		mainLog.Error("Couldn't stop parent process: ", err)
+	}
+}
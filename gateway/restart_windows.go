@@ -0,0 +1,21 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// restartSignal is nil as zero-downtime restarts aren't supported on
+// windows.
+var restartSignal os.Signal
+
+func listenTCP(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func startChild() error {
+	return errors.New("restart is not supported on windows")
+}
+
+func notifyParent() {}
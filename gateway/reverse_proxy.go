@@ -0,0 +1,460 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// ReverseProxy forwards requests received on the listen path of an API to
+// its target.
+type ReverseProxy struct {
+	Spec *APISpec
+
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+}
+
+// NewReverseProxy returns a ReverseProxy for spec.
+func NewReverseProxy(spec *APISpec) *ReverseProxy {
+	p := &ReverseProxy{Spec: spec, transport: upstreamTransport(spec)}
+	p.proxy = &httputil.ReverseProxy{
+		Director:       p.director,
+		Transport:      p.transport,
+		FlushInterval:  flushInterval(),
+		ErrorHandler:   p.errorHandler,
+		ModifyResponse: p.modifyResponse,
+	}
+	if spec.Proxy.EnableHTTP2 || spec.isGRPC() {
+		p.proxy.Transport = newHTTP2Transport(p.transport)
+	}
+	if spec.isGRPC() {
+		// streamed messages are passed on as they arrive
+		p.proxy.FlushInterval = -1
+	}
+	return p
+}
+
+// ServeHTTP implements http.Handler. WebSocket upgrades are tunnelled when
+// enable_web_sockets is set, everything else goes through the HTTP proxy
+// and is recorded in analytics.
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if isWebSocketUpgrade(r) {
+		if !config.Global().HttpServerOptions.EnableWebSockets {
+			handleError(w, r, "WebSockets are not enabled", http.StatusBadRequest)
+			return
+		}
+		p.serve(w, r, func(w http.ResponseWriter, r *http.Request) {
+			p.serveWebSocket(w, r, start)
+		})
+		return
+	}
+
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+	rec := &responseRecorder{ResponseWriter: w, req: r, writeTimeout: writeTimeout()}
+	p.serve(rec, r, p.proxy.ServeHTTP)
+
+	record := newAnalyticsRecord(p.Spec, r, rec.statusCode(), start)
+	record.BytesIn = body.count()
+	record.BytesOut = rec.bytes
+	if p.Spec.isGRPC() {
+		record.Protocol = "grpc"
+		if code, ok := grpcResponseStatus(rec.Header()); ok {
+			record.GRPCStatus = grpcCodeName(code)
+			record.ResponseCode = grpcToHTTPStatus(code)
+		}
+	}
+	recordAnalytics(record)
+}
+
+// serve picks the upstream for r and passes the request on to next. The
+// upstream is the version's override target if it has one, otherwise it is
+// picked by the API's load balancer.
+func (p *ReverseProxy) serve(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	target := ctxGetTargetOverride(r)
+	if target == nil {
+		t, err := p.Spec.loadBalancer.Next(r)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "proxy",
+				"api_id": p.Spec.APIID,
+			}).Error(err)
+			if cb := ctxGetCircuitBreaker(r); cb != nil {
+				cb.record(true)
+			}
+			handleError(w, r, "Service temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		t.acquire()
+		defer t.release()
+		target = t.url
+	}
+	ctxSetUpstreamTarget(r, target)
+
+	next(w, r)
+}
+
+func (p *ReverseProxy) director(req *http.Request) {
+	target := ctxGetUpstreamTarget(req)
+	setForwardedHeaders(req, p.Spec.Proxy.ForwardedHeaders)
+
+	path := req.URL.Path
+	if p.Spec.Proxy.StripListenPath {
+		path = stripListenPath(p.Spec.Proxy.ListenPath, path)
+	}
+
+	targetQuery := target.RawQuery
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = singleJoiningSlash(target.Path, path)
+	req.URL.RawPath = ""
+	if targetQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = targetQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+	}
+	req.Host = target.Host
+
+	// only the gateway may tell the upstream who the client is
+	req.Header.Del(headers.XSSLClientSubject)
+	req.Header.Del(headers.XSSLClientFingerprint)
+	if cert := ctxGetClientCert(req); cert != nil {
+		req.Header.Set(headers.XSSLClientSubject, cert.Subject)
+		req.Header.Set(headers.XSSLClientFingerprint, cert.Fingerprint)
+	}
+
+	if _, ok := req.Header[headers.UserAgent]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set(headers.UserAgent, "")
+	}
+}
+
+// modifyResponse reports the upstream's response to the passive health
+// checks and the circuit breaker, a 5xx counts as a failure.
+func (p *ReverseProxy) modifyResponse(res *http.Response) error {
+	failed := res.StatusCode >= http.StatusInternalServerError
+	GlobalHostChecker.ReportResult(p.Spec.APIID, ctxGetUpstreamTarget(res.Request), failed, res.Status)
+	if cb := ctxGetCircuitBreaker(res.Request); cb != nil {
+		cb.record(failed)
+	}
+	return nil
+}
+
+// statusClientClosedRequest is recorded for requests whose client went away
+// before the upstream answered.
+const statusClientClosedRequest = 499
+
+func (p *ReverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil || errors.Is(err, context.Canceled) {
+		// the client gave up, which says nothing about the upstream
+		abandonBreaker(r)
+		log.WithFields(logrus.Fields{
+			"prefix":   "proxy",
+			"api_id":   p.Spec.APIID,
+			"upstream": r.URL.Host,
+			"path":     r.URL.Path,
+		}).Debug("Client closed the request: ", err)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	GlobalHostChecker.ReportResult(p.Spec.APIID, ctxGetUpstreamTarget(r), true, err.Error())
+	if cb := ctxGetCircuitBreaker(r); cb != nil {
+		cb.record(true)
+	}
+	log.WithFields(logrus.Fields{
+		"prefix":   "proxy",
+		"api_id":   p.Spec.APIID,
+		"upstream": r.URL.Host,
+		"path":     r.URL.Path,
+	}).Error("http: proxy error: ", err)
+	handleError(w, r, "There was a problem proxying the request", http.StatusBadGateway)
+}
+
+// responseRecorder keeps the status code and size of a response for
+// analytics. Streamed responses, server-sent events and bodies of unknown
+// length, are passed straight through with every write given a fresh write
+// timeout, so long-lived streams outlast the server's write_timeout. Events
+// are flushed as soon as they are written.
+type responseRecorder struct {
+	http.ResponseWriter
+	req          *http.Request
+	writeTimeout time.Duration
+
+	status int
+	bytes  int64
+
+	stream      bool
+	flushWrites bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	// informational responses can precede the final one
+	if rec.status == 0 && code >= http.StatusOK {
+		rec.setStatus(code)
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) setStatus(code int) {
+	rec.status = code
+	h := rec.Header()
+	rec.flushWrites = isEventStream(h.Get(headers.ContentType))
+	rec.stream = rec.flushWrites || h.Get(headers.ContentLength) == ""
+	if rec.stream {
+		rec.extendWriteDeadline()
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.setStatus(http.StatusOK)
+	}
+	if rec.stream {
+		rec.extendWriteDeadline()
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	if rec.flushWrites {
+		rec.Flush()
+	}
+	return n, err
+}
+
+// Flush implements http.Flusher so streamed responses are still flushed.
+func (rec *responseRecorder) Flush() {
+	if rec.stream {
+		rec.extendWriteDeadline()
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *responseRecorder) extendWriteDeadline() {
+	if rec.req != nil && rec.writeTimeout > 0 {
+		extendWriteDeadline(rec.ResponseWriter, rec.req, rec.writeTimeout)
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// isEventStream reports whether contentType is that of server-sent events.
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream"
+}
+
+// countingReader counts the bytes read from a request body. The transport
+// may still be reading when the response is done, so n is accessed
+// atomically.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// flushInterval returns the configured flush_interval, which is set in
+// milliseconds.
+func flushInterval() time.Duration {
+	return time.Duration(config.Global().HttpServerOptions.FlushIntercal) * time.Millisecond
+}
+
+// upstreamIdleTimeout is how long upstream connections are kept open while
+// idle.
+const upstreamIdleTimeout = 90 * time.Second
+
+func httpTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dialContext := dialer.DialContext
+	if dnsCache := currentDNSCache(); dnsCache != nil {
+		dialContext = dnsCache.WrapDialer(dialer)
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       upstreamIdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// upstreamTransport returns a transport connecting to the upstreams of
+// spec with its upstream_tls configuration.
+func upstreamTransport(spec *APISpec) *http.Transport {
+	t := httpTransport()
+	if spec.upstreamTLS != nil {
+		t.TLSClientConfig = spec.upstreamTLS.Clone()
+	}
+	return t
+}
+
+// http2Transport sends requests to the upstream over HTTP/2, as h2c to http
+// targets and negotiated through ALPN to https ones. Connections are
+// dialed the same way as base's. The HTTP/2 transports have no idle
+// timeout of their own, so their connections are closed once none have
+// had a request in flight for idleTimeout.
+type http2Transport struct {
+	h2c *http2.Transport
+	h2  *http2.Transport
+
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	inFlight    int
+	idle        *time.Timer
+}
+
+func newHTTP2Transport(base *http.Transport) *http2Transport {
+	return &http2Transport{
+		idleTimeout: upstreamIdleTimeout,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return base.DialContext(context.Background(), network, addr)
+			},
+		},
+		h2: &http2.Transport{
+			TLSClientConfig: base.TLSClientConfig.Clone(),
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := base.DialContext(context.Background(), network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				conn.SetDeadline(time.Now().Add(base.TLSHandshakeTimeout))
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				conn.SetDeadline(time.Time{})
+				if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+					conn.Close()
+					return nil, fmt.Errorf("upstream %s doesn't support HTTP/2, negotiated %q", addr, p)
+				}
+				return tlsConn, nil
+			},
+		},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.h2
+	if req.URL.Scheme == "http" {
+		rt = t.h2c
+	}
+	t.begin()
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.end()
+		return nil, err
+	}
+	res.Body = &doneReader{ReadCloser: res.Body, done: t.end}
+	return res, nil
+}
+
+// begin counts a request in flight, stopping the idle timer.
+func (t *http2Transport) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight++
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+}
+
+// end counts a request done, starting the idle timer after the last one.
+func (t *http2Transport) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	if t.inFlight > 0 {
+		return
+	}
+	if t.idle == nil {
+		t.idle = time.AfterFunc(t.idleTimeout, t.CloseIdleConnections)
+		return
+	}
+	t.idle.Reset(t.idleTimeout)
+}
+
+// CloseIdleConnections closes the connections without requests in flight.
+func (t *http2Transport) CloseIdleConnections() {
+	t.h2c.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+}
+
+// doneReader calls done once when the body is closed.
+type doneReader struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (r *doneReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.done)
+	return err
+}
+
+// closeIdleConnections closes the idle connections to the upstreams.
+func (p *ReverseProxy) closeIdleConnections() {
+	p.transport.CloseIdleConnections()
+	if t, ok := p.proxy.Transport.(*http2Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,357 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var proxyPathTests = []struct {
+	listenPath string
+	strip      bool
+	target     string
+	reqPath    string
+	expected   string
+	code       int
+}{
+	{listenPath: "/gateway", target: "/api", reqPath: "/gateway/widgets", expected: "/api/gateway/widgets", code: http.StatusOK},
+	{listenPath: "/gateway", strip: true, target: "/api", reqPath: "/gateway/widgets", expected: "/api/widgets", code: http.StatusOK},
+	{listenPath: "/gateway/", strip: true, target: "/", reqPath: "/gateway", expected: "/", code: http.StatusOK},
+	{listenPath: "/", target: "/api/", reqPath: "/widgets", expected: "/api/widgets", code: http.StatusOK},
+	{listenPath: "/gateway", target: "/api", reqPath: "/gatewayx/widgets", code: http.StatusNotFound},
+	{listenPath: "/gateway", target: "/api", reqPath: "/other", code: http.StatusNotFound},
+}
+
+func TestReverseProxyListenPath(t *testing.T) {
+	upstream := testUpstream()
+	defer upstream.Close()
+
+	for _, test := range proxyPathTests {
+		spec := buildSpec(t, upstream.URL+test.target, func(def *apidef.APIDefinition) {
+			def.Proxy.ListenPath = test.listenPath
+			def.Proxy.StripListenPath = test.strip
+		})
+		rt := &router{}
+		rt.handle(spec.Proxy.ListenPath, NewReverseProxy(spec))
+
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.reqPath, nil))
+
+		if rec.Code != test.code {
+			t.Errorf("%s -> %s: expected code %d got %d", test.listenPath, test.reqPath, test.code, rec.Code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		body, _ := ioutil.ReadAll(rec.Body)
+		if string(body) != test.expected {
+			t.Errorf("%s -> %s: expected upstream path %s got %s", test.listenPath, test.reqPath, test.expected, body)
+		}
+	}
+}
+
+func TestReverseProxyUpstreamDown(t *testing.T) {
+	proxy := NewReverseProxy(buildSpec(t, "http://127.0.0.1:1"))
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected %d got %d", http.StatusBadGateway, rec.Code)
+	}
+}
+
+func TestLoadTemplatesEmptyPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, defaultTemplateName), []byte("from the working directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer loadTemplates(config.Global().TemplatePath)
+
+	loadTemplates("")
+	rec := httptest.NewRecorder()
+	handleError(rec, httptest.NewRequest(http.MethodGet, "/", nil), "oops", http.StatusBadGateway)
+	if body := rec.Body.String(); !strings.Contains(body, `"error": "oops"`) {
+		t.Errorf("expected the default template, got %q", body)
+	}
+}
+
+func TestDefaultTemplateEscaping(t *testing.T) {
+	defer loadTemplates(config.Global().TemplatePath)
+	for _, dir := range []string{"", "../templates"} {
+		loadTemplates(dir)
+		msg := `no route for "/a\b"` + "\n"
+		rec := httptest.NewRecorder()
+		handleError(rec, httptest.NewRequest(http.MethodGet, "/", nil), msg, http.StatusNotFound)
+		var body struct{ Error string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != msg {
+			t.Errorf("%q: want the message escaped, got %q %v", dir, rec.Body, err)
+		}
+	}
+}
+
+func TestLoadTemplatesWhileServing(t *testing.T) {
+	defer loadTemplates(config.Global().TemplatePath)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			loadTemplates("../templates")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		handleError(rec, httptest.NewRequest(http.MethodGet, "/", nil), "oops", http.StatusBadGateway)
+		if !strings.Contains(rec.Body.String(), `"oops"`) {
+			t.Fatalf("want the message rendered, got %q", rec.Body)
+		}
+	}
+	<-done
+}
+
+func TestMakeSpecInvalidTarget(t *testing.T) {
+	for _, target := range []string{"", "localhost:8080", "/api"} {
+		def := &apidef.APIDefinition{APIID: "test", Proxy: apidef.ProxyConfig{TargetURL: target}}
+		if _, err := (APIDefinitionLoader{}).MakeSpec(def); err == nil {
+			t.Errorf("expected error for target %q", target)
+		}
+	}
+}
+
+func TestReverseProxyHTTP2Upstream(t *testing.T) {
+	protoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	h2cUpstream := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer h2cUpstream.Close()
+	tlsUpstream := httptest.NewUnstartedServer(protoHandler)
+	tlsUpstream.EnableHTTP2 = true
+	tlsUpstream.StartTLS()
+	defer tlsUpstream.Close()
+
+	for _, upstream := range []*httptest.Server{h2cUpstream, tlsUpstream} {
+		for _, enabled := range []bool{false, true} {
+			proxy := NewReverseProxy(buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+				def.Proxy.EnableHTTP2 = enabled
+				def.Proxy.UpstreamTLS.InsecureSkipVerify = true
+			}))
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			want := "HTTP/1.1"
+			if enabled {
+				want = "HTTP/2.0"
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != want {
+				t.Errorf("%s with enable_http2=%v: want %s, got %d %s", upstream.URL, enabled, want, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+// closeCountingListener counts the connections it accepted that were
+// closed, which hijacked connections aren't reported as by ConnState.
+type closeCountingListener struct {
+	net.Listener
+	closed int32
+}
+
+func (l *closeCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeCountingConn{Conn: conn, closed: &l.closed}, nil
+}
+
+type closeCountingConn struct {
+	net.Conn
+	once   sync.Once
+	closed *int32
+}
+
+func (c *closeCountingConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(c.closed, 1) })
+	return c.Conn.Close()
+}
+
+// connTracker returns an upstream served by handler, over h2c if useH2C
+// is set, and a func waiting until n of its connections are closed.
+func connTracker(t *testing.T, handler http.Handler, useH2C bool) (*httptest.Server, func(n int32)) {
+	if useH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	upstream := httptest.NewUnstartedServer(handler)
+	ln := &closeCountingListener{Listener: upstream.Listener}
+	upstream.Listener = ln
+	upstream.Start()
+	return upstream, func(n int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&ln.closed) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("want %d upstream connections closed, got %d", n, atomic.LoadInt32(&ln.closed))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestReverseProxyHTTP2IdleTimeout(t *testing.T) {
+	upstream, waitClosed := connTracker(t, http.NotFoundHandler(), true)
+	defer upstream.Close()
+
+	proxy := NewReverseProxy(buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.Proxy.EnableHTTP2 = true
+	}))
+	proxy.proxy.Transport.(*http2Transport).idleTimeout = 50 * time.Millisecond
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("want the upstream's %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	waitClosed(1)
+}
+
+func TestRouterCloseIdleConnections(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		upstream, waitClosed := connTracker(t, http.NotFoundHandler(), enabled)
+		rt := loadApps([]*APISpec{buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+			def.Proxy.EnableHTTP2 = enabled
+		})})
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("enable_http2=%v: want the upstream's %d, got %d", enabled, http.StatusNotFound, rec.Code)
+		}
+		// as once a reload has replaced it
+		rt.closeIdleConnections()
+		waitClosed(1)
+		upstream.Close()
+	}
+}
+
+func TestReverseProxyHTTP2UpstreamNotSupported(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.NotFoundHandler())
+	upstream.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	proxy := NewReverseProxy(buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.Proxy.EnableHTTP2 = true
+		def.Proxy.UpstreamTLS.InsecureSkipVerify = true
+	}))
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("want %d from an HTTP/1.1-only upstream, got %d", http.StatusBadGateway, rec.Code)
+	}
+}
+
+func TestReverseProxyEventStream(t *testing.T) {
+	defer setServerOptions(config.HttpServerOptionsConfig{WriteTimeout: 1})()
+	defer enableAnalytics()()
+
+	release := make(chan struct{})
+	events := []string{"data: one\n\n", "data: two\n\n", "data: three\n\n", "data: four\n\n"}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Write([]byte(events[0]))
+		w.(http.Flusher).Flush()
+		// held until the client has the first event, which must not wait
+		// for more data
+		<-release
+		for _, e := range events[1:] {
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte(e))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	handler := processSpec(buildSpec(t, upstream.URL))
+	gw := httptest.NewUnstartedServer(handler)
+	gw.Config = newServer(handler)
+	gw.Start()
+	defer gw.Close()
+
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+	res, err := http.Post(gw.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	br := bufio.NewReader(res.Body)
+	first, err := br.ReadString('\n')
+	close(release)
+	if err != nil || first != "data: one\n" {
+		t.Fatalf("want the first event before the stream ends, got %q %v", first, err)
+	}
+	// the stream outlives the one second write timeout
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := first + string(rest); got != strings.Join(events, "") {
+		t.Errorf("want every event, got %q", got)
+	}
+
+	record := waitForAnalyticsRecord(t)
+	if record.BytesIn != 5 || record.BytesOut != int64(len(strings.Join(events, ""))) {
+		t.Errorf("want the stream's bytes recorded, got %d in and %d out", record.BytesIn, record.BytesOut)
+	}
+	if record.RequestTime < 1500 {
+		t.Errorf("want the stream's duration recorded, got %dms", record.RequestTime)
+	}
+}
+
+func TestReverseProxyFlushInterval(t *testing.T) {
+	defer setServerOptions(config.HttpServerOptionsConfig{FlushIntercal: 10})()
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("last chunk\n"))
+	}))
+	defer upstream.Close()
+	gw := httptest.NewServer(processSpec(buildSpec(t, upstream.URL)))
+	defer gw.Close()
+	defer close(release)
+
+	res, err := http.Get(gw.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil || line != "first chunk\n" {
+		t.Errorf("want the first chunk flushed, got %q %v", line, err)
+	}
+}
@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests to the handler registered for the longest
+// listen path that matches the request path. Routes for the request's
+// domain are preferred over those for any domain with the same listen path.
+type router struct {
+	routes []route
+	// specs are the APIs served, their upstream connections are closed
+	// once the router is replaced.
+	specs []*APISpec
+}
+
+type route struct {
+	domain     string
+	listenPath string
+	handler    http.Handler
+}
+
+func (rt *router) handle(listenPath string, handler http.Handler) {
+	rt.handleDomain("", listenPath, handler)
+}
+
+// handleDomain routes requests for domain to handler, an empty domain
+// matches any host.
+func (rt *router) handleDomain(domain, listenPath string, handler http.Handler) {
+	rt.routes = append(rt.routes, route{
+		domain:     strings.ToLower(domain),
+		listenPath: cleanListenPath(listenPath),
+		handler:    handler,
+	})
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		a, b := rt.routes[i], rt.routes[j]
+		if len(a.listenPath) != len(b.listenPath) {
+			return len(a.listenPath) > len(b.listenPath)
+		}
+		return a.domain != "" && b.domain == ""
+	})
+}
+
+// closeIdleConnections closes the idle upstream connections of the APIs
+// served, the others are closed once their requests complete.
+func (rt *router) closeIdleConnections() {
+	for _, spec := range rt.specs {
+		if spec.proxy != nil {
+			spec.proxy.closeIdleConnections()
+		}
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := requestHost(r)
+	for _, route := range rt.routes {
+		if (route.domain == "" || route.domain == host) && matchListenPath(route.listenPath, r.URL.Path) {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	handleError(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+// requestHost returns the lower-cased host r was sent to, without a port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// cleanListenPath makes sure a listen path starts with a slash and has no
+// trailing one, so that "/" is the only path that ends in a slash.
+func cleanListenPath(listenPath string) string {
+	listenPath = "/" + strings.Trim(listenPath, "/")
+	return listenPath
+}
+
+// matchListenPath reports whether path falls under listenPath, only
+// matching on whole path segments.
+func matchListenPath(listenPath, path string) bool {
+	if listenPath == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, listenPath) {
+		return false
+	}
+	return len(path) == len(listenPath) || path[len(listenPath)] == '/'
+}
+
+// stripListenPath removes listenPath from the front of path.
+func stripListenPath(listenPath, path string) string {
+	if listenPath == "/" {
+		return path
+	}
+	path = strings.TrimPrefix(path, listenPath)
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -2,15 +2,30 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	cli "github.com/raspberry-gateway/raspberry/cli"
 	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/dnscache"
 	logger "github.com/raspberry-gateway/raspberry/log"
+	"github.com/raspberry-gateway/raspberry/request"
+	"github.com/raspberry-gateway/raspberry/storage"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
@@ -36,14 +51,34 @@ var (
 
 	runningTestsMu sync.RWMutex
 	testMode       bool
+
+	// GlobalSessionManager stores the sessions of API keys.
+	GlobalSessionManager SessionHandler
+	sessionLimiter       *SessionLimiter
+	analytics            *AnalyticsHandler
+
+	dnsCacheMu sync.Mutex
+	// dnsCacheManager resolves upstream host names when the DNS cache is
+	// enabled, nil otherwise.
+	dnsCacheManager *dnscache.DnsCacheManager
+	dnsCacheConf    config.DnsCacheConfig
+)
+
+const (
+	defaultReadTimeout  = 120 * time.Second
+	defaultWriteTimeout = 120 * time.Second
+
+	defaultPIDFileLocation  = "/var/run/raspberry/raspberry-gateway.pid"
+	defaultGracefulShutdown = 30 * time.Second
 )
 
 // Start The function Raspberry Gateway entry.
 func Start() {
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	cli.Init(VERSION, confPaths)
+	cli.Parse()
 
 	// Stop gateway process if not running in "start" mode:
 	if !cli.DefaultMode {
@@ -52,6 +87,33 @@ func Start() {
 
 	SetNodeID("solo-" + uuid.NewV4().String())
 
+	if err := initialiseSystem(ctx); err != nil {
+		mainLog.Fatalf("Error initialising system: %v", err)
+	}
+
+	if err := writePIDFile(); err != nil {
+		mainLog.Error("Failed to write PIDFile: ", err)
+	}
+	defer removePIDFile()
+
+	specs, err := loadAPISpecs(config.Global())
+	if len(specs) == 0 {
+		mainLog.Fatalf("Error loading API definitions: %v", err)
+	}
+	if err != nil {
+		mainLog.Error(err)
+	}
+	setMainRouter(loadApps(specs))
+	handleReloadSignals()
+
+	srv, err := listen(mainHandler{})
+	if err != nil {
+		mainLog.Fatalf("Server error: %v", err)
+	}
+	notifyParent()
+
+	waitForShutdown(srv)
+	mainLog.Info("Stop signal received, exiting")
 }
 
 // SetNodeID writes NodeID safely.
@@ -61,7 +123,7 @@ func SetNodeID(nodeID string) {
 	muNodeID.Unlock()
 }
 
-func initialliseSystem(ctx context.Context) error {
+func initialiseSystem(ctx context.Context) error {
 	if isRunningTests() && os.Getenv(logger.LogLevel) == "" {
 		// `go test` without RASPBERRY_LOGLEVEL set defaults to no log output
 		log.Level = logrus.ErrorLevel
@@ -72,15 +134,140 @@ func initialliseSystem(ctx context.Context) error {
 	}
 
 	if *cli.Conf != "" {
-		mainLog.Debugf("Using %s fro configuration", *cli.Conf)
+		mainLog.Debugf("Using %s for configuration", *cli.Conf)
 		confPaths = []string{*cli.Conf}
 	} else {
-		mainLog.Debug("No configuration file defined, with try to use default (raspberry.conf)")
+		mainLog.Debug("No configuration file defined, will try to use default (raspberry.conf)")
 	}
 
 	mainLog.Infof("Raspberry API gateway %s", VERSION)
 
-	
+	globalConf, err := loadGlobalConfig()
+	if err != nil {
+		return err
+	}
+	if globalConf.PIDFileLocation == "" {
+		globalConf.PIDFileLocation = defaultPIDFileLocation
+	}
+	if err := checkHashKeyFunctions(globalConf); err != nil {
+		return err
+	}
+	deniedIPs, err := newIPTrie(globalConf.DeniedIPs)
+	if err != nil {
+		return fmt.Errorf("denied_ips: %v", err)
+	}
+	if err := request.SetTrustedProxies(globalConf.TrustedProxies, globalConf.ClientIPHeaders); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	globalDeniedIPs.Store(deniedIPs)
+	config.SetGlobal(globalConf)
+	if globalConf.HttpServerOptions.SSLInsecureSkipVerify {
+		mainLog.Warning("http_server_options.ssl_insecure_skip_verify is ignored, set proxy.upstream_tls.ssl_insecure_skip_verify on the APIs that need it")
+	}
+
+	loadTemplates(globalConf.TemplatePath)
+	return setupGlobals()
+}
+
+// loadGlobalConfig reads the configuration from confPaths and applies the
+// command line overrides to it.
+func loadGlobalConfig() (config.Config, error) {
+	globalConf := config.Config{}
+	if err := config.Load(confPaths, &globalConf); err != nil {
+		return globalConf, err
+	}
+
+	if cli.Port != nil && *cli.Port != "" {
+		portNum, err := strconv.Atoi(*cli.Port)
+		if err != nil {
+			return globalConf, fmt.Errorf("invalid port %q: %v", *cli.Port, err)
+		}
+		globalConf.ListenPort = portNum
+	}
+	return globalConf, nil
+}
+
+// setupGlobals connects the session, rate limit, analytics and certificate
+// stores to the configured storage, encrypting sessions if enabled.
+func setupGlobals() error {
+	conf := config.Global().Storage
+	stores := make(map[string]storage.Handler)
+	for _, prefix := range []string{storage.SessionKeyPrefix, "", "acme-", "webhook.cache."} {
+		store, err := storage.Connect(conf, prefix)
+		if err != nil {
+			return fmt.Errorf("storage: %v", err)
+		}
+		stores[prefix] = store
+	}
+
+	sessions := stores[storage.SessionKeyPrefix]
+	if enc := config.Global().SessionEncryption; enc.Enabled {
+		keys, err := storage.LoadKeyring(enc, config.Global().Secret)
+		if err != nil {
+			return fmt.Errorf("session_encryption: %v", err)
+		}
+		sessions = storage.NewEncryptedHandler(sessions, keys)
+	}
+
+	GlobalSessionManager = NewSessionManager(sessions)
+	sessionLimiter = NewSessionLimiter(stores[""])
+	if analytics != nil {
+		analytics.Stop()
+	}
+	analytics = NewAnalyticsHandler(stores[""])
+	analytics.Init()
+	acmeStorage = stores["acme-"]
+	webhookStorage = stores["webhook.cache."]
+	initDNSCaching()
+	return nil
+}
+
+// initDNSCaching sets up the DNS cache from the dns_cache configuration. An
+// unchanged configuration keeps the current cache.
+func initDNSCaching() {
+	conf := config.Global().DnsCache
+
+	dnsCacheMu.Lock()
+	defer dnsCacheMu.Unlock()
+
+	if dnsCacheManager != nil && conf == dnsCacheConf {
+		return
+	}
+	if dnsCacheManager != nil {
+		dnsCacheManager.DisposeCache()
+		dnsCacheManager = nil
+	}
+	dnsCacheConf = conf
+	if !conf.Enabled {
+		return
+	}
+
+	ttl, checkInterval := conf.TTL, conf.CheckInterval
+	if ttl <= 0 {
+		ttl = config.Default.DnsCache.TTL
+	}
+	if checkInterval <= 0 {
+		checkInterval = config.Default.DnsCache.CheckInterval
+	}
+	strategy := conf.MultipleIPsHandleStrategy
+	switch strategy {
+	case config.PickFirstStrategy, config.RandomStrategy, config.NoCacheStrategy:
+	default:
+		if strategy != "" {
+			mainLog.Warningf("Unknown DNS cache strategy %q, using %q", strategy, config.Default.DnsCache.MultipleIPsHandleStrategy)
+		}
+		strategy = config.Default.DnsCache.MultipleIPsHandleStrategy
+	}
+
+	dnsCacheManager = dnscache.NewDnsCacheManager(strategy)
+	dnsCacheManager.InitDNSCaching(time.Duration(ttl)*time.Second, time.Duration(checkInterval)*time.Second)
+}
+
+// currentDNSCache returns the DNS cache in use, nil if it is disabled.
+func currentDNSCache() *dnscache.DnsCacheManager {
+	dnsCacheMu.Lock()
+	defer dnsCacheMu.Unlock()
+	return dnsCacheManager
 }
 
 func isRunningTests() bool {
@@ -90,6 +277,176 @@ func isRunningTests() bool {
 	return v
 }
 
+// newServer returns an http.Server for handler, honouring the timeouts set
+// in the global HttpServerOptions.
+func newServer(handler http.Handler) *http.Server {
+	opts := config.Global().HttpServerOptions
+
+	readTimeout := defaultReadTimeout
+	if opts.ReadTimeout > 0 {
+		readTimeout = time.Duration(opts.ReadTimeout) * time.Second
+	}
+
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, ctxConn, c)
+		},
+	}
+}
+
+// writeTimeout returns the configured write_timeout.
+func writeTimeout() time.Duration {
+	if t := config.Global().HttpServerOptions.WriteTimeout; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+	return defaultWriteTimeout
+}
+
+// listen starts serving handler on the configured address in the
+// background.
+func listen(handler http.Handler) (*http.Server, error) {
+	conf := config.Global()
+	address := net.JoinHostPort(conf.ListenAddress, strconv.Itoa(conf.ListenPort))
+
+	ln, err := listenTCP(address)
+	if err != nil {
+		return nil, err
+	}
+	mainLog.Infof("--> Listening on address: %s", ln.Addr())
+
+	if conf.HttpServerOptions.ProxyProtocol.Enabled {
+		pln, err := newProxyProtoListener(ln, conf.HttpServerOptions.ProxyProtocol)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = pln
+	}
+
+	srv := newServer(handler)
+	if ln, err = configureProtocols(srv, ln); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			mainLog.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	if conf.HttpServerOptions.UseLe_SSL && conf.HttpServerOptions.ACME.HTTPPort > 0 {
+		if err := listenACMEChallenges(conf); err != nil {
+			return srv, err
+		}
+	}
+	return srv, nil
+}
+
+// configureProtocols sets up the protocols srv speaks on ln. With use_ssl
+// or use_ssl_le the listener is wrapped in TLS, offering h2 through ALPN
+// when enable_http2 is set, and answering TLS-ALPN-01 challenges with
+// use_ssl_le. Plain listeners accept h2c as well when both
+// enable_http2 and enable_h2c are set.
+func configureProtocols(srv *http.Server, ln net.Listener) (net.Listener, error) {
+	opts := config.Global().HttpServerOptions
+
+	if !servesTLS(opts) {
+		if opts.EnableHttp2 && opts.EnableH2c {
+			srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+		}
+		return ln, nil
+	}
+
+	tlsConfig, err := getTLSConfig(opts)
+	if err != nil {
+		return ln, err
+	}
+	srv.TLSConfig = tlsConfig
+	if opts.EnableHttp2 {
+		if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+			return ln, err
+		}
+	} else {
+		// a non-nil map stops the server from enabling h2 on its own
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	if opts.UseLe_SSL {
+		if len(srv.TLSConfig.NextProtos) == 0 {
+			// clients have to agree on a protocol once any is offered
+			srv.TLSConfig.NextProtos = []string{"http/1.1"}
+		}
+		srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, acme.ALPNProto)
+	}
+	return tls.NewListener(ln, srv.TLSConfig), nil
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT is received, then drains
+// in-flight requests from srv. The restart signal starts a new process that
+// takes over the listeners and stops this one once it is ready.
+func waitForShutdown(srv *http.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	if restartSignal != nil {
+		signal.Notify(sigs, restartSignal)
+	}
+
+	for sig := range sigs {
+		if sig == restartSignal {
+			mainLog.Info("Restart signal received, starting new process")
+			if err := startChild(); err != nil {
+				mainLog.Error("Couldn't start new process: ", err)
+			}
+			continue
+		}
+		break
+	}
+	signal.Stop(sigs)
+	gracefulShutdown(srv)
+}
+
+// gracefulShutdown stops accepting connections and waits for in-flight
+// requests for up to graceful_shutdown_timeout_duration, after which the
+// remaining connections are closed. Storage files are closed last, once
+// analytics has been flushed to them.
+func gracefulShutdown(srv *http.Server) {
+	timeout := defaultGracefulShutdown
+	if t := config.Global().GracefulShutdownTimeoutDuration; t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+	mainLog.Infof("Waiting up to %s for in-flight requests to complete", timeout)
+	GlobalHostChecker.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		mainLog.Warning("Graceful shutdown timed out, closing remaining connections: ", err)
+		srv.Close()
+	}
+	analytics.Stop()
+	if err := storage.CloseAll(); err != nil {
+		mainLog.Error("Couldn't close storage: ", err)
+	}
+}
+
 func writePIDFile() error {
-	file := config.
-}
\ No newline at end of file
+	file := config.Global().PIDFileLocation
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	pid := strconv.Itoa(os.Getpid())
+	return ioutil.WriteFile(file, []byte(pid), 0600)
+}
+
+// removePIDFile removes the PID file, unless a restarted process has
+// already replaced it with its own.
+func removePIDFile() {
+	file := config.Global().PIDFileLocation
+	data, err := ioutil.ReadFile(file)
+	if err != nil || string(data) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(file)
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/raspberry-gateway/raspberry/storage"
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+type sessionFailReason uint
+
+const (
+	sessionFailNone sessionFailReason = iota
+	sessionFailRateLimit
+	sessionFailQuota
+)
+
+const (
+	rateLimitKeyPrefix = "rate-limit-"
+	quotaKeyPrefix     = "quota-"
+)
+
+// SessionLimiter is the rate limiter for the API, use ForwardMessage() to
+// check if a message should pass through or not
+type SessionLimiter struct {
+	store storage.Handler
+}
+
+// NewSessionLimiter returns a SessionLimiter keeping its counters in store.
+func NewSessionLimiter(store storage.Handler) *SessionLimiter {
+	return &SessionLimiter{store: store}
+}
+
+// ForwardMessage will enforce rate limiting and quotas, returning the
+// reason the request should be blocked, if any. The request is counted
+// against both the rate limit and the quota.
+func (l *SessionLimiter) ForwardMessage(session *user.SessionState, key string) sessionFailReason {
+	if l.rateExceeded(rateLimitKeyPrefix+key, session.Rate, session.Per) {
+		return sessionFailRateLimit
+	}
+
+	if session.QuotaMax > 0 {
+		if l.store.IncrementWithExpire(quotaKeyPrefix+key, session.QuotaRenewalRate) > session.QuotaMax {
+			return sessionFailQuota
+		}
+	}
+	return sessionFailNone
+}
+
+// MethodRateExceeded counts a call by key to a gRPC method against the
+// method's rate limit, and reports whether the limit was exceeded.
+func (l *SessionLimiter) MethodRateExceeded(key, method string, rate, per float64) bool {
+	return l.rateExceeded(rateLimitKeyPrefix+key+"-"+method, rate, per)
+}
+
+// rateExceeded counts a request against the counter in counterKey and
+// reports whether it is over rate requests per per seconds.
+func (l *SessionLimiter) rateExceeded(counterKey string, rate, per float64) bool {
+	if rate <= 0 || per <= 0 {
+		return false
+	}
+	window := int64(math.Ceil(per))
+	allowed := int64(rate * float64(window) / per)
+	return l.store.IncrementWithExpire(counterKey, window) > allowed
+}
+
+// QuotaRemaining returns how many requests are left in the current quota
+// period, or -1 if the session has no quota.
+func (l *SessionLimiter) QuotaRemaining(session *user.SessionState, key string) int64 {
+	if session.QuotaMax <= 0 {
+		return -1
+	}
+	used, err := l.store.GetKey(quotaKeyPrefix + key)
+	if err != nil {
+		return session.QuotaMax
+	}
+	n, _ := strconv.ParseInt(used, 10, 64)
+	if remaining := session.QuotaMax - n; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// moveQuota moves the quota counted for the key from to the key to, as
+// when the session of a key is moved to its hash.
+func (l *SessionLimiter) moveQuota(from, to string) {
+	used, err := l.store.GetKey(quotaKeyPrefix + from)
+	if err != nil {
+		return
+	}
+	ttl, err := l.store.GetExp(quotaKeyPrefix + from)
+	if err != nil {
+		return
+	}
+	if ttl == 0 {
+		ttl = 1
+	}
+	l.store.SetKey(quotaKeyPrefix+to, used, ttl)
+	l.store.DeleteKey(quotaKeyPrefix + from)
+}
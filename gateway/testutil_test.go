@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	logger "github.com/raspberry-gateway/raspberry/log"
+	"github.com/raspberry-gateway/raspberry/user"
+	"github.com/sirupsen/logrus"
+)
+
+const testSecret = "test-secret"
+
+func TestMain(m *testing.M) {
+	runningTestsMu.Lock()
+	testMode = true
+	runningTestsMu.Unlock()
+
+	if os.Getenv(logger.LogLevel) == "" {
+		log.Level = logrus.PanicLevel
+	}
+
+	conf := config.Config{Secret: testSecret}
+	config.SetGlobal(conf)
+	if err := setupGlobals(); err != nil {
+		panic(err)
+	}
+	setMainRouter(loadApps(nil))
+
+	os.Exit(m.Run())
+}
+
+// buildSpec returns a spec for a keyless API proxying to target, after
+// applying fns to its definition.
+func buildSpec(t *testing.T, target string, fns ...func(*apidef.APIDefinition)) *APISpec {
+	def := &apidef.APIDefinition{
+		APIID:            "test",
+		Name:             "Test API",
+		Active:           true,
+		UseKeylessAccess: true,
+		VersionData:      apidef.VersionData{NotVersioned: true},
+		Proxy: apidef.ProxyConfig{
+			ListenPath: "/",
+			TargetURL:  target,
+		},
+	}
+	for _, fn := range fns {
+		fn(def)
+	}
+	spec, err := APIDefinitionLoader{}.MakeSpec(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// createSession stores session under a new key and returns the key.
+func createSession(t *testing.T, session *user.SessionState) string {
+	key := generateToken("")
+	if err := GlobalSessionManager.UpdateSession(key, session, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testUpstream returns a server that replies with the request path.
+func testUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+}
+
+// enableAnalytics turns analytics on, returning a func restoring the
+// previous configuration.
+func enableAnalytics() func() {
+	old := config.Global()
+	conf := old
+	conf.EnableAnalytics = true
+	config.SetGlobal(conf)
+	return func() { config.SetGlobal(old) }
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+)
+
+// pinPrefix is the optional prefix of pinned public keys, as curl and
+// HPKP write them.
+const pinPrefix = "sha256//"
+
+var errPinMismatch = errors.New("upstream certificate doesn't match any pinned public key")
+
+// newUpstreamTLSConfig returns the TLS configuration of the connections to
+// the upstreams of an API.
+func newUpstreamTLSConfig(conf apidef.UpstreamTLS) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		if conf.CertFile == "" || conf.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if conf.CAFile != "" {
+		certs, err := loadCertificates(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA file: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			tlsConf.RootCAs.AddCert(cert)
+		}
+	}
+
+	if len(conf.PinnedPublicKeys) > 0 {
+		pins := make(map[[sha256.Size]byte]bool, len(conf.PinnedPublicKeys))
+		for _, pin := range conf.PinnedPublicKeys {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix))
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pinned public key %q, want a base64 SHA-256", pin)
+			}
+			var sum [sha256.Size]byte
+			copy(sum[:], b)
+			pins[sum] = true
+		}
+		tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkPins(pins, rawCerts, verifiedChains)
+		}
+	}
+	return tlsConf, nil
+}
+
+// checkPins reports whether the upstream presented one of the pinned
+// public keys. Without verification only the upstream's own certificate
+// counts, as anyone can send a copy of the rest of the chain.
+func checkPins(pins map[[sha256.Size]byte]bool, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+	}
+	if len(verifiedChains) == 0 && len(rawCerts) > 0 {
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if pins[sha256.Sum256(leaf.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return errPinMismatch
+}
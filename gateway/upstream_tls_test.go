@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+)
+
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeKeyPair writes cert and its key to dir, returning their paths.
+func writeKeyPair(t *testing.T, dir string, cert *tls.Certificate) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Leaf.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	clientCA := testCertificate(t, "Client CA", nil)
+	client := testCertificate(t, "gateway", clientCA)
+	certFile, keyFile := writeKeyPair(t, dir, client)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	upstream.TLS.ClientCAs.AddCert(clientCA.Leaf)
+	upstream.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	upstream.StartTLS()
+	defer upstream.Close()
+	caFile := writeCAFile(t, dir, &tls.Certificate{Leaf: upstream.Certificate()})
+
+	pin := publicKeyPin(upstream.Certificate())
+	otherPin := publicKeyPin(client.Leaf)
+	withCert := apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile}
+
+	for _, test := range []struct {
+		name string
+		conf apidef.UpstreamTLS
+		code int
+	}{
+		{"no client certificate", apidef.UpstreamTLS{CAFile: caFile}, http.StatusBadGateway},
+		{"system roots", withCert, http.StatusBadGateway},
+		{"CA bundle", apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}, http.StatusOK},
+		{"pinned", apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, PinnedPublicKeys: []string{otherPin, pin}}, http.StatusOK},
+		{"pin mismatch", apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, PinnedPublicKeys: []string{otherPin}}, http.StatusBadGateway},
+		{"insecure", apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}, http.StatusOK},
+		{"insecure pinned", apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true, PinnedPublicKeys: []string{pin}}, http.StatusOK},
+		{"insecure pin mismatch", apidef.UpstreamTLS{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true, PinnedPublicKeys: []string{otherPin}}, http.StatusBadGateway},
+	} {
+		proxy := NewReverseProxy(buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+			def.Proxy.UpstreamTLS = test.conf
+		}))
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != test.code {
+			t.Errorf("%s: want %d, got %d", test.name, test.code, rec.Code)
+			continue
+		}
+		if test.code == http.StatusOK && rec.Body.String() != "gateway" {
+			t.Errorf("%s: want the client certificate presented, got %q", test.name, rec.Body)
+		}
+	}
+}
+
+func TestUpstreamTLSValidation(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, _ := writeKeyPair(t, dir, testCertificate(t, "gateway", nil))
+
+	for _, conf := range []apidef.UpstreamTLS{
+		{CertFile: certFile},
+		{CertFile: certFile, KeyFile: certFile},
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{PinnedPublicKeys: []string{"sha256//not-base64"}},
+		{PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	} {
+		if _, err := newUpstreamTLSConfig(conf); err == nil {
+			t.Errorf("want an error for %+v", conf)
+		}
+	}
+}
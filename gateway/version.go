@@ -1,4 +1,4 @@
 package gateway
 
 // VERSION Specify the current release version
-const VERSION = "v0.0.1" 
+const VERSION = "v0.0.1"
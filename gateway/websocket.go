@@ -0,0 +1,344 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/headers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebSocketIdleTimeout = 60 * time.Second
+	wsBufferSize                = 32 * 1024
+)
+
+var errWebSocketIdle = errors.New("websocket connection idle")
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket
+// protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, headers.Connection, "upgrade") &&
+		strings.EqualFold(r.Header.Get(headers.Upgrade), "websocket")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func webSocketIdleTimeout() time.Duration {
+	if t := config.Global().HttpServerOptions.WebSocketIdleTimeout; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+	return defaultWebSocketIdleTimeout
+}
+
+// connCounter counts the open connections of each key.
+type connCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// acquire counts a new connection for key, unless it already has max.
+func (c *connCounter) acquire(key string, max int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] >= max {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+func (c *connCounter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]--
+	if c.counts[key] <= 0 {
+		delete(c.counts, key)
+	}
+}
+
+// wsConnections holds the open WebSocket connections per key on this node.
+var wsConnections = &connCounter{counts: map[string]int64{}}
+
+// serveWebSocket sends the upgrade request to the upstream and, once it
+// switches protocols, tunnels the connection until either side closes it
+// or it is idle for longer than websocket_idle_timeout.
+func (p *ReverseProxy) serveWebSocket(w http.ResponseWriter, r *http.Request, start time.Time) {
+	logger := log.WithFields(logrus.Fields{
+		"prefix": "websocket",
+		"api_id": p.Spec.APIID,
+		"path":   r.URL.Path,
+	})
+
+	if session := ctxGetSession(r); session != nil && session.MaxWebSocketConnections > 0 {
+		key := ctxGetAuthToken(r)
+		if !wsConnections.acquire(key, session.MaxWebSocketConnections) {
+			logger.WithField("key", obfuscateKey(key)).Info("WebSocket connection limit reached")
+			abandonBreaker(r)
+			handleError(w, r, "WebSocket connection limit reached", http.StatusTooManyRequests)
+			return
+		}
+		defer wsConnections.release(key)
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		abandonBreaker(r)
+		handleError(w, r, "WebSockets are not supported on this connection", http.StatusBadRequest)
+		return
+	}
+
+	outReq := r.Clone(r.Context())
+	p.director(outReq)
+	appendForwardedFor(outReq)
+
+	upConn, err := p.dialUpstream(outReq.Context(), outReq.URL)
+	if err != nil {
+		p.errorHandler(w, r, err)
+		return
+	}
+	defer upConn.Close()
+
+	upConn.SetDeadline(time.Now().Add(webSocketIdleTimeout()))
+	if err := outReq.Write(upConn); err != nil {
+		p.errorHandler(w, r, err)
+		return
+	}
+	upReader := bufio.NewReaderSize(upConn, wsBufferSize)
+	res, err := http.ReadResponse(upReader, outReq)
+	if err != nil {
+		p.errorHandler(w, r, err)
+		return
+	}
+	p.modifyResponse(res)
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// the upstream refused the upgrade, pass its reply on
+		defer res.Body.Close()
+		for k, vv := range res.Header {
+			w.Header()[k] = vv
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		recordAnalytics(newAnalyticsRecord(p.Spec, r, res.StatusCode, start))
+		return
+	}
+
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		logger.Error("Couldn't hijack connection: ", err)
+		abandonBreaker(r)
+		return
+	}
+	defer clientConn.Close()
+	// drop the deadlines the server set for the request
+	clientConn.SetDeadline(time.Time{})
+	upConn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", res.Status)
+	res.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		logger.Error("Couldn't complete upgrade: ", err)
+		return
+	}
+
+	t := newWSTunnel(webSocketIdleTimeout())
+	in, out := t.run(clientConn, clientBuf.Reader, upConn, upReader)
+	logger.WithFields(logrus.Fields{
+		"frames_in":  in.frames,
+		"frames_out": out.frames,
+	}).Debug("WebSocket connection closed")
+
+	record := newAnalyticsRecord(p.Spec, r, http.StatusSwitchingProtocols, start)
+	record.Protocol = "websocket"
+	record.BytesIn, record.FramesIn = in.bytes, in.frames
+	record.BytesOut, record.FramesOut = out.bytes, out.frames
+	recordAnalytics(record)
+}
+
+// dialUpstream opens a connection to u with the proxy's dialer, adding TLS
+// for wss and https upstreams.
+func (p *ReverseProxy) dialUpstream(ctx context.Context, u *url.URL) (net.Conn, error) {
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := p.transport.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return conn, nil
+	}
+
+	tlsConf := &tls.Config{}
+	if p.transport.TLSClientConfig != nil {
+		tlsConf = p.transport.TLSClientConfig.Clone()
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = u.Hostname()
+	}
+	// the upgrade is an HTTP/1.1 mechanism
+	tlsConf.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, tlsConf)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// wsTunnel copies data both ways between the client and the upstream.
+type wsTunnel struct {
+	idle         time.Duration
+	lastActivity int64 // unix nanoseconds, accessed atomically
+}
+
+func newWSTunnel(idle time.Duration) *wsTunnel {
+	t := &wsTunnel{idle: idle}
+	t.touch()
+	return t
+}
+
+func (t *wsTunnel) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+func (t *wsTunnel) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+}
+
+// run tunnels until either side closes or the connection is idle, and
+// returns the counts of each direction.
+func (t *wsTunnel) run(client net.Conn, clientReader io.Reader, upstream net.Conn, upstreamReader io.Reader) (in, out *frameCounter) {
+	in, out = &frameCounter{}, &frameCounter{}
+	done := make(chan error, 2)
+	go func() { done <- t.pipe(upstream, client, clientReader, in) }()
+	go func() { done <- t.pipe(client, upstream, upstreamReader, out) }()
+
+	<-done
+	// unblock the other direction
+	client.Close()
+	upstream.Close()
+	<-done
+	return in, out
+}
+
+// pipe copies from src, read through srcReader, to dst until an error.
+// Read timeouts only end the copy once neither direction has seen any
+// traffic for the idle timeout.
+func (t *wsTunnel) pipe(dst net.Conn, src net.Conn, srcReader io.Reader, counter *frameCounter) error {
+	buf := make([]byte, wsBufferSize)
+	for {
+		src.SetReadDeadline(time.Now().Add(t.idle))
+		n, err := srcReader.Read(buf)
+		if n > 0 {
+			t.touch()
+			counter.observe(buf[:n])
+			dst.SetWriteDeadline(time.Now().Add(t.idle))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if t.idleFor() < t.idle {
+					continue
+				}
+				return errWebSocketIdle
+			}
+			return err
+		}
+	}
+}
+
+// frameCounter counts the bytes and WebSocket frames seen in a stream by
+// following the frame headers, without buffering the payloads.
+type frameCounter struct {
+	bytes  int64
+	frames int64
+
+	header    []byte // the part of the current frame header read so far
+	remaining uint64 // payload bytes left in the current frame
+}
+
+func (c *frameCounter) observe(p []byte) {
+	c.bytes += int64(len(p))
+	for len(p) > 0 {
+		if c.remaining > 0 {
+			n := uint64(len(p))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.remaining -= n
+			p = p[n:]
+			continue
+		}
+		c.header = append(c.header, p[0])
+		p = p[1:]
+		if size := frameHeaderSize(c.header); size > 0 && len(c.header) == size {
+			c.frames++
+			c.remaining = framePayloadLength(c.header)
+			c.header = c.header[:0]
+		}
+	}
+}
+
+// frameHeaderSize returns the size of the frame header starting with h, or
+// 0 if h is too short to tell.
+func frameHeaderSize(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+	return size
+}
+
+func framePayloadLength(h []byte) uint64 {
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(l)
+	}
+}
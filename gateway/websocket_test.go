@@ -0,0 +1,277 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/apidef"
+	"github.com/raspberry-gateway/raspberry/config"
+	"github.com/raspberry-gateway/raspberry/user"
+)
+
+// wsEchoUpstream accepts WebSocket upgrades and echoes everything it
+// receives back.
+func wsEchoUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+}
+
+// wsFrame returns a single masked text frame carrying payload.
+func wsFrame(payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// wsDial sends an upgrade request for path to addr and returns the
+// connection and the status of the response.
+func wsDial(t *testing.T, addr, path string, hdrs map[string]string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", path, addr)
+	for k, v := range hdrs {
+		fmt.Fprintf(conn, "%s: %s\r\n", k, v)
+	}
+	fmt.Fprint(conn, "\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res.StatusCode
+}
+
+func setWebSocketConfig(enabled bool, idleTimeout int) func() {
+	old := config.Global()
+	conf := old
+	conf.EnableAnalytics = true
+	conf.HttpServerOptions.EnableWebSockets = enabled
+	conf.HttpServerOptions.WebSocketIdleTimeout = idleTimeout
+	config.SetGlobal(conf)
+	return func() { config.SetGlobal(old) }
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	defer setWebSocketConfig(true, 0)()
+
+	upstream := wsEchoUpstream()
+	defer upstream.Close()
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseKeylessAccess = false
+		def.Auth.AuthHeaderName = "x-api-key"
+	})
+	gw := httptest.NewServer(processSpec(spec))
+	defer gw.Close()
+	addr := gw.Listener.Addr().String()
+
+	noKey, _, code := wsDial(t, addr, "/ws", nil)
+	noKey.Close()
+	if code != http.StatusUnauthorized {
+		t.Fatalf("want upgrade without a key rejected with 401, got %d", code)
+	}
+
+	key := createSession(t, &user.SessionState{MaxWebSocketConnections: 1})
+	hdrs := map[string]string{"x-api-key": key}
+	conn, br, code := wsDial(t, addr, "/ws", hdrs)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, got %d", code)
+	}
+
+	second, _, code := wsDial(t, addr, "/ws", hdrs)
+	second.Close()
+	if code != http.StatusTooManyRequests {
+		t.Errorf("want second connection over the key's limit rejected with 429, got %d", code)
+	}
+
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+	frames := append(wsFrame("hello"), wsFrame("world")...)
+	conn.Write(frames)
+	echo := make([]byte, len(frames))
+	if _, err := io.ReadFull(br, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(frames) {
+		t.Errorf("echo doesn't match what was sent")
+	}
+	conn.Close()
+
+	record := waitForAnalyticsRecord(t)
+	if record.Protocol != "websocket" || record.ResponseCode != http.StatusSwitchingProtocols {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.FramesIn != 2 || record.FramesOut != 2 || record.BytesIn != int64(len(frames)) || record.BytesOut != int64(len(frames)) {
+		t.Errorf("want 2 frames and %d bytes each way, got %+v", len(frames), record)
+	}
+
+	// the connection is released once closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, _, code := wsDial(t, addr, "/ws", hdrs)
+		conn.Close()
+		if code == http.StatusSwitchingProtocols {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection limit not released, got %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketRejectedHalfOpen(t *testing.T) {
+	defer setWebSocketConfig(true, 0)()
+
+	upstream := wsEchoUpstream()
+	defer upstream.Close()
+	spec := buildSpec(t, upstream.URL, func(def *apidef.APIDefinition) {
+		def.UseKeylessAccess = false
+		def.Auth.AuthHeaderName = "x-api-key"
+		def.CircuitBreakers = []apidef.CircuitBreakerMeta{{
+			Path:                 "/",
+			ThresholdPercent:     1,
+			Samples:              1,
+			ReturnToServiceAfter: 60,
+		}}
+	})
+	handler := processSpec(spec)
+	gw := httptest.NewServer(handler)
+	defer gw.Close()
+	addr := gw.Listener.Addr().String()
+	cb := spec.circuitBreakers[0]
+	halfOpen := func() {
+		cb.record(true)
+		cb.openedAt = time.Now().Add(-time.Hour)
+	}
+
+	key := createSession(t, &user.SessionState{MaxWebSocketConnections: 1})
+	hdrs := map[string]string{"x-api-key": key}
+	conn, _, code := wsDial(t, addr, "/ws", hdrs)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, got %d", code)
+	}
+	defer conn.Close()
+
+	halfOpen()
+	second, _, code := wsDial(t, addr, "/ws", hdrs)
+	second.Close()
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("want the connection over the limit rejected with 429, got %d", code)
+	}
+	if !cb.allow() {
+		t.Error("want another half-open request let through after a rejected upgrade")
+	}
+	cb.abandon()
+
+	// a recorder can't be hijacked, like an HTTP/2 connection
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("x-api-key", createSession(t, &user.SessionState{}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("want an upgrade that can't be hijacked rejected with 400, got %d", rec.Code)
+	}
+	if !cb.allow() {
+		t.Error("want another half-open request let through after an upgrade that can't be hijacked")
+	}
+}
+
+func waitForAnalyticsRecord(t *testing.T) AnalyticsRecord {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if data := analytics.Store.GetAndDeleteSet(analyticsKeyName); len(data) > 0 {
+			var record AnalyticsRecord
+			if err := json.Unmarshal([]byte(data[len(data)-1]), &record); err != nil {
+				t.Fatal(err)
+			}
+			return record
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no analytics record written")
+	return AnalyticsRecord{}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	defer setWebSocketConfig(true, 1)()
+
+	upstream := wsEchoUpstream()
+	defer upstream.Close()
+	gw := httptest.NewServer(processSpec(buildSpec(t, upstream.URL)))
+	defer gw.Close()
+
+	conn, br, code := wsDial(t, gw.Listener.Addr().String(), "/ws", nil)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, got %d", code)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("want idle connection closed by the gateway, got %v", err)
+	}
+}
+
+func TestWebSocketDisabled(t *testing.T) {
+	defer setWebSocketConfig(false, 0)()
+
+	upstream := wsEchoUpstream()
+	defer upstream.Close()
+	gw := httptest.NewServer(processSpec(buildSpec(t, upstream.URL)))
+	defer gw.Close()
+
+	conn, _, code := wsDial(t, gw.Listener.Addr().String(), "/ws", nil)
+	conn.Close()
+	if code != http.StatusBadRequest {
+		t.Errorf("want 400 with WebSockets disabled, got %d", code)
+	}
+}
+
+func TestFrameCounter(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	stream := append(wsFrame("a"), wsFrame("")...)
+	// a frame with a 16-bit length, unmasked
+	stream = append(stream, 0x82, 126, 0x01, 0x2c)
+	stream = append(stream, long...)
+
+	// feed it in awkward pieces to split headers
+	c := &frameCounter{}
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		c.observe(stream[i:end])
+	}
+	if c.frames != 3 || c.bytes != int64(len(stream)) || c.remaining != 0 {
+		t.Errorf("want 3 frames and %d bytes, got %d frames, %d bytes", len(stream), c.frames, c.bytes)
+	}
+}
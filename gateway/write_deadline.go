@@ -0,0 +1,15 @@
+//go:build go1.20
+// +build go1.20
+
+package gateway
+
+import (
+	"net/http"
+	"time"
+)
+
+// extendWriteDeadline gives the response another timeout to be written
+// before the server gives up on the client.
+func extendWriteDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+}
@@ -0,0 +1,22 @@
+//go:build !go1.20
+// +build !go1.20
+
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// extendWriteDeadline gives the response another timeout to be written
+// before the server gives up on the client. Only HTTP/1 connections can be
+// extended, HTTP/2 streams share their connection with other requests.
+func extendWriteDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	if r.ProtoMajor != 1 {
+		return
+	}
+	if conn, ok := r.Context().Value(ctxConn).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
@@ -14,7 +14,10 @@ const (
 	Pragma                  = "Pragma"
 	Expires                 = "Expires"
 	Connection              = "Connection"
+	Upgrade                 = "Upgrade"
 	WWWAuthenticate         = "WWW-Authenticate"
+	Forwarded               = "Forwarded"
+	Via                     = "Via"
 )
 
 // Definitions of request content.
@@ -27,11 +30,12 @@ const (
 // keys of request Context.
 const (
 	XRealIP                 = "X-Real-IP"
-	XForwardFor             = "X-Forward-For"
+	XForwardFor             = "X-Forwarded-For"
 	XAuthResult             = "X-Auth-Result"
 	XSessionAlias           = "X-Session-Alias"
 	XInitialURI             = "X-Initial-URI"
-	XForwardProto           = "X-Forward-Proto"
+	XForwardProto           = "X-Forwarded-Proto"
+	XForwardHost            = "X-Forwarded-Host"
 	XContentTypeOptions     = "X-Content-Type-Options"
 	XXSSProtection          = "X-XSS-Protection"
 	XFrameOptions           = "X-Frame-Options"
@@ -40,6 +44,8 @@ const (
 	XRaspberryHostname      = "x-respberry-hostname"
 	XGenerator              = "X-Generator"
 	XRaspberryAuthorization = "X-Raspberry-Authorization"
+	XSSLClientSubject       = "X-SSL-Client-Subject"
+	XSSLClientFingerprint   = "X-SSL-Client-Fingerprint"
 )
 
 // Gateway's custom response headers
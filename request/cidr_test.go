@@ -0,0 +1,26 @@
+package request
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false,
+		"2001:db8::7": true, "::1": true, "::2": false,
+	} {
+		if got := ContainsIP(nets, net.ParseIP(ip)); got != want {
+			t.Errorf("%s: want %v, got %v", ip, want, got)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := ParseCIDRs([]string{bad}); err == nil {
+			t.Errorf("want an error for %q", bad)
+		}
+	}
+}
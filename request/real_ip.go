@@ -4,34 +4,172 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
 	"github.com/raspberry-gateway/raspberry/headers"
 )
 
+// DefaultClientIPHeaders are the headers the client IP is read from when
+// none are configured, in order of precedence.
+var DefaultClientIPHeaders = []string{headers.XRealIP, headers.XForwardFor, headers.Forwarded}
+
+// ProxySettings are the trusted proxies and the headers they set, as
+// parsed by ParseTrustedProxies.
+type ProxySettings struct {
+	trusted []*net.IPNet
+	headers []string
+}
+
+var settings atomic.Value
+
+func init() {
+	settings.Store(ProxySettings{headers: DefaultClientIPHeaders})
+}
+
+// SetTrustedProxies configures the peers whose headers are believed, given
+// as CIDRs or IP addresses, and the headers the client IP is read from in
+// order of precedence. X-Forwarded-For and Forwarded list every hop, other
+// headers hold a single address. Empty headers mean DefaultClientIPHeaders.
+func SetTrustedProxies(trusted, ipHeaders []string) error {
+	s, err := ParseTrustedProxies(trusted, ipHeaders)
+	if err != nil {
+		return err
+	}
+	ApplyTrustedProxies(s)
+	return nil
+}
+
+// ParseTrustedProxies returns the settings SetTrustedProxies would apply,
+// without applying them.
+func ParseTrustedProxies(trusted, ipHeaders []string) (ProxySettings, error) {
+	nets, err := ParseCIDRs(trusted)
+	if err != nil {
+		return ProxySettings{}, err
+	}
+	if len(ipHeaders) == 0 {
+		ipHeaders = DefaultClientIPHeaders
+	}
+	canonical := make([]string, len(ipHeaders))
+	for i, h := range ipHeaders {
+		canonical[i] = http.CanonicalHeaderKey(strings.TrimSpace(h))
+	}
+	return ProxySettings{trusted: nets, headers: canonical}, nil
+}
+
+// ApplyTrustedProxies makes s the settings client IPs are resolved with.
+func ApplyTrustedProxies(s ProxySettings) {
+	settings.Store(s)
+}
+
 // RealIP takes a request object, and returns the real Client IP address.
+// Headers are only believed when the peer is a trusted proxy. Lists of
+// hops are walked from the right, the client is the first address that
+// isn't a trusted proxy, as the ones before it could have been made up.
 func RealIP(r *http.Request) string {
 	if contextIP := r.Context().Value(headers.RemoteAddr); contextIP != nil {
 		return contextIP.(string)
 	}
 
-	if realIP := r.Header.Get(headers.XRealIP); realIP != "" {
-		return realIP
+	// From net/http.Request.RemoteAddr:
+	//		The HTTP server in this package sets RemoteAddr to an
+	//		"IP:port" address before invoking a handler.
+	// So we can ignore the case of the port missing.
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	s := settings.Load().(ProxySettings)
+	if len(s.trusted) == 0 || !s.isTrusted(peer) {
+		return peer
+	}
+
+	for _, name := range s.headers {
+		values := r.Header[name]
+		if len(values) == 0 {
+			continue
+		}
+		var hops []string
+		switch name {
+		case headers.XForwardFor:
+			hops = splitList(values)
+		case headers.Forwarded:
+			hops = forwardedFor(values)
+		default:
+			hops = values[len(values)-1:]
+		}
+		if ip := s.client(hops); ip != "" {
+			return ip
+		}
 	}
+	return peer
+}
 
-	if fw := r.Header.Get(headers.XForwardFor); fw != "" {
-		// X-Formarded-For has no port
-		if i := strings.IndexByte(fw, ','); i >= 0 {
+func (s ProxySettings) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && ContainsIP(s.trusted, parsed)
+}
 
-			return fw[:i]
+// client walks hops from the right and returns the first address that
+// isn't a trusted proxy, or the left-most one if they all are. The walk
+// stops at the first value that isn't an address, returning the hop
+// after it, as nothing before it can be relied on.
+func (s ProxySettings) client(hops []string) string {
+	last := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == "" {
+			return last
+		}
+		if !s.isTrusted(ip) {
+			return ip
 		}
+		last = ip
+	}
+	return last
+}
 
-		return fw
+// splitList splits comma separated header values into their elements.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			list = append(list, strings.TrimSpace(e))
+		}
 	}
+	return list
+}
 
-	// From net/http.Request.RemoteAddr:
-	//		The HTTP server in this package sets RemoteAddr to an
-	//		"IP:port" address before invoking a handler.
-	// So we can ignore the case of the port missing.
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return host
+// forwardedFor returns the for= parameter of each element of Forwarded
+// header values, such as
+// `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		node := ""
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				node = strings.Trim(kv[1], `"`)
+			}
+		}
+		hops = append(hops, node)
+	}
+	return hops
+}
+
+// parseHop returns the IP address in a hop, which may have a port and
+// brackets around IPv6 addresses. Obfuscated and unknown hops give "".
+func parseHop(hop string) string {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+	}
+	if strings.HasPrefix(hop, "[") && strings.HasSuffix(hop, "]") {
+		if ip := net.ParseIP(hop[1 : len(hop)-1]); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
 }
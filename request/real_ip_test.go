@@ -12,26 +12,66 @@ var ipHeaderTests = []struct {
 	remoteAddr string
 	key        string
 	value      string
+	trusted    []string
+	order      []string
 	expected   string
 	comment    string
 }{
-	{remoteAddr: "192.168.1.10:8080", key: "X-Real-IP", value: "192.168.1.1", expected: "192.168.1.1", comment: "X-Real-IP"},
-	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "192.168.1.2", expected: "192.168.1.2", comment: "X-Forwarded-For"},
-	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "192.168.1.3, 192.168.1.2, 192.168.1.1", expected: "192.168.1.3", comment: "X-Forwarded-For (multiple)"},
+	{remoteAddr: "192.168.1.10:8080", key: "X-Real-IP", value: "192.168.1.1", trusted: lan, expected: "192.168.1.1", comment: "X-Real-IP"},
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "192.168.1.2", trusted: lan, expected: "192.168.1.2", comment: "X-Forwarded-For"},
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "192.168.1.3, 192.168.1.2, 192.168.1.1", trusted: lan, expected: "192.168.1.3", comment: "X-Forwarded-For (multiple)"},
 	{remoteAddr: "192.168.1.10:8080", expected: "192.168.1.10", comment: "RemoteAddr"},
+
+	// headers are ignored unless the peer is a trusted proxy
+	{remoteAddr: "192.168.1.10:8080", key: "X-Real-IP", value: "192.168.1.1", expected: "192.168.1.10", comment: "X-Real-IP (no trusted proxies)"},
+	{remoteAddr: "203.0.113.9:8080", key: "X-Real-IP", value: "192.168.1.1", trusted: lan, expected: "203.0.113.9", comment: "X-Real-IP (untrusted peer)"},
+	{remoteAddr: "203.0.113.9:8080", key: "X-Forwarded-For", value: "192.168.1.2", trusted: lan, expected: "203.0.113.9", comment: "X-Forwarded-For (untrusted peer)"},
+
+	// the client is the right-most address that isn't a trusted proxy
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "6.6.6.6, 203.0.113.9, 192.168.1.2", trusted: lan, expected: "203.0.113.9", comment: "X-Forwarded-For (spoofed)"},
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "203.0.113.9", trusted: []string{"192.168.1.10"}, expected: "203.0.113.9", comment: "X-Forwarded-For (single proxy)"},
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "garbage, 192.168.1.2", trusted: lan, expected: "192.168.1.2", comment: "X-Forwarded-For (invalid hop)"},
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "garbage", trusted: lan, expected: "192.168.1.10", comment: "X-Forwarded-For (invalid)"},
+	{remoteAddr: "[2001:db8::1]:8080", key: "X-Forwarded-For", value: "2001:db8:cafe::17, 2001:db8::2", trusted: []string{"2001:db8::/64"}, expected: "2001:db8:cafe::17", comment: "X-Forwarded-For (IPv6)"},
+
+	// RFC 7239
+	{remoteAddr: "192.168.1.10:8080", key: "Forwarded", value: "for=203.0.113.9;proto=https;by=192.168.1.10", trusted: lan, expected: "203.0.113.9", comment: "Forwarded"},
+	{remoteAddr: "192.168.1.10:8080", key: "Forwarded", value: `for=6.6.6.6, For="[2001:db8:cafe::17]:4711", for=192.168.1.2`, trusted: lan, expected: "2001:db8:cafe::17", comment: "Forwarded (multiple)"},
+	{remoteAddr: "192.168.1.10:8080", key: "Forwarded", value: "for=203.0.113.9:8443", trusted: lan, expected: "203.0.113.9", comment: "Forwarded (port)"},
+	{remoteAddr: "192.168.1.10:8080", key: "Forwarded", value: "for=unknown, for=192.168.1.2", trusted: lan, expected: "192.168.1.2", comment: "Forwarded (unknown)"},
+	{remoteAddr: "192.168.1.10:8080", key: "Forwarded", value: "for=_hidden", trusted: lan, expected: "192.168.1.10", comment: "Forwarded (obfuscated)"},
+
+	// header precedence
+	{remoteAddr: "192.168.1.10:8080", key: "X-Forwarded-For", value: "203.0.113.9", trusted: lan, order: []string{"forwarded"}, expected: "192.168.1.10", comment: "X-Forwarded-For (not configured)"},
+	{remoteAddr: "192.168.1.10:8080", key: "CF-Connecting-IP", value: "203.0.113.9", trusted: lan, order: []string{"cf-connecting-ip"}, expected: "203.0.113.9", comment: "custom header"},
 }
 
+// lan is the trusted proxy network of the tests.
+var lan = []string{"192.168.1.0/24"}
+
 var testURL = "http://xyz.com"
 
+// trustProxies configures RealIP, returning a func restoring the defaults.
+func trustProxies(tb testing.TB, trusted, order []string) func() {
+	if err := SetTrustedProxies(trusted, order); err != nil {
+		tb.Fatal(err)
+	}
+	return func() { SetTrustedProxies(nil, nil) }
+}
+
 func TestRealIP(t *testing.T) {
 	for _, test := range ipHeaderTests {
 		t.Log(test.comment)
 
 		r, _ := http.NewRequest(http.MethodGet, testURL+":8080", nil)
-		r.Header.Set(test.key, test.value)
+		if test.key != "" {
+			r.Header.Set(test.key, test.value)
+		}
 		r.RemoteAddr = test.remoteAddr
 
+		restore := trustProxies(t, test.trusted, test.order)
 		ip := RealIP(r)
+		restore()
 
 		if ip != test.expected {
 			t.Errorf("\texpected %s got %s", test.expected, ip)
@@ -50,11 +90,52 @@ func TestRealIP(t *testing.T) {
 	}
 }
 
+func TestRealIPHeaderPrecedence(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, testURL+":8080", nil)
+	r.RemoteAddr = "192.168.1.10:8080"
+	r.Header.Set(headers.XRealIP, "203.0.113.1")
+	r.Header.Set(headers.XForwardFor, "203.0.113.2")
+	r.Header.Set(headers.Forwarded, "for=203.0.113.3")
+
+	for _, test := range []struct {
+		order    []string
+		expected string
+	}{
+		{nil, "203.0.113.1"},
+		{[]string{"Forwarded", "X-Forwarded-For"}, "203.0.113.3"},
+		{[]string{"x-forwarded-for", "x-real-ip"}, "203.0.113.2"},
+	} {
+		restore := trustProxies(t, lan, test.order)
+		if ip := RealIP(r); ip != test.expected {
+			t.Errorf("%v: expected %s got %s", test.order, test.expected, ip)
+		}
+		restore()
+	}
+}
+
+func TestRealIPForwardedForLines(t *testing.T) {
+	defer trustProxies(t, lan, nil)()
+
+	r, _ := http.NewRequest(http.MethodGet, testURL+":8080", nil)
+	r.RemoteAddr = "192.168.1.10:8080"
+	r.Header.Add(headers.XForwardFor, "6.6.6.6")
+	r.Header.Add(headers.XForwardFor, "203.0.113.9, 192.168.1.3")
+	if ip := RealIP(r); ip != "203.0.113.9" {
+		t.Errorf("expected %s got %s", "203.0.113.9", ip)
+	}
+}
+
+func TestSetTrustedProxiesInvalid(t *testing.T) {
+	if err := SetTrustedProxies([]string{"not-a-cidr"}, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
+
 func BenchmarkRealIP_RemoteAddr(b *testing.B) {
 	b.ReportAllocs()
 
 	r, _ := http.NewRequest(http.MethodGet, testURL+":8080", nil)
-	r.RemoteAddr = testURL + ":8081"
+	r.RemoteAddr = "192.168.1.10:8081"
 
 	for n := 0; n < b.N; n++ {
 		ip := RealIP(r)
@@ -66,8 +147,10 @@ func BenchmarkRealIP_RemoteAddr(b *testing.B) {
 
 func BenchmarkRealIP_ForwardedFor(b *testing.B) {
 	b.ReportAllocs()
+	defer trustProxies(b, lan, nil)()
 
 	r, _ := http.NewRequest(http.MethodGet, testURL+":8080", nil)
+	r.RemoteAddr = "192.168.1.10:8081"
 	r.Header.Set(headers.XForwardFor, "192.168.1.3, 192.168.1.2, 192.168.1.1")
 
 	for n := 0; n < b.N; n++ {
@@ -80,8 +163,10 @@ func BenchmarkRealIP_ForwardedFor(b *testing.B) {
 
 func BenchmarkRealIP_RealIP(b *testing.B) {
 	b.ReportAllocs()
+	defer trustProxies(b, lan, nil)()
 
 	r, _ := http.NewRequest(http.MethodGet, testURL+":8080", nil)
+	r.RemoteAddr = "192.168.1.10:8081"
 	r.Header.Set(headers.XRealIP, "192.168.1.10")
 
 	for n := 0; n < b.N; n++ {
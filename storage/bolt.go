@@ -0,0 +1,686 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultBoltPath          = "raspberry.db"
+	defaultBoltSweepInterval = time.Minute
+	// boltOpenTimeout is how long to wait for another process to release
+	// the file.
+	boltOpenTimeout = time.Second
+	// boltSweepBatch is how many expired keys are deleted per transaction.
+	boltSweepBatch = 1000
+)
+
+// The buckets of a storage file. Items hold the kind and expiry of each
+// key and the value of strings, collections have their members in a
+// bucket of their own, and the expiry index orders the keys that expire by
+// when they do.
+var (
+	boltData    = []byte("data")
+	boltMembers = []byte("members")
+	boltExpiry  = []byte("expiry")
+)
+
+// The kinds of value a key holds, writing a kind of value to a key holding
+// another replaces it.
+const (
+	boltString byte = iota
+	boltList
+	boltSet
+	boltSortedSet
+)
+
+var (
+	boltMu    sync.Mutex
+	boltFiles = make(map[string]*boltFile)
+)
+
+// boltFile is a storage file shared by the handlers of a configuration, as
+// it can only be opened once, and the sweeper of its expired keys.
+type boltFile struct {
+	db   *bolt.DB
+	done chan struct{}
+}
+
+// boltDB returns the database in the file of conf, opened on first use.
+func boltDB(conf config.StorageOptionsConf) (*bolt.DB, error) {
+	path := conf.Path
+	if path == "" {
+		path = defaultBoltPath
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	if f, ok := boltFiles[abs]; ok {
+		return f.db, nil
+	}
+	db, err := bolt.Open(abs, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("storage file %s is in use by another process", abs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open storage file %s: %v", abs, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltData, boltMembers, boltExpiry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	interval := defaultBoltSweepInterval
+	if conf.SweepInterval > 0 {
+		interval = time.Duration(conf.SweepInterval) * time.Second
+	}
+	f := &boltFile{db: db, done: make(chan struct{})}
+	boltFiles[abs] = f
+	go f.sweep(interval)
+	return db, nil
+}
+
+// OpenFiles returns the paths of the storage files open in this process,
+// which no other process can open until they are closed.
+func OpenFiles() []string {
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	paths := make([]string, 0, len(boltFiles))
+	for path := range boltFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// sweep deletes the expired keys every interval until the file is closed.
+// They are already hidden, this gets their space back.
+// CloseAll closes the storage files open in this process, releasing them to
+// other processes. Handlers using them fail afterwards.
+func CloseAll() error {
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	var firstErr error
+	for path, f := range boltFiles {
+		if err := f.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(boltFiles, path)
+	}
+	return firstErr
+}
+
+func (f *boltFile) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-ticker.C:
+			if _, err := sweepBolt(f.db, now); err != nil {
+				log.WithField("op", "sweep").Error("Storage file error: ", err)
+			}
+		}
+	}
+}
+
+func (f *boltFile) close() error {
+	close(f.done)
+	return f.db.Close()
+}
+
+// sweepBolt deletes the keys of db expired by now, returning how many.
+func sweepBolt(db *bolt.DB, now time.Time) (int, error) {
+	deadline := now.UnixNano()
+	total := 0
+	for {
+		var keys [][]byte
+		err := db.Update(func(tx *bolt.Tx) error {
+			keys = keys[:0]
+			c := tx.Bucket(boltExpiry).Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < boltSweepBatch; k, _ = c.Next() {
+				if int64(binary.BigEndian.Uint64(k)) > deadline {
+					break
+				}
+				keys = append(keys, append([]byte(nil), k[8:]...))
+			}
+			// not while iterating, which deleting would upset
+			for _, key := range keys {
+				if err := deleteBoltItem(tx, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += len(keys)
+		if len(keys) < boltSweepBatch {
+			return total, nil
+		}
+	}
+}
+
+// boltItem is the kind, expiry and value of a key, encoded as the kind
+// byte, the expiry in Unix nanoseconds (zero for none) and the value.
+type boltItem struct {
+	kind    byte
+	expires int64
+	value   []byte
+}
+
+func (i boltItem) expired(now time.Time) bool {
+	return i.expires != 0 && i.expires <= now.UnixNano()
+}
+
+func (i boltItem) encode() []byte {
+	b := make([]byte, 9+len(i.value))
+	b[0] = i.kind
+	binary.BigEndian.PutUint64(b[1:9], uint64(i.expires))
+	copy(b[9:], i.value)
+	return b
+}
+
+func decodeBoltItem(b []byte) (boltItem, bool) {
+	if len(b) < 9 {
+		return boltItem{}, false
+	}
+	return boltItem{kind: b[0], expires: int64(binary.BigEndian.Uint64(b[1:9])), value: b[9:]}, true
+}
+
+// expiryKey is the key of the expiry index for key expiring at expires.
+func expiryKey(expires int64, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(expires))
+	copy(k[8:], key)
+	return k
+}
+
+// getBoltItem returns the live item stored under key. Its value is only
+// valid during tx.
+func getBoltItem(tx *bolt.Tx, key []byte, now time.Time) (boltItem, bool) {
+	item, ok := decodeBoltItem(tx.Bucket(boltData).Get(key))
+	if !ok || item.expired(now) {
+		return boltItem{}, false
+	}
+	return item, true
+}
+
+// putBoltItem stores item under key, keeping the expiry index in step.
+func putBoltItem(tx *bolt.Tx, key []byte, item boltItem) error {
+	data, expiry := tx.Bucket(boltData), tx.Bucket(boltExpiry)
+	if old, ok := decodeBoltItem(data.Get(key)); ok && old.expires != 0 && old.expires != item.expires {
+		if err := expiry.Delete(expiryKey(old.expires, key)); err != nil {
+			return err
+		}
+	}
+	if item.expires != 0 {
+		if err := expiry.Put(expiryKey(item.expires, key), nil); err != nil {
+			return err
+		}
+	}
+	return data.Put(key, item.encode())
+}
+
+// deleteBoltItem removes key with its members and expiry, whether it has
+// expired or not.
+func deleteBoltItem(tx *bolt.Tx, key []byte) error {
+	data := tx.Bucket(boltData)
+	item, ok := decodeBoltItem(data.Get(key))
+	if !ok {
+		return nil
+	}
+	if item.expires != 0 {
+		if err := tx.Bucket(boltExpiry).Delete(expiryKey(item.expires, key)); err != nil {
+			return err
+		}
+	}
+	if item.kind != boltString {
+		if err := tx.Bucket(boltMembers).DeleteBucket(key); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return data.Delete(key)
+}
+
+// boltCollection returns the members of the collection of kind stored
+// under key, creating it when there is none.
+func boltCollection(tx *bolt.Tx, key []byte, kind byte, now time.Time) (*bolt.Bucket, error) {
+	if item, ok := getBoltItem(tx, key, now); !ok || item.kind != kind {
+		if err := deleteBoltItem(tx, key); err != nil {
+			return nil, err
+		}
+		if err := putBoltItem(tx, key, boltItem{kind: kind}); err != nil {
+			return nil, err
+		}
+	}
+	return tx.Bucket(boltMembers).CreateBucketIfNotExists(key)
+}
+
+// boltMembersOf returns the members of the collection of kind stored under
+// key, nil when there is none.
+func boltMembersOf(tx *bolt.Tx, key []byte, kind byte, now time.Time) *bolt.Bucket {
+	if item, ok := getBoltItem(tx, key, now); !ok || item.kind != kind {
+		return nil
+	}
+	return tx.Bucket(boltMembers).Bucket(key)
+}
+
+// BoltStorageManager is a Handler keeping keys in a file, so that they
+// survive restarts of single node setups without a Redis server.
+type BoltStorageManager struct {
+	KeyPrefix string
+
+	db *bolt.DB
+}
+
+// NewBoltStorageManager returns a BoltStorageManager using db.
+func NewBoltStorageManager(db *bolt.DB, keyPrefix string) *BoltStorageManager {
+	return &BoltStorageManager{KeyPrefix: keyPrefix, db: db}
+}
+
+func (b *BoltStorageManager) fixKey(keyName string) []byte {
+	return []byte(b.KeyPrefix + keyName)
+}
+
+func (b *BoltStorageManager) cleanKey(key []byte) string {
+	return strings.TrimPrefix(string(key), b.KeyPrefix)
+}
+
+func (b *BoltStorageManager) logError(op string, err error) {
+	log.WithField("op", op).Error("Storage file error: ", err)
+}
+
+// GetKey will retrieve a key from the store
+func (b *BoltStorageManager) GetKey(keyName string) (string, error) {
+	var value string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		item, ok := getBoltItem(tx, b.fixKey(keyName), time.Now())
+		if !ok {
+			return ErrKeyNotFound
+		}
+		value = string(item.value)
+		return nil
+	})
+	return value, err
+}
+
+// SetKey will create (or update) a key value in the store, a timeout of
+// zero or less means the key never expires
+func (b *BoltStorageManager) SetKey(keyName, session string, timeout int64) error {
+	item := boltItem{kind: boltString, value: []byte(session)}
+	if timeout > 0 {
+		item.expires = time.Now().Add(time.Duration(timeout) * time.Second).UnixNano()
+	}
+	key := b.fixKey(keyName)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteBoltItem(tx, key); err != nil {
+			return err
+		}
+		return putBoltItem(tx, key, item)
+	})
+	if err != nil {
+		b.logError("set", err)
+	}
+	return err
+}
+
+// GetExp returns the seconds until keyName expires, -1 if it never does
+func (b *BoltStorageManager) GetExp(keyName string) (int64, error) {
+	var ttl int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		item, ok := getBoltItem(tx, b.fixKey(keyName), now)
+		switch {
+		case !ok:
+			return ErrKeyNotFound
+		case item.expires == 0:
+			ttl = -1
+		default:
+			ttl = int64(time.Duration(item.expires-now.UnixNano()) / time.Second)
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// SetExp sets keyName to expire in timeout seconds, or never
+func (b *BoltStorageManager) SetExp(keyName string, timeout int64) error {
+	key := b.fixKey(keyName)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		item, ok := getBoltItem(tx, key, now)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		item.expires = 0
+		if timeout > 0 {
+			item.expires = now.Add(time.Duration(timeout) * time.Second).UnixNano()
+		}
+		return putBoltItem(tx, key, item)
+	})
+}
+
+// GetKeys will return all keys according to the filter (filter is a prefix - e.g. raspberry.keys.*)
+func (b *BoltStorageManager) GetKeys(filter string) []string {
+	prefix := b.fixKey(strings.TrimSuffix(filter, "*"))
+	keys := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		c := tx.Bucket(boltData).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if item, ok := decodeBoltItem(v); ok && !item.expired(now) {
+				keys = append(keys, b.cleanKey(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.logError("keys", err)
+	}
+	return keys
+}
+
+// DeleteKey will remove a key from the store
+func (b *BoltStorageManager) DeleteKey(keyName string) bool {
+	return b.DeleteKeys([]string{keyName}) > 0
+}
+
+// DeleteKeys removes keyNames from the store, returning how many there were
+func (b *BoltStorageManager) DeleteKeys(keyNames []string) int64 {
+	var deleted int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		deleted = 0
+		for _, keyName := range keyNames {
+			key := b.fixKey(keyName)
+			if _, ok := getBoltItem(tx, key, now); ok {
+				deleted++
+			}
+			if err := deleteBoltItem(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.logError("delete", err)
+		return 0
+	}
+	return deleted
+}
+
+// GetMultiKey returns the values of keyNames in order, with an empty value
+// for the missing ones
+func (b *BoltStorageManager) GetMultiKey(keyNames []string) ([]string, error) {
+	values := make([]string, len(keyNames))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for i, keyName := range keyNames {
+			if item, ok := getBoltItem(tx, b.fixKey(keyName), now); ok {
+				values[i] = string(item.value)
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+// IncrementWithExpire will increment a key, the expiry is only set when
+// the key is created so the counter works as a fixed window. Concurrent
+// increments are written together.
+func (b *BoltStorageManager) IncrementWithExpire(keyName string, expire int64) int64 {
+	key := b.fixKey(keyName)
+	var val int64
+	err := b.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		item, ok := getBoltItem(tx, key, now)
+		if !ok || item.kind != boltString {
+			if err := deleteBoltItem(tx, key); err != nil {
+				return err
+			}
+			item = boltItem{kind: boltString}
+			if expire > 0 {
+				item.expires = now.Add(time.Duration(expire) * time.Second).UnixNano()
+			}
+		}
+		val, _ = strconv.ParseInt(string(item.value), 10, 64)
+		val++
+		item.value = []byte(strconv.FormatInt(val, 10))
+		return putBoltItem(tx, key, item)
+	})
+	if err != nil {
+		b.logError("incr", err)
+		return 0
+	}
+	return val
+}
+
+// AppendToSet appends value to the list stored under keyName. Concurrent
+// appends are written together.
+func (b *BoltStorageManager) AppendToSet(keyName, value string) {
+	key := b.fixKey(keyName)
+	err := b.db.Batch(func(tx *bolt.Tx) error {
+		list, err := boltCollection(tx, key, boltList, time.Now())
+		if err != nil {
+			return err
+		}
+		seq, err := list.NextSequence()
+		if err != nil {
+			return err
+		}
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, seq)
+		return list.Put(id, []byte(value))
+	})
+	if err != nil {
+		b.logError("append", err)
+	}
+}
+
+// GetAndDeleteSet returns the list stored under keyName and removes it
+func (b *BoltStorageManager) GetAndDeleteSet(keyName string) []string {
+	key := b.fixKey(keyName)
+	var values []string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		values = nil
+		if list := boltMembersOf(tx, key, boltList, time.Now()); list != nil {
+			list.ForEach(func(_, v []byte) error {
+				values = append(values, string(v))
+				return nil
+			})
+		}
+		return deleteBoltItem(tx, key)
+	})
+	if err != nil {
+		b.logError("get and delete", err)
+		return nil
+	}
+	return values
+}
+
+// AddToSet adds value to the set stored under keyName
+func (b *BoltStorageManager) AddToSet(keyName, value string) {
+	key := b.fixKey(keyName)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		set, err := boltCollection(tx, key, boltSet, time.Now())
+		if err != nil {
+			return err
+		}
+		return set.Put([]byte(value), nil)
+	})
+	if err != nil {
+		b.logError("add to set", err)
+	}
+}
+
+// GetSet returns the members of the set stored under keyName
+func (b *BoltStorageManager) GetSet(keyName string) ([]string, error) {
+	members := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		set := boltMembersOf(tx, b.fixKey(keyName), boltSet, time.Now())
+		if set == nil {
+			return nil
+		}
+		return set.ForEach(func(k, _ []byte) error {
+			members = append(members, string(k))
+			return nil
+		})
+	})
+	return members, err
+}
+
+// RemoveFromSet removes value from the set stored under keyName
+func (b *BoltStorageManager) RemoveFromSet(keyName, value string) {
+	key := b.fixKey(keyName)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		set := boltMembersOf(tx, key, boltSet, time.Now())
+		if set == nil {
+			return nil
+		}
+		if err := set.Delete([]byte(value)); err != nil {
+			return err
+		}
+		if k, _ := set.Cursor().First(); k == nil {
+			return deleteBoltItem(tx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		b.logError("remove from set", err)
+	}
+}
+
+// AddToSortedSet adds value with score to the sorted set stored under
+// keyName, updating its score if it is already there
+func (b *BoltStorageManager) AddToSortedSet(keyName, value string, score float64) {
+	key := b.fixKey(keyName)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		zset, err := boltCollection(tx, key, boltSortedSet, time.Now())
+		if err != nil {
+			return err
+		}
+		s := make([]byte, 8)
+		binary.BigEndian.PutUint64(s, math.Float64bits(score))
+		return zset.Put([]byte(value), s)
+	})
+	if err != nil {
+		b.logError("add to sorted set", err)
+	}
+}
+
+// GetSortedSetRange returns the members of the sorted set stored under
+// keyName scored from min to max, and their scores, lowest first
+func (b *BoltStorageManager) GetSortedSetRange(keyName string, min, max float64) ([]string, []float64, error) {
+	type scored struct {
+		member string
+		score  float64
+	}
+	var found []scored
+	err := b.db.View(func(tx *bolt.Tx) error {
+		zset := boltMembersOf(tx, b.fixKey(keyName), boltSortedSet, time.Now())
+		if zset == nil {
+			return nil
+		}
+		return zset.ForEach(func(k, v []byte) error {
+			score := math.Float64frombits(binary.BigEndian.Uint64(v))
+			if score >= min && score <= max {
+				found = append(found, scored{string(k), score})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.logError("sorted set range", err)
+		return nil, nil, err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score < found[j].score
+		}
+		return found[i].member < found[j].member
+	})
+	members := make([]string, len(found))
+	scores := make([]float64, len(found))
+	for i, f := range found {
+		members[i], scores[i] = f.member, f.score
+	}
+	return members, scores, nil
+}
+
+// RemoveSortedSetRange removes the members of the sorted set stored under
+// keyName scored from min to max
+func (b *BoltStorageManager) RemoveSortedSetRange(keyName string, min, max float64) error {
+	key := b.fixKey(keyName)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		zset := boltMembersOf(tx, key, boltSortedSet, time.Now())
+		if zset == nil {
+			return nil
+		}
+		var gone [][]byte
+		left := false
+		zset.ForEach(func(k, v []byte) error {
+			score := math.Float64frombits(binary.BigEndian.Uint64(v))
+			if score >= min && score <= max {
+				gone = append(gone, append([]byte(nil), k...))
+			} else {
+				left = true
+			}
+			return nil
+		})
+		if !left {
+			return deleteBoltItem(tx, key)
+		}
+		for _, k := range gone {
+			if err := zset.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.logError("remove sorted set range", err)
+	}
+	return err
+}
+
+// Publish sends message to the subscribers of channel in this process, the
+// file isn't shared with others
+func (b *BoltStorageManager) Publish(channel, message string) error {
+	return localPublish(channel, message)
+}
+
+// Subscribe calls onMessage with the messages published to channel in
+// this process, in order, until the returned func is called
+func (b *BoltStorageManager) Subscribe(channel string, onMessage func(string)) (func(), error) {
+	return localSubscribe(channel, onMessage)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// reopenBolt closes the file of conf, as a restart would, and opens it again.
+func reopenBolt(t *testing.T, conf config.StorageOptionsConf) *bolt.DB {
+	abs, _ := filepath.Abs(conf.Path)
+	boltMu.Lock()
+	f := boltFiles[abs]
+	delete(boltFiles, abs)
+	boltMu.Unlock()
+	if err := f.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := boltDB(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// countBolt returns how many items and expiry index entries db holds.
+func countBolt(t *testing.T, db *bolt.DB) (items, expiries int) {
+	err := db.View(func(tx *bolt.Tx) error {
+		items = tx.Bucket(boltData).Stats().KeyN
+		expiries = tx.Bucket(boltExpiry).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items, expiries
+}
+
+func TestBoltDurable(t *testing.T) {
+	conf := config.StorageOptionsConf{Type: "file", Path: filepath.Join(testDir, "durable.db")}
+	h, err := Connect(conf, "apikey-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.DeleteKeys([]string{"session", "quota", "list", "zset"})
+	h.SetKey("session", `{"rate":10}`, 60)
+	h.IncrementWithExpire("quota", 3600)
+	h.IncrementWithExpire("quota", 3600)
+	h.AppendToSet("list", "a")
+	h.AddToSortedSet("zset", "a", 1.5)
+
+	h = NewBoltStorageManager(reopenBolt(t, conf), "apikey-")
+	if v, err := h.GetKey("session"); err != nil || v != `{"rate":10}` {
+		t.Errorf("want the session kept, got %q %v", v, err)
+	}
+	if exp, _ := h.GetExp("session"); exp < 58 || exp > 60 {
+		t.Errorf("want its expiry kept, got %d", exp)
+	}
+	if n := h.IncrementWithExpire("quota", 3600); n != 3 {
+		t.Errorf("want the quota counted on, got %d", n)
+	}
+	if got := h.GetAndDeleteSet("list"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("want the list kept, got %v", got)
+	}
+	if _, scores, _ := h.GetSortedSetRange("zset", 0, 2); !reflect.DeepEqual(scores, []float64{1.5}) {
+		t.Errorf("want the sorted set kept, got %v", scores)
+	}
+}
+
+func TestBoltSweep(t *testing.T) {
+	conf := config.StorageOptionsConf{Type: "file", Path: filepath.Join(testDir, "sweep.db")}
+	db, err := boltDB(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewBoltStorageManager(db, "")
+	h.SetKey("short", "1", 1)
+	h.SetKey("long", "2", 3600)
+	h.SetKey("forever", "3", 0)
+	h.AddToSet("set", "a")
+	h.SetExp("set", 1)
+	h.SetExp("long", 7200) // moved in the index
+
+	if items, expiries := countBolt(t, db); items != 4 || expiries != 3 {
+		t.Fatalf("want 4 items, 3 expiring, got %d %d", items, expiries)
+	}
+	if n, err := sweepBolt(db, time.Now()); err != nil || n != 0 {
+		t.Errorf("want nothing swept yet, got %d %v", n, err)
+	}
+	if n, err := sweepBolt(db, time.Now().Add(2*time.Second)); err != nil || n != 2 {
+		t.Errorf("want 2 keys swept, got %d %v", n, err)
+	}
+	if items, expiries := countBolt(t, db); items != 2 || expiries != 1 {
+		t.Errorf("want 2 items, 1 expiring, got %d %d", items, expiries)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltMembers).Bucket([]byte("set")) != nil {
+			t.Error("want the members of the set swept")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := h.GetKeys(""); len(keys) != 2 {
+		t.Errorf("want long and forever left, got %v", keys)
+	}
+}
+
+func TestBoltSweepBatches(t *testing.T) {
+	conf := config.StorageOptionsConf{Type: "file", Path: filepath.Join(testDir, "batches.db")}
+	db, err := boltDB(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Second).UnixNano()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < boltSweepBatch+10; i++ {
+			key := []byte(time.Duration(i).String())
+			if err := putBoltItem(tx, key, boltItem{kind: boltString, expires: expires}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sweepBolt(db, time.Now().Add(time.Minute)); err != nil || n != boltSweepBatch+10 {
+		t.Errorf("want every key swept, got %d %v", n, err)
+	}
+}
+
+func TestBoltShared(t *testing.T) {
+	conf := config.StorageOptionsConf{Type: "file", Path: filepath.Join(testDir, "shared.db")}
+	a, err := Connect(conf, "a-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Connect(conf, "b-")
+	if a.(*BoltStorageManager).db != b.(*BoltStorageManager).db {
+		t.Error("want handlers of the same file to share it")
+	}
+	a.SetKey("k", "a", 0)
+	if _, err := b.GetKey("k"); err != ErrKeyNotFound {
+		t.Errorf("want keys kept apart by prefix, got %v", err)
+	}
+	found := false
+	for _, path := range OpenFiles() {
+		found = found || path == conf.Path
+	}
+	if !found {
+		t.Errorf("want %s listed as open, got %v", conf.Path, OpenFiles())
+	}
+}
+
+func TestBoltCloseAll(t *testing.T) {
+	conf := config.StorageOptionsConf{Type: "file", Path: filepath.Join(testDir, "closed.db")}
+	if _, err := Connect(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if files := OpenFiles(); len(files) != 0 {
+		t.Errorf("want no files open, got %v", files)
+	}
+	// as another process would
+	db, err := bolt.Open(conf.Path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		t.Fatalf("want the file released, got %v", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptedPrefix marks the values sealed by a Keyring. It is followed by
+// the ID of the key and the base64 of the nonce and ciphertext, separated
+// by a colon.
+const encryptedPrefix = "enc:v1:"
+
+// keyDerivationInfo binds the keys derived from a secret to their use.
+const keyDerivationInfo = "raspberry session encryption"
+
+// ErrUnknownKey is returned for values encrypted with a key the keyring
+// doesn't hold.
+var ErrUnknownKey = errors.New("value encrypted with an unknown key")
+
+// Keyring holds the AES-GCM keys values are encrypted with, by ID. The
+// first key encrypts and every key decrypts, so keys are rotated by adding
+// a new one in front of the old ones.
+type Keyring struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+// NewKeyring derives a key from each of secrets. The ID of a key is
+// derived from its secret too, so that it stays the same wherever the
+// secret is listed.
+func NewKeyring(secrets []string) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	for _, secret := range secrets {
+		if secret == "" {
+			return nil, errors.New("empty encryption secret")
+		}
+		derived := make([]byte, 32+4)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(keyDerivationInfo)), derived); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(derived[:32])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := hex.EncodeToString(derived[32:])
+		if _, ok := k.aeads[id]; !ok {
+			k.ids = append(k.ids, id)
+			k.aeads[id] = aead
+		}
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("no encryption secret")
+	}
+	return k, nil
+}
+
+// LoadKeyring returns the keyring of conf, with the secrets in its key
+// file or else secret. Blank lines and lines starting with # are skipped.
+func LoadKeyring(conf config.SessionEncryptionConfig, secret string) (*Keyring, error) {
+	if conf.KeyFile == "" {
+		return NewKeyring([]string{secret})
+	}
+	f, err := os.Open(conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var secrets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			secrets = append(secrets, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	keys, err := NewKeyring(secrets)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", conf.KeyFile, err)
+	}
+	return keys, nil
+}
+
+// CurrentID returns the ID of the key values are encrypted with.
+func (k *Keyring) CurrentID() string {
+	return k.ids[0]
+}
+
+// Encrypt seals value with the current key. name is authenticated along
+// with it, so that it can't be moved to another key of the storage.
+func (k *Keyring) Encrypt(name, value string) (string, error) {
+	id := k.CurrentID()
+	aead := k.aeads[id]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return encryptedPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens value stored under name, returning it with the ID of the
+// key it was encrypted with. Values stored before encryption was turned on
+// are returned as they are, with no ID.
+func (k *Keyring) Decrypt(name, value string) (string, string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, "", nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed encrypted value")
+	}
+	id := parts[0]
+	aead, ok := k.aeads[id]
+	if !ok {
+		return "", id, ErrUnknownKey
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", id, errors.New("malformed encrypted value")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", id, err
+	}
+	return string(plain), id, nil
+}
+
+// EncryptedHandler is a Handler encrypting the values of keys set with
+// SetKey, such as sessions, with a Keyring. Everything else is left to the
+// Handler it wraps.
+type EncryptedHandler struct {
+	Handler
+	keys *Keyring
+}
+
+// NewEncryptedHandler returns an EncryptedHandler storing in h.
+func NewEncryptedHandler(h Handler, keys *Keyring) *EncryptedHandler {
+	return &EncryptedHandler{Handler: h, keys: keys}
+}
+
+// GetKey will retrieve and decrypt a key from the store
+func (e *EncryptedHandler) GetKey(keyName string) (string, error) {
+	value, err := e.Handler.GetKey(keyName)
+	if err != nil {
+		return "", err
+	}
+	value, _, err = e.keys.Decrypt(keyName, value)
+	return value, err
+}
+
+// SetKey will encrypt and store a key value, a timeout of zero or less
+// means the key never expires
+func (e *EncryptedHandler) SetKey(keyName, value string, timeout int64) error {
+	sealed, err := e.keys.Encrypt(keyName, value)
+	if err != nil {
+		return err
+	}
+	return e.Handler.SetKey(keyName, sealed, timeout)
+}
+
+// GetMultiKey returns the decrypted values of keyNames in order, with an
+// empty value for the missing ones
+func (e *EncryptedHandler) GetMultiKey(keyNames []string) ([]string, error) {
+	values, err := e.Handler.GetMultiKey(keyNames)
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		if values[i], _, err = e.keys.Decrypt(keyNames[i], value); err != nil {
+			return nil, fmt.Errorf("%s: %v", keyNames[i], err)
+		}
+	}
+	return values, nil
+}
+
+// Reencrypt encrypts the value of keyName again with the current key,
+// keeping its expiry. It reports whether the value needed it, it doesn't
+// when it is already encrypted with the current key.
+func (e *EncryptedHandler) Reencrypt(keyName string) (bool, error) {
+	raw, err := e.Handler.GetKey(keyName)
+	if err != nil {
+		return false, err
+	}
+	value, id, err := e.keys.Decrypt(keyName, raw)
+	if err != nil {
+		return false, err
+	}
+	if id == e.keys.CurrentID() {
+		return false, nil
+	}
+	ttl, err := e.Handler.GetExp(keyName)
+	if err != nil {
+		return false, err
+	}
+	if ttl == 0 {
+		// less than a second to go, zero would keep it forever
+		ttl = 1
+	}
+	return true, e.SetKey(keyName, value, ttl)
+}
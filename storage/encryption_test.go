@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raspberry-gateway/raspberry/config"
+)
+
+func TestKeyring(t *testing.T) {
+	keys, err := NewKeyring([]string{"new-secret", "old-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := NewKeyring([]string{"old-secret"})
+	if keys.CurrentID() == old.CurrentID() || len(keys.CurrentID()) != 8 {
+		t.Errorf("want an ID per secret, got %s %s", keys.CurrentID(), old.CurrentID())
+	}
+
+	sealed, err := keys.Encrypt("key", `{"rate":10}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, encryptedPrefix+keys.CurrentID()+":") || strings.Contains(sealed, "rate") {
+		t.Errorf("unexpected sealed value %s", sealed)
+	}
+	if again, _ := keys.Encrypt("key", `{"rate":10}`); again == sealed {
+		t.Error("want a nonce per value")
+	}
+	if value, id, err := keys.Decrypt("key", sealed); err != nil || value != `{"rate":10}` || id != keys.CurrentID() {
+		t.Errorf("want the value back, got %q %s %v", value, id, err)
+	}
+	if _, _, err := keys.Decrypt("other-key", sealed); err == nil {
+		t.Error("want a value moved to another key refused")
+	}
+	if _, _, err := old.Decrypt("key", sealed); err != ErrUnknownKey {
+		t.Errorf("want %v, got %v", ErrUnknownKey, err)
+	}
+
+	// values from before the rotation, or before encryption
+	byOld, _ := old.Encrypt("key", "before")
+	if value, id, err := keys.Decrypt("key", byOld); err != nil || value != "before" || id != old.CurrentID() {
+		t.Errorf("want the old key to decrypt, got %q %s %v", value, id, err)
+	}
+	if value, id, err := keys.Decrypt("key", `{"plain":true}`); err != nil || value != `{"plain":true}` || id != "" {
+		t.Errorf("want plain values as they are, got %q %s %v", value, id, err)
+	}
+	for _, bad := range []string{encryptedPrefix + "nocolon", encryptedPrefix + keys.CurrentID() + ":!!", encryptedPrefix + keys.CurrentID() + ":AA"} {
+		if _, _, err := keys.Decrypt("key", bad); err == nil {
+			t.Errorf("want %q refused", bad)
+		}
+	}
+
+	if _, err := NewKeyring(nil); err == nil {
+		t.Error("want a keyring without keys refused")
+	}
+	if _, err := NewKeyring([]string{""}); err == nil {
+		t.Error("want an empty secret refused")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(testDir, "session.keys")
+	if err := ioutil.WriteFile(path, []byte("# rotated in March\n\n  new-secret  \nold-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyring(config.SessionEncryptionConfig{KeyFile: path}, "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := NewKeyring([]string{"new-secret", "old-secret"})
+	if keys.CurrentID() != want.CurrentID() || len(keys.ids) != 2 {
+		t.Errorf("want the keys of the file, got %v", keys.ids)
+	}
+
+	keys, _ = LoadKeyring(config.SessionEncryptionConfig{}, "secret")
+	want, _ = NewKeyring([]string{"secret"})
+	if keys.CurrentID() != want.CurrentID() {
+		t.Error("want the key of the secret without a key file")
+	}
+	if _, err := LoadKeyring(config.SessionEncryptionConfig{}, ""); err == nil {
+		t.Error("want an empty secret refused")
+	}
+	if _, err := LoadKeyring(config.SessionEncryptionConfig{KeyFile: filepath.Join(testDir, "missing")}, "secret"); err == nil {
+		t.Error("want a missing key file refused")
+	}
+}
+
+func TestEncryptedHandler(t *testing.T) {
+	for name, h := range testHandlers(t, "test-encrypted-") {
+		old, _ := NewKeyring([]string{"old-secret"})
+		NewEncryptedHandler(h, old).SetKey("a", "one", 60)
+		h.SetKey("b", "two", 0) // stored before encryption was turned on
+
+		keys, _ := NewKeyring([]string{"new-secret", "old-secret"})
+		e := NewEncryptedHandler(h, keys)
+		if raw, _ := h.GetKey("a"); !strings.HasPrefix(raw, encryptedPrefix) {
+			t.Errorf("%s: want the value stored encrypted, got %q", name, raw)
+		}
+		if values, err := e.GetMultiKey([]string{"a", "missing", "b"}); err != nil || strings.Join(values, ",") != "one,,two" {
+			t.Errorf("%s: want [one  two], got %q %v", name, values, err)
+		}
+
+		for _, keyName := range []string{"a", "b"} {
+			if changed, err := e.Reencrypt(keyName); err != nil || !changed {
+				t.Errorf("%s: want %s encrypted again, got %v %v", name, keyName, changed, err)
+			}
+			if changed, _ := e.Reencrypt(keyName); changed {
+				t.Errorf("%s: want %s left once encrypted with the current key", name, keyName)
+			}
+		}
+		if value, err := e.GetKey("a"); err != nil || value != "one" {
+			t.Errorf("%s: want one, got %q %v", name, value, err)
+		}
+		if exp, _ := h.GetExp("a"); exp < 58 || exp > 60 {
+			t.Errorf("%s: want the expiry kept, got %d", name, exp)
+		}
+		if exp, _ := h.GetExp("b"); exp != -1 {
+			t.Errorf("%s: want no expiry kept, got %d", name, exp)
+		}
+		raw, _ := h.GetKey("b")
+		if _, id, _ := keys.Decrypt("b", raw); id != keys.CurrentID() {
+			t.Errorf("%s: want the current key used, got %s", name, id)
+		}
+		if _, err := e.Reencrypt("missing"); err != ErrKeyNotFound {
+			t.Errorf("%s: want %v, got %v", name, ErrKeyNotFound, err)
+		}
+		h.DeleteKeys([]string{"a", "b"})
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import "sync"
+
+// localSubscribers are the subscriptions of the handlers without a server
+// to go through, by channel, so that channels are shared by the process
+// like they are by the clients of a Redis server.
+var localSubscribers = struct {
+	sync.RWMutex
+	channels map[string]map[*localSubscription]bool
+}{channels: make(map[string]map[*localSubscription]bool)}
+
+type localSubscription struct {
+	messages chan string
+	done     chan struct{}
+}
+
+// localPublish sends message to the local subscribers of channel.
+func localPublish(channel, message string) error {
+	localSubscribers.RLock()
+	defer localSubscribers.RUnlock()
+
+	for sub := range localSubscribers.channels[channel] {
+		select {
+		case sub.messages <- message:
+		case <-sub.done:
+		}
+	}
+	return nil
+}
+
+// localSubscribe calls onMessage with the messages published locally to
+// channel, in order, until the returned func is called.
+func localSubscribe(channel string, onMessage func(string)) (func(), error) {
+	sub := &localSubscription{
+		messages: make(chan string, 100),
+		done:     make(chan struct{}),
+	}
+	localSubscribers.Lock()
+	if localSubscribers.channels[channel] == nil {
+		localSubscribers.channels[channel] = make(map[*localSubscription]bool)
+	}
+	localSubscribers.channels[channel][sub] = true
+	localSubscribers.Unlock()
+
+	go func() {
+		for {
+			select {
+			case message := <-sub.messages:
+				onMessage(message)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			localSubscribers.Lock()
+			delete(localSubscribers.channels[channel], sub)
+			if len(localSubscribers.channels[channel]) == 0 {
+				delete(localSubscribers.channels, channel)
+			}
+			localSubscribers.Unlock()
+			close(sub.done)
+		})
+	}, nil
+}
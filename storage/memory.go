@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMemorySweepInterval = time.Minute
+
+// MemoryStorageManager is a Handler that keeps everything in process
+// memory. Keys are lost on restart, so it is only suited for tests and
+// single node setups.
+type MemoryStorageManager struct {
+	KeyPrefix string
+
+	mu   sync.Mutex
+	data map[string]memoryItem
+}
+
+type memoryItem struct {
+	value   string
+	list    []string
+	set     map[string]bool
+	zset    map[string]float64
+	expires time.Time
+}
+
+func (i memoryItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+// NewMemoryStorageManager returns an empty MemoryStorageManager, its
+// expired keys swept every minute.
+func NewMemoryStorageManager(keyPrefix string) *MemoryStorageManager {
+	return newMemoryStorageManager(keyPrefix, defaultMemorySweepInterval)
+}
+
+func newMemoryStorageManager(keyPrefix string, interval time.Duration) *MemoryStorageManager {
+	m := &MemoryStorageManager{
+		KeyPrefix: keyPrefix,
+		data:      make(map[string]memoryItem),
+	}
+	go m.sweep(interval)
+	return m
+}
+
+// sweep deletes the expired keys every interval. They are already hidden,
+// this frees the ones nothing reads again, such as the counters of keys
+// no longer used. Handlers live as long as the process, so it never stops.
+func (m *MemoryStorageManager) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.sweepExpired(now)
+	}
+}
+
+// sweepExpired deletes the keys expired by now, returning how many.
+func (m *MemoryStorageManager) sweepExpired(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key, item := range m.data {
+		if item.expired(now) {
+			delete(m.data, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (m *MemoryStorageManager) fixKey(keyName string) string {
+	return m.KeyPrefix + keyName
+}
+
+func (m *MemoryStorageManager) cleanKey(keyName string) string {
+	return strings.TrimPrefix(keyName, m.KeyPrefix)
+}
+
+// get returns the live item stored under the already prefixed key,
+// removing it if it has expired. m.mu must be held.
+func (m *MemoryStorageManager) get(key string, now time.Time) (memoryItem, bool) {
+	item, ok := m.data[key]
+	if !ok {
+		return memoryItem{}, false
+	}
+	if item.expired(now) {
+		delete(m.data, key)
+		return memoryItem{}, false
+	}
+	return item, true
+}
+
+// GetKey will retrieve a key from the store
+func (m *MemoryStorageManager) GetKey(keyName string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.get(m.fixKey(keyName), time.Now())
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return item.value, nil
+}
+
+// SetKey will create (or update) a key value in the store, a timeout of
+// zero or less means the key never expires
+func (m *MemoryStorageManager) SetKey(keyName, session string, timeout int64) error {
+	item := memoryItem{value: session}
+	if timeout > 0 {
+		item.expires = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+
+	m.mu.Lock()
+	m.data[m.fixKey(keyName)] = item
+	m.mu.Unlock()
+	return nil
+}
+
+// GetExp returns the seconds until keyName expires, -1 if it never does
+func (m *MemoryStorageManager) GetExp(keyName string) (int64, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.get(m.fixKey(keyName), now)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if item.expires.IsZero() {
+		return -1, nil
+	}
+	return int64(item.expires.Sub(now) / time.Second), nil
+}
+
+// SetExp sets keyName to expire in timeout seconds, or never
+func (m *MemoryStorageManager) SetExp(keyName string, timeout int64) error {
+	now := time.Now()
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.get(key, now)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	item.expires = time.Time{}
+	if timeout > 0 {
+		item.expires = now.Add(time.Duration(timeout) * time.Second)
+	}
+	m.data[key] = item
+	return nil
+}
+
+// GetKeys will return all keys according to the filter (filter is a prefix - e.g. raspberry.keys.*)
+func (m *MemoryStorageManager) GetKeys(filter string) []string {
+	filter = strings.TrimSuffix(m.fixKey(filter), "*")
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := []string{}
+	for key := range m.data {
+		if !strings.HasPrefix(key, filter) {
+			continue
+		}
+		if _, ok := m.get(key, now); ok {
+			keys = append(keys, m.cleanKey(key))
+		}
+	}
+	return keys
+}
+
+// DeleteKey will remove a key from the store
+func (m *MemoryStorageManager) DeleteKey(keyName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.fixKey(keyName)
+	_, ok := m.get(key, time.Now())
+	delete(m.data, key)
+	return ok
+}
+
+// DeleteKeys removes keyNames from the store, returning how many there were
+func (m *MemoryStorageManager) DeleteKeys(keyNames []string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+	for _, keyName := range keyNames {
+		key := m.fixKey(keyName)
+		if _, ok := m.get(key, now); ok {
+			deleted++
+		}
+		delete(m.data, key)
+	}
+	return deleted
+}
+
+// GetMultiKey returns the values of keyNames in order, with an empty value
+// for the missing ones
+func (m *MemoryStorageManager) GetMultiKey(keyNames []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	values := make([]string, len(keyNames))
+	for i, keyName := range keyNames {
+		if item, ok := m.get(m.fixKey(keyName), now); ok {
+			values[i] = item.value
+		}
+	}
+	return values, nil
+}
+
+// IncrementWithExpire will increment a key, the expiry is only set when
+// the key is created so the counter works as a fixed window
+func (m *MemoryStorageManager) IncrementWithExpire(keyName string, expire int64) int64 {
+	now := time.Now()
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.get(key, now)
+	if !ok && expire > 0 {
+		item.expires = now.Add(time.Duration(expire) * time.Second)
+	}
+	val, _ := strconv.ParseInt(item.value, 10, 64)
+	val++
+	item.value = strconv.FormatInt(val, 10)
+	m.data[key] = item
+	return val
+}
+
+// AppendToSet appends value to the list stored under keyName
+func (m *MemoryStorageManager) AppendToSet(keyName, value string) {
+	now := time.Now()
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, _ := m.get(key, now)
+	item.list = append(item.list, value)
+	m.data[key] = item
+}
+
+// GetAndDeleteSet returns the list stored under keyName and removes it
+func (m *MemoryStorageManager) GetAndDeleteSet(keyName string) []string {
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, _ := m.get(key, time.Now())
+	delete(m.data, key)
+	return item.list
+}
+
+// AddToSet adds value to the set stored under keyName
+func (m *MemoryStorageManager) AddToSet(keyName, value string) {
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, _ := m.get(key, time.Now())
+	if item.set == nil {
+		item.set = make(map[string]bool)
+	}
+	item.set[value] = true
+	m.data[key] = item
+}
+
+// GetSet returns the members of the set stored under keyName
+func (m *MemoryStorageManager) GetSet(keyName string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, _ := m.get(m.fixKey(keyName), time.Now())
+	members := make([]string, 0, len(item.set))
+	for member := range item.set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// RemoveFromSet removes value from the set stored under keyName
+func (m *MemoryStorageManager) RemoveFromSet(keyName, value string) {
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.get(key, time.Now())
+	if !ok {
+		return
+	}
+	delete(item.set, value)
+	if len(item.set) == 0 {
+		delete(m.data, key)
+	}
+}
+
+// AddToSortedSet adds value with score to the sorted set stored under
+// keyName, updating its score if it is already there
+func (m *MemoryStorageManager) AddToSortedSet(keyName, value string, score float64) {
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, _ := m.get(key, time.Now())
+	if item.zset == nil {
+		item.zset = make(map[string]float64)
+	}
+	item.zset[value] = score
+	m.data[key] = item
+}
+
+// GetSortedSetRange returns the members of the sorted set stored under
+// keyName scored from min to max, and their scores, lowest first
+func (m *MemoryStorageManager) GetSortedSetRange(keyName string, min, max float64) ([]string, []float64, error) {
+	type scored struct {
+		member string
+		score  float64
+	}
+	var found []scored
+
+	m.mu.Lock()
+	item, _ := m.get(m.fixKey(keyName), time.Now())
+	for member, score := range item.zset {
+		if score >= min && score <= max {
+			found = append(found, scored{member, score})
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score < found[j].score
+		}
+		return found[i].member < found[j].member
+	})
+	members := make([]string, len(found))
+	scores := make([]float64, len(found))
+	for i, f := range found {
+		members[i], scores[i] = f.member, f.score
+	}
+	return members, scores, nil
+}
+
+// RemoveSortedSetRange removes the members of the sorted set stored under
+// keyName scored from min to max
+func (m *MemoryStorageManager) RemoveSortedSetRange(keyName string, min, max float64) error {
+	key := m.fixKey(keyName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.get(key, time.Now())
+	if !ok {
+		return nil
+	}
+	for member, score := range item.zset {
+		if score >= min && score <= max {
+			delete(item.zset, member)
+		}
+	}
+	if len(item.zset) == 0 {
+		delete(m.data, key)
+	}
+	return nil
+}
+
+// Publish sends message to the subscribers of channel
+func (m *MemoryStorageManager) Publish(channel, message string) error {
+	return localPublish(channel, message)
+}
+
+// Subscribe calls onMessage with the messages published to channel, in
+// order, until the returned func is called
+func (m *MemoryStorageManager) Subscribe(channel string, onMessage func(string)) (func(), error) {
+	return localSubscribe(channel, onMessage)
+}
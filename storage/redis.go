@@ -0,0 +1,560 @@
+package storage
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/raspberry-gateway/raspberry/config"
+)
+
+const (
+	defaultRedisHost         = "localhost"
+	defaultRedisPort         = 6379
+	defaultRedisSentinelPort = 26379
+	defaultRedisTimeout      = 5 * time.Second
+	// redisIdleTimeout is how long connections beyond the idle ones kept
+	// open may stay unused before they are closed.
+	redisIdleTimeout = 240 * time.Second
+	// redisScanCount is how many keys GetKeys asks for at a time.
+	redisScanCount = 1000
+	// Failed commands are retried with a backoff doubling between these.
+	redisMaxRetries      = 3
+	redisMinRetryBackoff = 8 * time.Millisecond
+	redisMaxRetryBackoff = 512 * time.Millisecond
+)
+
+// The ways of deploying Redis.
+const (
+	redisSingle   = "single"
+	redisCluster  = "cluster"
+	redisSentinel = "sentinel"
+)
+
+var (
+	redisMu      sync.Mutex
+	redisClients = make(map[string]*redisConnection)
+)
+
+// redisConnection is a client shared by the handlers of a storage
+// configuration, and the monitor of its connection.
+type redisConnection struct {
+	client  redis.UniversalClient
+	monitor *redisMonitor
+}
+
+// redisClient returns the client for conf, created on first use.
+func redisClient(conf config.StorageOptionsConf) (redis.UniversalClient, error) {
+	id, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	redisMu.Lock()
+	defer redisMu.Unlock()
+
+	if conn, ok := redisClients[string(id)]; ok {
+		return conn.client, nil
+	}
+	opts, err := redisOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Username != "" {
+		log.Warning("storage username is not supported by Redis before 6 and is ignored")
+	}
+	mode := redisMode(conf)
+	client := newRedisClient(mode, opts)
+	conn := &redisConnection{client: client, monitor: newRedisMonitor(mode, opts.Addrs, client)}
+	redisClients[string(id)] = conn
+	go conn.monitor.run()
+	return client, nil
+}
+
+func redisMode(conf config.StorageOptionsConf) string {
+	switch {
+	case conf.EnableCluster:
+		return redisCluster
+	case conf.MasterName != "":
+		return redisSentinel
+	}
+	return redisSingle
+}
+
+// newRedisClient returns a client for the deployment mode.
+func newRedisClient(mode string, opts *redis.UniversalOptions) redis.UniversalClient {
+	if mode != redisCluster {
+		// a failover client with MasterName, a single node one otherwise
+		return redis.NewUniversalClient(opts)
+	}
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:           opts.Addrs,
+		Password:        opts.Password,
+		MaxRetries:      opts.MaxRetries,
+		MinRetryBackoff: opts.MinRetryBackoff,
+		MaxRetryBackoff: opts.MaxRetryBackoff,
+		DialTimeout:     opts.DialTimeout,
+		ReadTimeout:     opts.ReadTimeout,
+		WriteTimeout:    opts.WriteTimeout,
+		PoolSize:        opts.PoolSize,
+		MinIdleConns:    opts.MinIdleConns,
+		IdleTimeout:     opts.IdleTimeout,
+		TLSConfig:       opts.TLSConfig,
+	})
+}
+
+// redisAddrs returns the addresses of conf, the seed nodes of a cluster or
+// the sentinels when MasterName is set. Addrs take precedence over Hosts,
+// which map host names to ports, and Hosts over Host and Port.
+func redisAddrs(conf config.StorageOptionsConf) []string {
+	if len(conf.Addrs) > 0 {
+		return conf.Addrs
+	}
+	if len(conf.Hosts) > 0 {
+		var addrs []string
+		for host, port := range conf.Hosts {
+			addrs = append(addrs, net.JoinHostPort(host, port))
+		}
+		sort.Strings(addrs)
+		return addrs
+	}
+
+	host, port := conf.Host, conf.Port
+	if host == "" {
+		host = defaultRedisHost
+	}
+	if port == 0 {
+		port = defaultRedisPort
+		if conf.MasterName != "" {
+			port = defaultRedisSentinelPort
+		}
+	}
+	return []string{net.JoinHostPort(host, strconv.Itoa(port))}
+}
+
+// redisOptions translates conf to the options of a Redis client.
+// MaxActive limits the connections to each server, MaxIdle of them are
+// kept open while idle.
+func redisOptions(conf config.StorageOptionsConf) (*redis.UniversalOptions, error) {
+	addrs := redisAddrs(conf)
+	switch {
+	case conf.EnableCluster && conf.MasterName != "":
+		return nil, errors.New("enable_cluster and master_name can't be used together")
+	case conf.EnableCluster && conf.Database != 0:
+		return nil, errors.New("Redis Cluster only has database 0")
+	case len(addrs) > 1 && !conf.EnableCluster && conf.MasterName == "":
+		return nil, errors.New("several Redis addresses need enable_cluster or master_name")
+	case conf.UseSSL && conf.MasterName != "":
+		// the client only uses TLS for the sentinels, not the master
+		return nil, errors.New("use_ssl can't be used with master_name")
+	}
+
+	timeout := defaultRedisTimeout
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:           addrs,
+		MasterName:      conf.MasterName,
+		DB:              conf.Database,
+		Password:        conf.Password,
+		MaxRetries:      redisMaxRetries,
+		MinRetryBackoff: redisMinRetryBackoff,
+		MaxRetryBackoff: redisMaxRetryBackoff,
+		DialTimeout:     timeout,
+		ReadTimeout:     timeout,
+		WriteTimeout:    timeout,
+		PoolSize:        conf.MaxActive,
+		MinIdleConns:    conf.MaxIdle,
+		IdleTimeout:     redisIdleTimeout,
+	}
+	if opts.PoolSize > 0 && opts.MinIdleConns > opts.PoolSize {
+		opts.MinIdleConns = opts.PoolSize
+	}
+	if conf.UseSSL {
+		opts.TLSConfig = redisTLSConfig(conf, addrs)
+	}
+	return opts, nil
+}
+
+// redisTLSConfig returns the TLS config for the servers at addrs. Cluster
+// nodes are left without a ServerName, so each is verified against the
+// host of the address it is dialled at, seed or discovered.
+func redisTLSConfig(conf config.StorageOptionsConf, addrs []string) *tls.Config {
+	if conf.SSLInsecureSkipVerify {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	if redisMode(conf) == redisSingle {
+		host, _, _ := net.SplitHostPort(addrs[0])
+		return &tls.Config{ServerName: host}
+	}
+	return &tls.Config{}
+}
+
+// RedisStorageManager is a Handler keeping keys in Redis, so that every
+// gateway node shares them.
+type RedisStorageManager struct {
+	KeyPrefix string
+
+	client redis.UniversalClient
+}
+
+// NewRedisStorageManager returns a RedisStorageManager using client.
+func NewRedisStorageManager(client redis.UniversalClient, keyPrefix string) *RedisStorageManager {
+	return &RedisStorageManager{KeyPrefix: keyPrefix, client: client}
+}
+
+func (r *RedisStorageManager) fixKey(keyName string) string {
+	return r.KeyPrefix + keyName
+}
+
+func (r *RedisStorageManager) cleanKey(keyName string) string {
+	return strings.TrimPrefix(keyName, r.KeyPrefix)
+}
+
+func (r *RedisStorageManager) logError(op string, err error) {
+	log.WithField("op", op).Error("Redis error: ", err)
+}
+
+// GetKey will retrieve a key from the store
+func (r *RedisStorageManager) GetKey(keyName string) (string, error) {
+	value, err := r.client.Get(r.fixKey(keyName)).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	if err != nil {
+		r.logError("get", err)
+		return "", err
+	}
+	return value, nil
+}
+
+// SetKey will create (or update) a key value in the store, a timeout of
+// zero or less means the key never expires
+func (r *RedisStorageManager) SetKey(keyName, session string, timeout int64) error {
+	err := r.client.Set(r.fixKey(keyName), session, seconds(timeout)).Err()
+	if err != nil {
+		r.logError("set", err)
+	}
+	return err
+}
+
+// GetExp returns the seconds until keyName expires, -1 if it never does
+func (r *RedisStorageManager) GetExp(keyName string) (int64, error) {
+	// the raw reply, as client versions differ in how they scale -1 and -2
+	cmd := redis.NewIntCmd("ttl", r.fixKey(keyName))
+	r.client.Process(cmd)
+	ttl, err := cmd.Result()
+	if err != nil {
+		r.logError("ttl", err)
+		return 0, err
+	}
+	if ttl == -2 {
+		return 0, ErrKeyNotFound
+	}
+	return ttl, nil
+}
+
+// SetExp sets keyName to expire in timeout seconds, or never
+func (r *RedisStorageManager) SetExp(keyName string, timeout int64) error {
+	key := r.fixKey(keyName)
+	var cmd *redis.BoolCmd
+	if timeout > 0 {
+		cmd = r.client.Expire(key, seconds(timeout))
+	} else {
+		cmd = r.client.Persist(key)
+	}
+	if err := cmd.Err(); err != nil {
+		r.logError("expire", err)
+		return err
+	}
+	if !cmd.Val() {
+		// PERSIST is also false for keys without an expiry
+		if _, err := r.client.Get(key).Result(); err == redis.Nil {
+			return ErrKeyNotFound
+		}
+	}
+	return nil
+}
+
+// GetKeys will return all keys according to the filter (filter is a prefix - e.g. raspberry.keys.*)
+func (r *RedisStorageManager) GetKeys(filter string) []string {
+	pattern := r.fixKey(strings.TrimSuffix(filter, "*")) + "*"
+	cluster, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return r.scan(r.client, pattern)
+	}
+
+	// each master holds its own part of the keys
+	var mu sync.Mutex
+	keys := []string{}
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		found := r.scan(client, pattern)
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		r.logError("scan", err)
+	}
+	return keys
+}
+
+// scan returns the keys of client matching pattern, without the prefix
+func (r *RedisStorageManager) scan(client redis.Cmdable, pattern string) []string {
+	keys := []string{}
+	iter := client.Scan(0, pattern, redisScanCount).Iterator()
+	for iter.Next() {
+		keys = append(keys, r.cleanKey(iter.Val()))
+	}
+	if err := iter.Err(); err != nil {
+		r.logError("scan", err)
+	}
+	return keys
+}
+
+// DeleteKey will remove a key from the store
+func (r *RedisStorageManager) DeleteKey(keyName string) bool {
+	n, err := r.client.Del(r.fixKey(keyName)).Result()
+	if err != nil {
+		r.logError("del", err)
+	}
+	return n > 0
+}
+
+// DeleteKeys removes keyNames from the store, returning how many there were
+func (r *RedisStorageManager) DeleteKeys(keyNames []string) int64 {
+	var deleted int64
+	for _, group := range r.slotGroups(keyNames) {
+		n, err := r.client.Del(group...).Result()
+		if err != nil {
+			r.logError("del", err)
+		}
+		deleted += n
+	}
+	return deleted
+}
+
+// GetMultiKey returns the values of keyNames in order, with an empty value
+// for the missing ones
+func (r *RedisStorageManager) GetMultiKey(keyNames []string) ([]string, error) {
+	values := make([]string, len(keyNames))
+	index := make(map[string][]int, len(keyNames))
+	for i, keyName := range keyNames {
+		key := r.fixKey(keyName)
+		index[key] = append(index[key], i)
+	}
+
+	for _, group := range r.slotGroups(keyNames) {
+		found, err := r.client.MGet(group...).Result()
+		if err != nil {
+			r.logError("mget", err)
+			return nil, err
+		}
+		for i, value := range found {
+			s, _ := value.(string)
+			for _, j := range index[group[i]] {
+				values[j] = s
+			}
+		}
+	}
+	return values, nil
+}
+
+// slotGroups returns the prefixed keyNames grouped so that each group can
+// go in one command: by hash slot on a cluster, all together otherwise.
+func (r *RedisStorageManager) slotGroups(keyNames []string) [][]string {
+	if len(keyNames) == 0 {
+		return nil
+	}
+	if _, ok := r.client.(*redis.ClusterClient); !ok {
+		keys := make([]string, len(keyNames))
+		for i, keyName := range keyNames {
+			keys[i] = r.fixKey(keyName)
+		}
+		return [][]string{keys}
+	}
+
+	var groups [][]string
+	slots := make(map[int]int)
+	for _, keyName := range keyNames {
+		key := r.fixKey(keyName)
+		slot := keySlot(key)
+		i, ok := slots[slot]
+		if !ok {
+			i = len(groups)
+			slots[slot] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups
+}
+
+// IncrementWithExpire will increment a key, the expiry is only set when
+// the key is created so the counter works as a fixed window. The key is
+// created with its expiry and incremented in one transaction, so a counter
+// can't be left without one.
+func (r *RedisStorageManager) IncrementWithExpire(keyName string, expire int64) int64 {
+	key := r.fixKey(keyName)
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if expire > 0 {
+			pipe.SetNX(key, 0, seconds(expire))
+		}
+		incr = pipe.Incr(key)
+		return nil
+	})
+	if err != nil {
+		r.logError("incr", err)
+		return 0
+	}
+	return incr.Val()
+}
+
+// AppendToSet appends value to the list stored under keyName
+func (r *RedisStorageManager) AppendToSet(keyName, value string) {
+	if err := r.client.RPush(r.fixKey(keyName), value).Err(); err != nil {
+		r.logError("rpush", err)
+	}
+}
+
+// GetAndDeleteSet returns the list stored under keyName and removes it
+func (r *RedisStorageManager) GetAndDeleteSet(keyName string) []string {
+	key := r.fixKey(keyName)
+	var lrange *redis.StringSliceCmd
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		lrange = pipe.LRange(key, 0, -1)
+		pipe.Del(key)
+		return nil
+	})
+	if err != nil {
+		r.logError("lrange", err)
+		return nil
+	}
+	return lrange.Val()
+}
+
+// AddToSet adds value to the set stored under keyName
+func (r *RedisStorageManager) AddToSet(keyName, value string) {
+	if err := r.client.SAdd(r.fixKey(keyName), value).Err(); err != nil {
+		r.logError("sadd", err)
+	}
+}
+
+// GetSet returns the members of the set stored under keyName
+func (r *RedisStorageManager) GetSet(keyName string) ([]string, error) {
+	members, err := r.client.SMembers(r.fixKey(keyName)).Result()
+	if err != nil {
+		r.logError("smembers", err)
+	}
+	return members, err
+}
+
+// RemoveFromSet removes value from the set stored under keyName
+func (r *RedisStorageManager) RemoveFromSet(keyName, value string) {
+	if err := r.client.SRem(r.fixKey(keyName), value).Err(); err != nil {
+		r.logError("srem", err)
+	}
+}
+
+// AddToSortedSet adds value with score to the sorted set stored under
+// keyName, updating its score if it is already there
+func (r *RedisStorageManager) AddToSortedSet(keyName, value string, score float64) {
+	if err := r.client.ZAdd(r.fixKey(keyName), redis.Z{Score: score, Member: value}).Err(); err != nil {
+		r.logError("zadd", err)
+	}
+}
+
+// GetSortedSetRange returns the members of the sorted set stored under
+// keyName scored from min to max, and their scores, lowest first
+func (r *RedisStorageManager) GetSortedSetRange(keyName string, min, max float64) ([]string, []float64, error) {
+	zs, err := r.client.ZRangeByScoreWithScores(r.fixKey(keyName), redis.ZRangeBy{
+		Min: formatScore(min),
+		Max: formatScore(max),
+	}).Result()
+	if err != nil {
+		r.logError("zrangebyscore", err)
+		return nil, nil, err
+	}
+	members := make([]string, len(zs))
+	scores := make([]float64, len(zs))
+	for i, z := range zs {
+		members[i], _ = z.Member.(string)
+		scores[i] = z.Score
+	}
+	return members, scores, nil
+}
+
+// RemoveSortedSetRange removes the members of the sorted set stored under
+// keyName scored from min to max
+func (r *RedisStorageManager) RemoveSortedSetRange(keyName string, min, max float64) error {
+	err := r.client.ZRemRangeByScore(r.fixKey(keyName), formatScore(min), formatScore(max)).Err()
+	if err != nil {
+		r.logError("zremrangebyscore", err)
+	}
+	return err
+}
+
+// Publish sends message to the subscribers of channel
+func (r *RedisStorageManager) Publish(channel, message string) error {
+	err := r.client.Publish(channel, message).Err()
+	if err != nil {
+		r.logError("publish", err)
+	}
+	return err
+}
+
+// Subscribe calls onMessage with the messages published to channel, in
+// order, until the returned func is called. Lost connections are
+// re-established and subscribed again.
+func (r *RedisStorageManager) Subscribe(channel string, onMessage func(string)) (func(), error) {
+	ps := r.client.Subscribe(channel)
+	// wait for the subscription, so no message published after it is missed
+	if _, err := ps.Receive(); err != nil {
+		ps.Close()
+		r.logError("subscribe", err)
+		return nil, err
+	}
+	messages := ps.Channel()
+	go func() {
+		for msg := range messages {
+			onMessage(msg.Payload)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { ps.Close() })
+	}, nil
+}
+
+// seconds converts an expiry in seconds to the duration Redis takes, where
+// zero means no expiry.
+func seconds(timeout int64) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// formatScore formats a sorted set score, infinities included.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
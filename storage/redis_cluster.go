@@ -0,0 +1,34 @@
+package storage
+
+import "strings"
+
+// redisSlots is the number of hash slots of a Redis Cluster.
+const redisSlots = 16384
+
+// keySlot returns the cluster hash slot of key. Only the part of a key
+// between the first { and the next } is hashed when it isn't empty, so
+// keys sharing such a hash tag are kept on the same node.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisSlots
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
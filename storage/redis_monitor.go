@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// The states of a storage connection.
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+)
+
+// How often connections are checked, and how long to wait before trying
+// again a lost one, doubling up to the maximum.
+const (
+	redisPingInterval   = 10 * time.Second
+	redisMinReconnDelay = 500 * time.Millisecond
+	redisMaxReconnDelay = 30 * time.Second
+)
+
+// ConnectionStatus is the state of the connection to a storage.
+type ConnectionStatus struct {
+	Type      string    `json:"type"`
+	Mode      string    `json:"mode"`
+	Addrs     []string  `json:"addrs"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Status returns the state of the connections to every Redis storage in
+// use, sorted by address.
+func Status() []ConnectionStatus {
+	redisMu.Lock()
+	statuses := make([]ConnectionStatus, 0, len(redisClients))
+	for _, conn := range redisClients {
+		statuses = append(statuses, conn.monitor.status())
+	}
+	redisMu.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return strings.Join(statuses[i].Addrs, ",") < strings.Join(statuses[j].Addrs, ",")
+	})
+	return statuses
+}
+
+// redisMonitor pings a Redis deployment to keep track of its connection.
+// While it is lost, it is tried again with an exponential backoff, the
+// clients themselves redialing on the next command.
+type redisMonitor struct {
+	client                       redis.UniversalClient
+	interval, minDelay, maxDelay time.Duration
+
+	mu      sync.Mutex
+	current ConnectionStatus
+}
+
+func newRedisMonitor(mode string, addrs []string, client redis.UniversalClient) *redisMonitor {
+	return &redisMonitor{
+		client:   client,
+		interval: redisPingInterval,
+		minDelay: redisMinReconnDelay,
+		maxDelay: redisMaxReconnDelay,
+		current: ConnectionStatus{
+			Type:  "redis",
+			Mode:  mode,
+			Addrs: addrs,
+			State: StateConnecting,
+			Since: time.Now(),
+		},
+	}
+}
+
+func (m *redisMonitor) status() ConnectionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// run checks the connection for as long as the process lives, as clients
+// are shared and never closed.
+func (m *redisMonitor) run() {
+	delay := m.minDelay
+	for {
+		if err := m.ping(); err != nil {
+			m.setState(StateDisconnected, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > m.maxDelay {
+				delay = m.maxDelay
+			}
+			continue
+		}
+		m.setState(StateConnected, nil)
+		delay = m.minDelay
+		time.Sleep(m.interval)
+	}
+}
+
+// ping checks the connection, to every master of a cluster.
+func (m *redisMonitor) ping() error {
+	if cluster, ok := m.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(client *redis.Client) error {
+			return client.Ping().Err()
+		})
+	}
+	return m.client.Ping().Err()
+}
+
+func (m *redisMonitor) setState(state string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := &m.current
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	if s.State == state {
+		return
+	}
+	logger := log.WithField("addrs", s.Addrs)
+	if state == StateConnected {
+		logger.Info("Connected to Redis")
+	} else {
+		logger.WithError(err).Error("Lost the connection to Redis, reconnecting")
+	}
+	s.State = state
+	s.Since = time.Now()
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/raspberry-gateway/raspberry/config"
+	logger "github.com/raspberry-gateway/raspberry/log"
+)
+
+var log = logger.Get().WithField("prefix", "storage")
+
+// SessionKeyPrefix is the prefix of the keys sessions are stored under.
+const SessionKeyPrefix = "apikey-"
+
+// ErrKeyNotFound is a standard error for when a key is not found in the storage engine
+var ErrKeyNotFound = errors.New("key not found")
+
+// Handler is a standard interface to a storage backend, used by
+// AuthorisationManager to read and write key values to the backend.
+// Expiries are in seconds, zero or less means a key never expires.
+type Handler interface {
+	GetKey(string) (string, error)
+	SetKey(string, string, int64) error // Second input string is expected to be a JSON object (user.SessionState)
+	GetExp(string) (int64, error)       // Remaining seconds, -1 if the key never expires
+	SetExp(string, int64) error
+	GetKeys(string) []string
+	DeleteKey(string) bool
+	IncrementWithExpire(string, int64) int64
+
+	// DeleteKeys and GetMultiKey work on several keys at once, GetMultiKey
+	// returning an empty value for the missing ones.
+	DeleteKeys([]string) int64
+	GetMultiKey([]string) ([]string, error)
+
+	// AppendToSet and GetAndDeleteSet keep a list, such as the analytics
+	// records waiting to be purged.
+	AppendToSet(string, string)
+	GetAndDeleteSet(string) []string
+
+	AddToSet(string, string)
+	GetSet(string) ([]string, error)
+	RemoveFromSet(string, string)
+
+	// Sorted set ranges are inclusive, use math.Inf for open ends.
+	AddToSortedSet(string, string, float64)
+	GetSortedSetRange(string, float64, float64) ([]string, []float64, error)
+	RemoveSortedSetRange(string, float64, float64) error
+
+	// Publish sends a message to the subscribers of a channel, channels
+	// aren't prefixed. Subscribe calls the func with each message until
+	// the returned func is called.
+	Publish(string, string) error
+	Subscribe(string, func(string)) (func(), error)
+}
+
+// Connect returns a Handler for the storage in conf, with its keys prefixed
+// with keyPrefix. The type is "redis", "file" or "memory", the default.
+// Redis handlers with the same configuration share their connections, file
+// handlers with the same path their file.
+func Connect(conf config.StorageOptionsConf, keyPrefix string) (Handler, error) {
+	switch conf.Type {
+	case "", "memory":
+		interval := defaultMemorySweepInterval
+		if conf.SweepInterval > 0 {
+			interval = time.Duration(conf.SweepInterval) * time.Second
+		}
+		return newMemoryStorageManager(keyPrefix, interval), nil
+	case "redis":
+		client, err := redisClient(conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisStorageManager(client, keyPrefix), nil
+	case "file":
+		db, err := boltDB(conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltStorageManager(db, keyPrefix), nil
+	}
+	return nil, fmt.Errorf("unknown storage type %q", conf.Type)
+}
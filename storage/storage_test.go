@@ -0,0 +1,535 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	stdlog "log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/raspberry-gateway/raspberry/config"
+)
+
+// testRedisEnv names the environment variable holding the host:port of a
+// Redis server to run the tests against, in its database 15.
+const testRedisEnv = "RASPBERRY_TEST_REDIS"
+
+// testDir holds the storage files of the tests.
+var testDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "raspberry-storage")
+	if err != nil {
+		panic(err)
+	}
+	testDir = dir
+	code := m.Run()
+
+	CloseAll()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testHandlers returns the handlers to test, each with its own prefix.
+func testHandlers(t *testing.T, prefix string) map[string]Handler {
+	file, err := Connect(config.StorageOptionsConf{Type: "file", Path: filepath.Join(testDir, "test.db")}, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers := map[string]Handler{
+		"memory": NewMemoryStorageManager(prefix),
+		"file":   file,
+	}
+	addr := os.Getenv(testRedisEnv)
+	if addr == "" {
+		return handlers
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("%s: %v", testRedisEnv, err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	h, err := Connect(config.StorageOptionsConf{Type: "redis", Host: host, Port: portNum, Database: 15}, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers["redis"] = h
+	return handlers
+}
+
+func TestHandlerKeys(t *testing.T) {
+	for name, h := range testHandlers(t, "test-keys-") {
+		h.DeleteKey("a")
+		h.DeleteKey("b")
+		h.DeleteKey("other")
+
+		if _, err := h.GetKey("a"); err != ErrKeyNotFound {
+			t.Errorf("%s: want %v, got %v", name, ErrKeyNotFound, err)
+		}
+		h.SetKey("a", "1", 0)
+		h.SetKey("b", "2", 60)
+		h.SetKey("other", "3", 0)
+		if v, err := h.GetKey("a"); err != nil || v != "1" {
+			t.Errorf("%s: want 1, got %q %v", name, v, err)
+		}
+
+		keys := h.GetKeys("")
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, []string{"a", "b", "other"}) {
+			t.Errorf("%s: want every key, got %v", name, keys)
+		}
+		if keys := h.GetKeys("o*"); !reflect.DeepEqual(keys, []string{"other"}) {
+			t.Errorf("%s: want the keys with the prefix, got %v", name, keys)
+		}
+
+		if exp, err := h.GetExp("a"); err != nil || exp != -1 {
+			t.Errorf("%s: want no expiry, got %d %v", name, exp, err)
+		}
+		if exp, err := h.GetExp("b"); err != nil || exp < 58 || exp > 60 {
+			t.Errorf("%s: want 60s to go, got %d %v", name, exp, err)
+		}
+		if err := h.SetExp("b", 0); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if exp, _ := h.GetExp("b"); exp != -1 {
+			t.Errorf("%s: want the expiry removed, got %d", name, exp)
+		}
+		if _, err := h.GetExp("missing"); err != ErrKeyNotFound {
+			t.Errorf("%s: want %v, got %v", name, ErrKeyNotFound, err)
+		}
+		if err := h.SetExp("missing", 10); err != ErrKeyNotFound {
+			t.Errorf("%s: want %v, got %v", name, ErrKeyNotFound, err)
+		}
+
+		if !h.DeleteKey("a") || h.DeleteKey("a") {
+			t.Errorf("%s: want a key deleted once", name)
+		}
+		h.DeleteKey("b")
+		h.DeleteKey("other")
+	}
+}
+
+func TestHandlerMultiKey(t *testing.T) {
+	for name, h := range testHandlers(t, "test-multi-") {
+		h.SetKey("a", "1", 0)
+		h.SetKey("b", "2", 0)
+
+		values, err := h.GetMultiKey([]string{"b", "missing", "a", "b"})
+		if err != nil || !reflect.DeepEqual(values, []string{"2", "", "1", "2"}) {
+			t.Errorf("%s: want [2  1 2], got %q %v", name, values, err)
+		}
+		if n := h.DeleteKeys([]string{"a", "b", "missing"}); n != 2 {
+			t.Errorf("%s: want 2 keys deleted, got %d", name, n)
+		}
+		if _, err := h.GetKey("a"); err != ErrKeyNotFound {
+			t.Errorf("%s: want the key deleted, got %v", name, err)
+		}
+		if values, err := h.GetMultiKey(nil); err != nil || len(values) != 0 {
+			t.Errorf("%s: want nothing, got %v %v", name, values, err)
+		}
+		if n := h.DeleteKeys(nil); n != 0 {
+			t.Errorf("%s: want nothing deleted, got %d", name, n)
+		}
+	}
+}
+
+func TestHandlerExpiry(t *testing.T) {
+	for name, h := range testHandlers(t, "test-expiry-") {
+		h.SetKey("a", "1", 1)
+		if n := h.IncrementWithExpire("counter", 1); n != 1 {
+			t.Errorf("%s: want 1, got %d", name, n)
+		}
+		if n := h.IncrementWithExpire("counter", 1); n != 2 {
+			t.Errorf("%s: want 2, got %d", name, n)
+		}
+		time.Sleep(1100 * time.Millisecond)
+		if _, err := h.GetKey("a"); err != ErrKeyNotFound {
+			t.Errorf("%s: want the key expired, got %v", name, err)
+		}
+		if n := h.IncrementWithExpire("counter", 1); n != 1 {
+			t.Errorf("%s: want a new window, got %d", name, n)
+		}
+		h.DeleteKey("counter")
+	}
+}
+
+func TestHandlerSets(t *testing.T) {
+	for name, h := range testHandlers(t, "test-sets-") {
+		h.DeleteKey("list")
+		h.DeleteKey("set")
+		h.DeleteKey("zset")
+
+		h.AppendToSet("list", "a")
+		h.AppendToSet("list", "b")
+		if got := h.GetAndDeleteSet("list"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("%s: want [a b], got %v", name, got)
+		}
+		if got := h.GetAndDeleteSet("list"); len(got) != 0 {
+			t.Errorf("%s: want the list deleted, got %v", name, got)
+		}
+
+		h.AddToSet("set", "a")
+		h.AddToSet("set", "b")
+		h.AddToSet("set", "a")
+		h.RemoveFromSet("set", "b")
+		if got, err := h.GetSet("set"); err != nil || !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("%s: want [a], got %v %v", name, got, err)
+		}
+		h.RemoveFromSet("set", "a")
+		if got, _ := h.GetSet("set"); len(got) != 0 {
+			t.Errorf("%s: want an empty set, got %v", name, got)
+		}
+
+		h.AddToSortedSet("zset", "c", 3)
+		h.AddToSortedSet("zset", "a", 1)
+		h.AddToSortedSet("zset", "b", 2)
+		h.AddToSortedSet("zset", "d", 4.5)
+		members, scores, err := h.GetSortedSetRange("zset", 2, math.Inf(1))
+		if err != nil || !reflect.DeepEqual(members, []string{"b", "c", "d"}) || !reflect.DeepEqual(scores, []float64{2, 3, 4.5}) {
+			t.Errorf("%s: want [b c d] [2 3 4.5], got %v %v %v", name, members, scores, err)
+		}
+		if err := h.RemoveSortedSetRange("zset", math.Inf(-1), 2); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if members, _, _ := h.GetSortedSetRange("zset", math.Inf(-1), math.Inf(1)); !reflect.DeepEqual(members, []string{"c", "d"}) {
+			t.Errorf("%s: want [c d] left, got %v", name, members)
+		}
+		h.DeleteKey("zset")
+	}
+}
+
+func TestHandlerPubSub(t *testing.T) {
+	for name, h := range testHandlers(t, "") {
+		received := make(chan string, 10)
+		unsubscribe, err := h.Subscribe("test-channel", func(msg string) { received <- msg })
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, msg := range []string{"one", "two"} {
+			if err := h.Publish("test-channel", msg); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		for _, want := range []string{"one", "two"} {
+			select {
+			case got := <-received:
+				if got != want {
+					t.Errorf("%s: want %s, got %s", name, want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: %s not received", name, want)
+			}
+		}
+
+		unsubscribe()
+		unsubscribe()
+		h.Publish("test-channel", "three")
+		select {
+		case got := <-received:
+			t.Errorf("%s: want nothing after unsubscribing, got %s", name, got)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	m := NewMemoryStorageManager("")
+	m.SetKey("a", "1", 1)
+	m.IncrementWithExpire("counter", 1)
+	m.SetKey("kept", "1", 0)
+
+	if n := m.sweepExpired(time.Now()); n != 0 {
+		t.Errorf("want nothing swept yet, got %d", n)
+	}
+	if n := m.sweepExpired(time.Now().Add(2 * time.Second)); n != 2 {
+		t.Errorf("want 2 keys swept, got %d", n)
+	}
+	if len(m.data) != 1 {
+		t.Errorf("want the key without an expiry kept, got %d keys", len(m.data))
+	}
+}
+
+func TestMemoryPubSubShared(t *testing.T) {
+	received := make(chan string, 1)
+	unsubscribe, _ := NewMemoryStorageManager("a-").Subscribe("shared", func(msg string) { received <- msg })
+	defer unsubscribe()
+
+	NewMemoryStorageManager("b-").Publish("shared", "hello")
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Errorf("want hello, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("want channels shared between handlers")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	if h, err := Connect(config.StorageOptionsConf{}, "p-"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := h.(*MemoryStorageManager); !ok {
+		t.Errorf("want memory storage by default, got %T", h)
+	}
+	if _, err := Connect(config.StorageOptionsConf{Type: "mongo"}, ""); err == nil {
+		t.Error("want an unknown type refused")
+	}
+
+	conf := config.StorageOptionsConf{Type: "redis", Host: "127.0.0.1", Port: 1}
+	a, _ := Connect(conf, "a-")
+	b, _ := Connect(conf, "b-")
+	if a.(*RedisStorageManager).client != b.(*RedisStorageManager).client {
+		t.Error("want handlers of the same storage to share a client")
+	}
+}
+
+func TestRedisOptions(t *testing.T) {
+	opts, err := redisOptions(config.StorageOptionsConf{})
+	if err != nil || !reflect.DeepEqual(opts.Addrs, []string{"localhost:6379"}) || opts.DialTimeout != defaultRedisTimeout || opts.TLSConfig != nil {
+		t.Errorf("unexpected defaults: %+v %v", opts, err)
+	}
+
+	opts, _ = redisOptions(config.StorageOptionsConf{
+		Host:                  "redis.internal",
+		Port:                  6380,
+		Password:              "secret",
+		Database:              3,
+		MaxIdle:               200,
+		MaxActive:             100,
+		Timeout:               2,
+		UseSSL:                true,
+		SSLInsecureSkipVerify: true,
+	})
+	switch {
+	case !reflect.DeepEqual(opts.Addrs, []string{"redis.internal:6380"}):
+		t.Errorf("unexpected addresses: %v", opts.Addrs)
+	case opts.DB != 3 || opts.Password != "secret":
+		t.Errorf("want database 3 with the password, got %d %q", opts.DB, opts.Password)
+	case opts.PoolSize != 100 || opts.MinIdleConns != 100:
+		t.Errorf("want 100 connections kept idle at most, got %d %d", opts.PoolSize, opts.MinIdleConns)
+	case opts.ReadTimeout != 2*time.Second || opts.WriteTimeout != 2*time.Second || opts.DialTimeout != 2*time.Second:
+		t.Errorf("want 2s timeouts, got %v %v %v", opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout)
+	case opts.MaxRetries != redisMaxRetries || opts.MinRetryBackoff != redisMinRetryBackoff:
+		t.Errorf("want commands retried, got %d %v", opts.MaxRetries, opts.MinRetryBackoff)
+	case opts.TLSConfig == nil || !opts.TLSConfig.InsecureSkipVerify:
+		t.Errorf("unexpected TLS config: %+v", opts.TLSConfig)
+	}
+
+	opts, _ = redisOptions(config.StorageOptionsConf{Host: "redis.internal", UseSSL: true})
+	if opts.TLSConfig.ServerName != "redis.internal" || opts.TLSConfig.InsecureSkipVerify {
+		t.Errorf("want the server verified, got %+v", opts.TLSConfig)
+	}
+}
+
+func TestRedisClusterTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// the certificate is for 127.0.0.1 and example.com, not localhost
+	for host, valid := range map[string]bool{"127.0.0.1": true, "localhost": false} {
+		addrs := []string{net.JoinHostPort(host, port)}
+		conf := redisTLSConfig(config.StorageOptionsConf{Addrs: addrs, EnableCluster: true, UseSSL: true}, addrs)
+		conf.RootCAs = roots
+		// as the client dials each node
+		conn, err := tls.DialWithDialer(&net.Dialer{}, "tcp", addrs[0], conf)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != valid {
+			t.Errorf("%s: want the host name verified, got %v", host, err)
+		}
+	}
+}
+
+func TestRedisModes(t *testing.T) {
+	for _, test := range []struct {
+		conf  config.StorageOptionsConf
+		mode  string
+		addrs []string
+	}{
+		{config.StorageOptionsConf{Host: "a"}, redisSingle, []string{"a:6379"}},
+		{config.StorageOptionsConf{Addrs: []string{"a:7000", "b:7000"}, EnableCluster: true}, redisCluster, []string{"a:7000", "b:7000"}},
+		{config.StorageOptionsConf{Hosts: map[string]string{"b": "7001", "a": "7000"}, EnableCluster: true}, redisCluster, []string{"a:7000", "b:7001"}},
+		{config.StorageOptionsConf{Addrs: []string{"s1:26379", "s2:26379"}, MasterName: "mymaster"}, redisSentinel, []string{"s1:26379", "s2:26379"}},
+		{config.StorageOptionsConf{Host: "s1", MasterName: "mymaster"}, redisSentinel, []string{"s1:26379"}},
+	} {
+		opts, err := redisOptions(test.conf)
+		if err != nil {
+			t.Errorf("%s: %v", test.mode, err)
+			continue
+		}
+		if mode := redisMode(test.conf); mode != test.mode || !reflect.DeepEqual(opts.Addrs, test.addrs) {
+			t.Errorf("want %s on %v, got %s on %v", test.mode, test.addrs, mode, opts.Addrs)
+		}
+		client := newRedisClient(test.mode, opts)
+		if _, ok := client.(*redis.ClusterClient); ok != (test.mode == redisCluster) {
+			t.Errorf("%s: unexpected client %T", test.mode, client)
+		}
+		client.Close()
+	}
+
+	for _, conf := range []config.StorageOptionsConf{
+		{Addrs: []string{"a:6379", "b:6379"}},
+		{EnableCluster: true, MasterName: "mymaster"},
+		{EnableCluster: true, Database: 1},
+		{MasterName: "mymaster", UseSSL: true},
+	} {
+		if _, err := redisOptions(conf); err == nil {
+			t.Errorf("want %+v refused", conf)
+		}
+	}
+	if _, err := Connect(config.StorageOptionsConf{Type: "redis", Addrs: []string{"a:6379", "b:6379"}}, ""); err == nil {
+		t.Error("want Connect to refuse an invalid configuration")
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	for key, want := range map[string]int{"": 0, "foo": 12182, "somekey": 11058} {
+		if got := keySlot(key); got != want {
+			t.Errorf("%q: want slot %d, got %d", key, want, got)
+		}
+	}
+	for key, hashed := range map[string]string{
+		"{user1000}.following": "user1000",
+		"x{user1000}":          "user1000",
+		"foo{bar}{zap}":        "bar",
+		"foo{{bar}}zap":        "{bar",
+		"foo{}{bar}":           "foo{}{bar}", // an empty tag hashes the whole key
+		"foo{bar":              "foo{bar",
+	} {
+		if keySlot(key) != keySlot(hashed) {
+			t.Errorf("%q: want the slot of %q", key, hashed)
+		}
+	}
+}
+
+func TestRedisSlotGroups(t *testing.T) {
+	keys := []string{"{a}.1", "{b}.1", "{a}.2"}
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"127.0.0.1:1"}})
+	defer client.Close()
+	cluster := NewRedisStorageManager(client, "p-")
+	if groups := cluster.slotGroups(keys); !reflect.DeepEqual(groups, [][]string{{"p-{a}.1", "p-{a}.2"}, {"p-{b}.1"}}) {
+		t.Errorf("want a group per slot, got %v", groups)
+	}
+
+	single := NewRedisStorageManager(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}), "p-")
+	if groups := single.slotGroups(keys); !reflect.DeepEqual(groups, [][]string{{"p-{a}.1", "p-{b}.1", "p-{a}.2"}}) {
+		t.Errorf("want every key together, got %v", groups)
+	}
+}
+
+// pongServer answers PING on addr until closed, like a Redis server would.
+func pongServer(t *testing.T, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					// a command is an array of bulk strings, two lines each
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					for i := 0; i < 2*n; i++ {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+					}
+					conn.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// waitForState waits for the monitor to report state.
+func waitForState(t *testing.T, m *redisMonitor, state string) ConnectionStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := m.status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %s, got %+v", state, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisMonitor(t *testing.T) {
+	ln := pongServer(t, "127.0.0.1:0")
+	addr := ln.Addr().String()
+	client := redis.NewClient(&redis.Options{Addr: addr, DialTimeout: time.Second})
+	defer client.Close()
+
+	m := newRedisMonitor(redisSingle, []string{addr}, client)
+	m.interval, m.minDelay, m.maxDelay = 20*time.Millisecond, 10*time.Millisecond, 40*time.Millisecond
+	if status := m.status(); status.State != StateConnecting || status.Mode != redisSingle {
+		t.Errorf("want connecting first, got %+v", status)
+	}
+	go m.run()
+	waitForState(t, m, StateConnected)
+
+	ln.Close()
+	if status := waitForState(t, m, StateDisconnected); status.LastError == "" {
+		t.Errorf("want the error reported, got %+v", status)
+	}
+
+	// the server is back
+	ln = pongServer(t, addr)
+	defer ln.Close()
+	waitForState(t, m, StateConnected)
+}
+
+func TestStatus(t *testing.T) {
+	conf := config.StorageOptionsConf{Type: "redis", Host: "127.0.0.1", Port: 2}
+	if _, err := Connect(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range Status() {
+		if reflect.DeepEqual(status.Addrs, []string{"127.0.0.1:2"}) {
+			if status.Type != "redis" || status.Mode != redisSingle {
+				t.Errorf("unexpected status: %+v", status)
+			}
+			return
+		}
+	}
+	t.Errorf("want the connection listed, got %+v", Status())
+}
@@ -0,0 +1,52 @@
+package user
+
+import "time"
+
+// AccessDefinition defines which versions of an API a key has access to
+type AccessDefinition struct {
+	APIName  string   `json:"api_name"`
+	APIID    string   `json:"api_id"`
+	Versions []string `json:"versions"`
+
+	// GRPCMethods limits the key to these methods of a gRPC API, given as
+	// /package.Service/Method or /package.Service/*. Empty allows every
+	// method.
+	GRPCMethods []string `json:"grpc_methods"`
+}
+
+// SessionState objects represent a current API session, mainly used for rate limiting.
+type SessionState struct {
+	OrgID            string                      `json:"org_id"`
+	Rate             float64                     `json:"rate"`
+	Per              float64                     `json:"per"`
+	Expires          int64                       `json:"expires"`
+	QuotaMax         int64                       `json:"quota_max"`
+	QuotaRenewalRate int64                       `json:"quota_renewal_rate"`
+	IsInactive       bool                        `json:"is_inactive"`
+	AccessRights     map[string]AccessDefinition `json:"access_rights"`
+	Alias            string                      `json:"alias"`
+	LastUpdated      string                      `json:"last_updated"`
+	Tags             []string                    `json:"tags"`
+
+	// MaxWebSocketConnections limits the open WebSocket connections of the
+	// key on each gateway node, zero means no limit.
+	MaxWebSocketConnections int64 `json:"max_websocket_connections"`
+}
+
+// IsExpired reports whether the session has an expiry date that has passed.
+func (s *SessionState) IsExpired() bool {
+	return s.Expires > 0 && time.Now().Unix() >= s.Expires
+}
+
+// Lifetime returns how long, in seconds, the session should be kept in
+// storage. Zero means it doesn't expire.
+func (s *SessionState) Lifetime() int64 {
+	if s.Expires <= 0 {
+		return 0
+	}
+	lifetime := s.Expires - time.Now().Unix()
+	if lifetime < 1 {
+		return 1
+	}
+	return lifetime
+}